@@ -28,18 +28,24 @@ func NewFakeBucketMapper(
 	idToProofSegment *Table,
 	outDir string,
 	bucketsMetadata Metadata,
-) *FakeBucketMapper {
-	all := OpenFileTable(outDir, "ablation", bucketsMetadata.RecordLen, 0)
+) (*FakeBucketMapper, error) {
+	all, err := OpenFileTable(outDir, "ablation", bucketsMetadata.RecordLen, 0)
+	if err != nil {
+		return nil, err
+	}
 	return &FakeBucketMapper{
 		accountToProofIds: accountToProofIds,
 		idToProofSegment:  idToProofSegment,
 		proofIdToRowId:    make(map[uint64]uint32),
 		all:               &all,
-	}
+	}, nil
 }
 
-func (b *FakeBucketMapper) MapAccountProofToBucketIndexes(addressHashBytes []byte) []BucketIndex {
-	proofIdBytes := b.accountToProofIds.Get(addressHashBytes)
+func (b *FakeBucketMapper) MapAccountProofToBucketIndexes(addressHashBytes []byte) ([]BucketIndex, error) {
+	proofIdBytes, err := b.accountToProofIds.Get(addressHashBytes)
+	if err != nil {
+		return nil, err
+	}
 	proofIds := bytesToUint64(proofIdBytes)
 	proofIds = dedupeUint64(proofIds)
 
@@ -47,8 +53,14 @@ func (b *FakeBucketMapper) MapAccountProofToBucketIndexes(addressHashBytes []byt
 	for _, proofId := range proofIds {
 		rowId, ok := b.proofIdToRowId[proofId]
 		if !ok {
-			proofSegment := b.idToProofSegment.Get(uint64ToKey(proofId))
-			rowId = b.all.Append(proofSegment)
+			proofSegment, err := b.idToProofSegment.Get(uint64ToKey(proofId))
+			if err != nil {
+				return nil, err
+			}
+			rowId, err = b.all.Append(proofSegment)
+			if err != nil {
+				return nil, err
+			}
 			b.proofIdToRowId[proofId] = uint32(rowId)
 		}
 		bucketIndexes = append(bucketIndexes, BucketIndex{RowId: rowId})
@@ -56,9 +68,9 @@ func (b *FakeBucketMapper) MapAccountProofToBucketIndexes(addressHashBytes []byt
 	for i := 0; i < 64-len(proofIds); i++ {
 		bucketIndexes = append(bucketIndexes, BucketIndex{RowId: math.MaxUint32})
 	}
-	return bucketIndexes
+	return bucketIndexes, nil
 }
 
-func (b *FakeBucketMapper) Close() {
-	b.all.Close()
+func (b *FakeBucketMapper) Close() error {
+	return b.all.Close()
 }
@@ -1,43 +1,52 @@
 package ethdataset
 
 import (
-	"log"
-
 	"github.com/cockroachdb/pebble"
 )
 
 type AccountTable struct {
 	DB *pebble.DB
+	wo *pebble.WriteOptions
 }
 
-func NewAccountTable(path string) *AccountTable {
-	return &AccountTable{
-		DB: openPebbleDB(path, "accounts"),
+func NewAccountTable(path string, pc PebbleConfig) (*AccountTable, error) {
+	db, err := openPebbleDB(path, "accounts", pc)
+	if err != nil {
+		return nil, err
 	}
+	return &AccountTable{
+		DB: db,
+		wo: pc.writeOptions("accounts"),
+	}, nil
 }
 
-func (at *AccountTable) Save(addressHash []byte, accountBytes []byte) {
-	if err := at.DB.Set(addressHash, accountBytes, pebble.NoSync); err != nil {
-		log.Fatal(err)
+// OpenAccountTableReadOnly opens an exported accounts table for reading.
+func OpenAccountTableReadOnly(path string, pc PebbleConfig) (*AccountTable, error) {
+	db, err := openPebbleDBReadOnly(path, "accounts", pc)
+	if err != nil {
+		return nil, err
 	}
+	return &AccountTable{
+		DB: db,
+	}, nil
 }
 
-func (at *AccountTable) Get(addressHash []byte) []byte {
-	b, c, err := at.DB.Get(addressHash)
+func (at *AccountTable) Save(addressHash []byte, accountBytes []byte) error {
+	return at.DB.Set(addressHash, accountBytes, at.wo)
+}
+
+// Get returns the account for addressHash, or an error wrapping ErrNotFound.
+func (at *AccountTable) Get(addressHash []byte) ([]byte, error) {
+	b, err := pebbleGet(at.DB, addressHash)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	dst := make([]byte, len(b))
-	copy(dst, b)
-
-	if err := c.Close(); err != nil {
-		log.Fatal(err)
+	if b == nil {
+		return nil, notFound("accounts", addressHash)
 	}
-
-	return dst
+	return b, nil
 }
 
-func (at *AccountTable) Close() {
-	at.DB.Close()
+func (at *AccountTable) Close() error {
+	return at.DB.Close()
 }
@@ -2,7 +2,7 @@ package ethdataset
 
 import (
 	"encoding/binary"
-	"log"
+	"fmt"
 	"unsafe"
 
 	"github.com/cockroachdb/pebble"
@@ -31,36 +31,39 @@ func bytesToUint64(data []byte) []uint64 {
 
 type AccountToProof struct {
 	db *pebble.DB
+	wo *pebble.WriteOptions
 }
 
-func NewAccountToProof(path string) *AccountToProof {
-	return &AccountToProof{
-		db: openPebbleDB(path, "accountToProof"),
+func NewAccountToProof(path string, pc PebbleConfig) (*AccountToProof, error) {
+	db, err := openPebbleDB(path, "accountToProof", pc)
+	if err != nil {
+		return nil, err
 	}
+	return &AccountToProof{
+		db: db,
+		wo: pc.writeOptions("accountToProof"),
+	}, nil
 }
 
-func (atp *AccountToProof) Save(addressHash []byte, proofIds []uint64) {
-	if err := atp.db.Set(addressHash, uint64SliceToBytesUnsafe(proofIds), pebble.NoSync); err != nil {
-		log.Fatal(err)
-	}
+func (atp *AccountToProof) Save(addressHash []byte, proofIds []uint64) error {
+	return atp.db.Set(addressHash, uint64SliceToBytesUnsafe(proofIds), atp.wo)
 }
 
-func (atp *AccountToProof) Get(addressHash []byte) []uint64 {
-	b, c, err := atp.db.Get(addressHash)
+// Get returns the proof ids for addressHash, or an error wrapping ErrNotFound.
+func (atp *AccountToProof) Get(addressHash []byte) ([]uint64, error) {
+	b, err := pebbleGet(atp.db, addressHash)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	dst := make([]byte, len(b))
-	copy(dst, b)
-
-	if err := c.Close(); err != nil {
-		log.Fatal(err)
+	if b == nil {
+		return nil, notFound("accountToProof", addressHash)
 	}
-
-	return bytesToUint64(dst)
+	if len(b)%8 != 0 {
+		return nil, corruptRecord("accountToProof", addressHash, fmt.Errorf("length %v is not a multiple of 8", len(b)))
+	}
+	return bytesToUint64(b), nil
 }
 
-func (atp *AccountToProof) Close() {
-	atp.db.Close()
+func (atp *AccountToProof) Close() error {
+	return atp.db.Close()
 }
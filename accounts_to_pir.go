@@ -3,6 +3,7 @@ package ethdataset
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
@@ -12,17 +13,47 @@ import (
 type AccountsToPIRConfig struct {
 	WorkDir string `toml:"work_dir"`
 	OutDir  string `toml:"out_dir"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
 }
 
-func AccountsToPIR(cfg AccountsToPIRConfig) {
-	os.MkdirAll(cfg.OutDir, os.ModePerm)
+func (c *AccountsToPIRConfig) Defaults() {
+	c.PebbleConfig.defaults(ProfileReadMostly)
+}
 
-	accountTable := NewAccountTable(cfg.WorkDir)
+func (c *AccountsToPIRConfig) Validate() error {
+	return errors.Join(
+		requireField("work_dir", c.WorkDir),
+		requireField("out_dir", c.OutDir),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+}
+
+func AccountsToPIR(cfg AccountsToPIRConfig) error {
+	if err := os.MkdirAll(cfg.OutDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	m, err := requireTables(cfg.WorkDir, "accounts")
+	if err != nil {
+		return err
+	}
+	if err := recordPinnedState(cfg.OutDir, m.PinnedState); err != nil {
+		return err
+	}
+	if err := startTables(cfg.OutDir, "accounts-to-pir", cfg, "accounts-pir"); err != nil {
+		return err
+	}
+
+	accountTable, err := OpenAccountTableReadOnly(cfg.WorkDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer accountTable.Close()
 
 	iter, err := accountTable.DB.NewIter(nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer iter.Close()
 
@@ -43,10 +74,13 @@ func AccountsToPIR(cfg AccountsToPIRConfig) {
 			log.Printf("%v %v %v\n", nRecords, elapsed, maxLen)
 		}
 	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
 
 	metadataFile, err := os.OpenFile(filepath.Join(cfg.OutDir, "accounts-pir-metadata.json"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer metadataFile.Close()
 	enc := json.NewEncoder(metadataFile)
@@ -58,12 +92,12 @@ func AccountsToPIR(cfg AccountsToPIRConfig) {
 		NRecords:  nRecords,
 		RecordLen: maxLen,
 	}); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	dataFile, err := os.OpenFile(filepath.Join(cfg.OutDir, "accounts-pir.bin"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer dataFile.Close()
 
@@ -77,7 +111,15 @@ func AccountsToPIR(cfg AccountsToPIRConfig) {
 		copy(buf[32:], slimAccount)
 
 		if _, err := w.Write(buf); err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return completeTable(cfg.OutDir, "accounts-pir", uint64(nRecords))
 }
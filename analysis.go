@@ -26,10 +26,12 @@ type SlotInfo struct {
 	CompressedProof []uint64
 }
 
+// AnalysisPass is fed every account of a Run. The CodeDeduper passed to
+// OnComplete is nil unless code was exported.
 type AnalysisPass interface {
 	OnStart(StateInfo)
 	OnAccount(AccountInfo) AccountAnalysisPass
-	OnComplete(CodeDeduper, ProofDB)
+	OnComplete(*CodeDeduper, *ProofDB)
 }
 
 type AccountAnalysisPass interface {
@@ -47,7 +49,7 @@ func (n *NopAnalysis) OnAccount(AccountInfo) AccountAnalysisPass {
 	return &NopAccountAnalysis{}
 }
 
-func (n *NopAnalysis) OnComplete(CodeDeduper, ProofDB) {}
+func (n *NopAnalysis) OnComplete(*CodeDeduper, *ProofDB) {}
 
 type NopAccountAnalysis struct{}
 
@@ -1,6 +1,7 @@
 package ethdataset
 
 import (
+	"errors"
 	"log"
 	"os"
 	"math/rand"
@@ -10,28 +11,56 @@ import (
 type BucketExperimentCfg struct {
 	WorkDir string `toml:"work_dir"`
 	OutDir  string `toml:"out_dir"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *BucketExperimentCfg) Defaults() {
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
+
+func (c *BucketExperimentCfg) Validate() error {
+	return errors.Join(
+		requireField("work_dir", c.WorkDir),
+		requireField("out_dir", c.OutDir),
+		c.PebbleConfig.validate("pebble_config"),
+	)
 }
 
-func BucketExperiment(cfg BucketExperimentCfg) {
+func BucketExperiment(cfg BucketExperimentCfg) error {
 	rand.Seed(time.Now().UnixNano())
 
-	os.MkdirAll(cfg.OutDir, os.ModePerm)
+	if err := os.MkdirAll(cfg.OutDir, os.ModePerm); err != nil {
+		return err
+	}
 
-	accountTable := NewTable(cfg.WorkDir, "accounts")
+	if _, err := requireTables(cfg.WorkDir, "accounts", "accountToProof", "idToProofSegment"); err != nil {
+		return err
+	}
+
+	accountTable, err := OpenTableReadOnly(cfg.WorkDir, "accounts", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer accountTable.Close()
 
 	iter, err := accountTable.DB.NewIter(nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer iter.Close()
 
-	proofBucketMapper := NewBucketMapper(
+	proofBucketMapper, err := NewBucketMapper(
 		cfg.WorkDir,
 		cfg.OutDir,
 		3,
 		64,
 		proofSegmentMetadata,
+		cfg.PebbleConfig,
 	)
+	if err != nil {
+		return err
+	}
 	defer proofBucketMapper.Close()
 
 	log.Println("Gathering accounts")
@@ -48,6 +77,9 @@ func BucketExperiment(cfg BucketExperimentCfg) {
 			log.Printf("%v\n", i)
 		}
 	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
 	log.Printf("Gathered %v accounts\n", len(accounts))
 
 	rand.Shuffle(len(accounts), func(i, j int) {
@@ -56,12 +88,14 @@ func BucketExperiment(cfg BucketExperimentCfg) {
 
 	i = 0
 	for _, addressHashBytes := range accounts {
-		proofBucketMapper.MapAccountProofToBucketIndexes(addressHashBytes)
+		if _, err := proofBucketMapper.MapAccountProofToBucketIndexes(addressHashBytes); err != nil {
+			return err
+		}
 		i += 1
 		if i % 100_000 == 0 {
 			log.Printf("%+v\n", proofBucketMapper.Stats())
 		}
 	}
-	iter.Close()
 	log.Printf("%+v\n", proofBucketMapper.Stats())
+	return nil
 }
@@ -1,12 +1,27 @@
 package ethdataset
 
 import (
+	"errors"
 	"log"
 )
 
 type BucketSimluationConfig struct {
 	StateRoot string `toml:"state_root"`
 	WorkDir   string `toml:"work_dir"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *BucketSimluationConfig) Defaults() {
+	c.PebbleConfig.defaults(ProfileReadMostly)
+}
+
+func (c *BucketSimluationConfig) Validate() error {
+	return errors.Join(
+		validateHash("state_root", c.StateRoot),
+		requireField("work_dir", c.WorkDir),
+		c.PebbleConfig.validate("pebble_config"),
+	)
 }
 
 type Bucket struct {
@@ -21,17 +36,28 @@ func (s *Bucket) Append(v uint32) uint32 {
 	return id
 }
 
-func BucketSimluation(cfg BucketSimluationConfig) {
+func BucketSimluation(cfg BucketSimluationConfig) error {
 	nTreeTop := 3
 	nBuckets := 64
 	buckets := make([]Bucket, nBuckets)
 
-	accountToProof := openPebbleDB(cfg.WorkDir, "accountToProof")
+	m, err := requireTables(cfg.WorkDir, "accountToProof")
+	if err != nil {
+		return err
+	}
+	if err := requireStateRoot(cfg.WorkDir, m, cfg.StateRoot); err != nil {
+		return err
+	}
+
+	accountToProof, err := openPebbleDBReadOnly(cfg.WorkDir, "accountToProof", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer accountToProof.Close()
 
 	iter, err := accountToProof.NewIter(nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer iter.Close()
 
@@ -114,6 +140,10 @@ func BucketSimluation(cfg BucketSimluationConfig) {
 		}
 	}
 
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
 	mmin := buckets[0].nextId
 	mmax := buckets[0].nextId
 	for i, b := range buckets {
@@ -126,4 +156,5 @@ func BucketSimluation(cfg BucketSimluationConfig) {
 		}
 	}
 	log.Printf("Min=%v Max=%v Spread=%v\n", mmin, mmax, mmax-mmin)
+	return nil
 }
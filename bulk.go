@@ -0,0 +1,223 @@
+package ethdataset
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+	"github.com/cockroachdb/pebble/objstorage/objstorageprovider"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+const (
+	// sstTargetFileSize is how large an SST grows before it is ingested.
+	sstTargetFileSize = 256 << 20
+	// batchWriteSize is how large a batch grows before it is committed.
+	batchWriteSize = 16 << 20
+)
+
+// BulkLoader loads sorted runs of keys into a table by writing them to SST
+// files and ingesting those, skipping the memtable, WAL and most of the
+// compaction work that DB.Set pays for.
+type BulkLoader struct {
+	db         *pebble.DB
+	stagingDir string
+	format     sstable.TableFormat
+
+	mu      sync.Mutex
+	writers map[int]*SSTWriter
+}
+
+// NewBulkLoader stages SSTs for the table name in path next to it. Anything
+// left staged by a crashed run is discarded, as it was never ingested.
+func NewBulkLoader(db *pebble.DB, path, name string) (*BulkLoader, error) {
+	stagingDir := filepath.Join(path, name+".ingest")
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(stagingDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &BulkLoader{
+		db:         db,
+		stagingDir: stagingDir,
+		format:     db.FormatMajorVersion().MaxTableFormat(),
+		writers:    make(map[int]*SSTWriter),
+	}, nil
+}
+
+// Writer returns the writer for sorted run i, e.g. one range of a StateWalk.
+func (l *BulkLoader) Writer(i int) *SSTWriter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w, ok := l.writers[i]
+	if !ok {
+		w = &SSTWriter{loader: l, run: i}
+		l.writers[i] = w
+	}
+	return w
+}
+
+// Flush ingests everything written so far.
+func (l *BulkLoader) Flush() error {
+	l.mu.Lock()
+	writers := make([]*SSTWriter, 0, len(l.writers))
+	for _, w := range l.writers {
+		writers = append(writers, w)
+	}
+	l.mu.Unlock()
+
+	for _, w := range writers {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close ingests everything written so far and removes the staging dir. The
+// table itself is left open.
+func (l *BulkLoader) Close() error {
+	if err := l.Flush(); err != nil {
+		return err
+	}
+	return os.RemoveAll(l.stagingDir)
+}
+
+// SSTWriter writes one sorted run. Keys passed to Set must be strictly
+// increasing.
+type SSTWriter struct {
+	loader *BulkLoader
+	run    int
+
+	mu      sync.Mutex
+	w       *sstable.Writer
+	path    string
+	nFiles  int
+	lastKey []byte
+}
+
+func (w *SSTWriter) Set(key, value []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Checked across SSTs too, as ingested ones must not overlap.
+	if w.lastKey != nil && bytes.Compare(key, w.lastKey) <= 0 {
+		return fmt.Errorf("bulk load run %v: key %x not after %x", w.run, key, w.lastKey)
+	}
+	if w.w == nil {
+		if err := w.create(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.w.Set(key, value); err != nil {
+		return err
+	}
+	w.lastKey = append(w.lastKey[:0], key...)
+
+	if w.w.EstimatedSize() >= sstTargetFileSize {
+		return w.ingest()
+	}
+	return nil
+}
+
+// Flush ingests the SST being written, if any.
+func (w *SSTWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ingest()
+}
+
+func (w *SSTWriter) create() error {
+	w.path = filepath.Join(w.loader.stagingDir, fmt.Sprintf("%06d-%06d.sst", w.run, w.nFiles))
+	w.nFiles += 1
+	f, err := vfs.Default.Create(w.path)
+	if err != nil {
+		return err
+	}
+	w.w = sstable.NewWriter(objstorageprovider.NewFileWritable(f), sstable.WriterOptions{
+		TableFormat:  w.loader.format,
+		FilterPolicy: bloom.FilterPolicy(10),
+	})
+	return nil
+}
+
+func (w *SSTWriter) ingest() error {
+	if w.w == nil {
+		return nil
+	}
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	w.w = nil
+	return w.loader.db.Ingest([]string{w.path})
+}
+
+// BatchWriter groups writes to a table whose keys don't arrive in order into
+// batches, committing each once it reaches batchWriteSize.
+type BatchWriter struct {
+	db *pebble.DB
+	wo *pebble.WriteOptions
+
+	mu sync.Mutex
+	b  *pebble.Batch
+}
+
+func NewBatchWriter(db *pebble.DB, wo *pebble.WriteOptions) *BatchWriter {
+	return &BatchWriter{
+		db: db,
+		wo: wo,
+		b:  db.NewBatch(),
+	}
+}
+
+func (w *BatchWriter) Set(key, value []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.b.Set(key, value, nil); err != nil {
+		return err
+	}
+	if w.b.Len() >= batchWriteSize {
+		return w.commit()
+	}
+	return nil
+}
+
+func (w *BatchWriter) Delete(key []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.b.Delete(key, nil); err != nil {
+		return err
+	}
+	if w.b.Len() >= batchWriteSize {
+		return w.commit()
+	}
+	return nil
+}
+
+// Flush commits the pending batch.
+func (w *BatchWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.commit()
+}
+
+func (w *BatchWriter) commit() error {
+	if w.b.Empty() {
+		return nil
+	}
+	if err := w.b.Commit(w.wo); err != nil {
+		return err
+	}
+	if err := w.b.Close(); err != nil {
+		return err
+	}
+	w.b = w.db.NewBatch()
+	return nil
+}
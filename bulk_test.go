@@ -0,0 +1,93 @@
+package ethdataset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// benchValueSize is about the size of an accountToProof record.
+const benchValueSize = 100
+
+// BenchmarkTableWrites writes b.N keccak keyed records to a fresh table in a
+// temp dir with DB.Set, with SST ingestion for sorted keys and with the
+// batched path for unsorted ones. Each write includes the final flush.
+func BenchmarkTableWrites(b *testing.B) {
+	pc := testPebbleConfig()
+	value := make([]byte, benchValueSize)
+	set := func(db *pebble.DB, dir, name string, keys [][]byte) error {
+		wo := pc.writeOptions(name)
+		for _, k := range keys {
+			if err := db.Set(k, value, wo); err != nil {
+				return err
+			}
+		}
+		return db.Flush()
+	}
+
+	cases := []struct {
+		name   string
+		sorted bool
+		write  func(db *pebble.DB, dir, name string, keys [][]byte) error
+	}{
+		{"sorted/set", true, set},
+		{"sorted/sst", true, func(db *pebble.DB, dir, name string, keys [][]byte) error {
+			loader, err := NewBulkLoader(db, dir, name)
+			if err != nil {
+				return err
+			}
+			w := loader.Writer(0)
+			for _, k := range keys {
+				if err := w.Set(k, value); err != nil {
+					return err
+				}
+			}
+			if err := loader.Close(); err != nil {
+				return err
+			}
+			return db.Flush()
+		}},
+		{"unsorted/set", false, set},
+		{"unsorted/batch", false, func(db *pebble.DB, dir, name string, keys [][]byte) error {
+			w := NewBatchWriter(db, pc.writeOptions(name))
+			for _, k := range keys {
+				if err := w.Set(k, value); err != nil {
+					return err
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			return db.Flush()
+		}},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			keys := make([][]byte, b.N)
+			for i := range keys {
+				var n [8]byte
+				binary.LittleEndian.PutUint64(n[:], uint64(i))
+				keys[i] = crypto.Keccak256(n[:])
+			}
+			if c.sorted {
+				sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+			}
+			dir := b.TempDir()
+			db, err := openPebbleDB(dir, "bench", pc)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			b.SetBytes(32 + benchValueSize)
+			b.ResetTimer()
+			if err := c.write(db, dir, "bench", keys); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
@@ -1,6 +1,150 @@
 package ethdataset
 
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/triedb"
+)
+
+// stateRootSearchDepth bounds how far back from the head we look for the block
+// carrying a configured state root.
+const stateRootSearchDepth uint64 = 90_000
+
 type ChainConfig struct {
 	DataDir     string `toml:"data_dir"`
 	AncientsDir string `toml:"ancients_dir"`
+
+	// At most one of BlockNumber, BlockHash and StateRoot pins the state to
+	// export. The chain head is used when none are set.
+	BlockNumber *uint64 `toml:"block_number"`
+	BlockHash   string  `toml:"block_hash"`
+	StateRoot   string  `toml:"state_root"`
+}
+
+// IsPinned reports whether the config selects a block other than the head.
+func (c ChainConfig) IsPinned() bool {
+	return c.BlockNumber != nil || c.BlockHash != "" || c.StateRoot != ""
+}
+
+// pinErr fails if more than one of BlockNumber, BlockHash and StateRoot is set.
+func (c ChainConfig) pinErr(field string) error {
+	nPins := 0
+	if c.BlockNumber != nil {
+		nPins += 1
+	}
+	if c.BlockHash != "" {
+		nPins += 1
+	}
+	if c.StateRoot != "" {
+		nPins += 1
+	}
+	if nPins > 1 {
+		return &ConfigError{Field: field, Reason: "set at most one of block_number, block_hash and state_root"}
+	}
+	return nil
+}
+
+func (c ChainConfig) validate(prefix string) error {
+	return errors.Join(
+		requireField(prefix+".data_dir", c.DataDir),
+		validateHash(prefix+".block_hash", c.BlockHash),
+		validateHash(prefix+".state_root", c.StateRoot),
+		c.pinErr(prefix),
+	)
+}
+
+// PinnedState identifies the canonical block whose state is being exported.
+type PinnedState struct {
+	BlockNumber uint64      `json:"block_number"`
+	BlockHash   common.Hash `json:"block_hash"`
+	StateRoot   common.Hash `json:"state_root"`
+}
+
+func pinnedStateOf(header *types.Header) PinnedState {
+	return PinnedState{
+		BlockNumber: header.Number.Uint64(),
+		BlockHash:   header.Hash(),
+		StateRoot:   header.Root,
+	}
+}
+
+// resolveHeader finds the canonical header selected by cfg.
+func resolveHeader(cfg ChainConfig, chainDB ethdb.Database) (*types.Header, error) {
+	if err := cfg.pinErr("chain_config"); err != nil {
+		return nil, err
+	}
+
+	head := rawdb.ReadHeadHeader(chainDB)
+	if head == nil {
+		return nil, fmt.Errorf("chain database has no head header")
+	}
+
+	switch {
+	case cfg.BlockNumber != nil:
+		number := *cfg.BlockNumber
+		hash := rawdb.ReadCanonicalHash(chainDB, number)
+		if hash == (common.Hash{}) {
+			return nil, &ConfigError{Field: "chain_config.block_number", Reason: fmt.Sprintf("no canonical block %v (head is %v)", number, head.Number)}
+		}
+		return readHeader(chainDB, hash, number)
+
+	case cfg.BlockHash != "":
+		hash := common.HexToHash(cfg.BlockHash)
+		number, ok := rawdb.ReadHeaderNumber(chainDB, hash)
+		if !ok {
+			return nil, &ConfigError{Field: "chain_config.block_hash", Reason: fmt.Sprintf("unknown block %v", hash)}
+		}
+		if canonical := rawdb.ReadCanonicalHash(chainDB, number); canonical != hash {
+			return nil, &ConfigError{Field: "chain_config.block_hash", Reason: fmt.Sprintf("block %v is not canonical, canonical block %v is %v", hash, number, canonical)}
+		}
+		return readHeader(chainDB, hash, number)
+
+	case cfg.StateRoot != "":
+		root := common.HexToHash(cfg.StateRoot)
+		header := head
+		for i := uint64(0); i < stateRootSearchDepth && header != nil; i++ {
+			if header.Root == root {
+				return header, nil
+			}
+			if header.Number.Uint64() == 0 {
+				break
+			}
+			header = rawdb.ReadHeader(chainDB, header.ParentHash, header.Number.Uint64()-1)
+		}
+		return nil, &ConfigError{Field: "chain_config.state_root", Reason: fmt.Sprintf("%v not found in the last %v canonical blocks", root, stateRootSearchDepth)}
+	}
+
+	return head, nil
+}
+
+func readHeader(chainDB ethdb.Database, hash common.Hash, number uint64) (*types.Header, error) {
+	header := rawdb.ReadHeader(chainDB, hash, number)
+	if header == nil {
+		return nil, fmt.Errorf("header %v (block %v): %w", hash, number, ErrNotFound)
+	}
+	return header, nil
+}
+
+// ResolvePinnedState resolves cfg against the canonical chain and checks that
+// the state trie for the selected block can actually be read.
+func ResolvePinnedState(cfg ChainConfig, chainDB ethdb.Database, trieDB *triedb.Database) (PinnedState, error) {
+	header, err := resolveHeader(cfg, chainDB)
+	if err != nil {
+		return PinnedState{}, err
+	}
+	pinned := pinnedStateOf(header)
+
+	if _, err := trie.New(trie.StateTrieID(pinned.StateRoot), trieDB); err != nil {
+		return PinnedState{}, fmt.Errorf("state for block %v (StateRoot=%v) is not available in the %v trie database, it was likely pruned: %w", pinned.BlockNumber, pinned.StateRoot, trieDB.Scheme(), err)
+	}
+
+	log.Printf("Pinned BlockNumber=%v BlockHash=%v StateRoot=%v\n", pinned.BlockNumber, pinned.BlockHash, pinned.StateRoot)
+	return pinned, nil
 }
@@ -0,0 +1,103 @@
+package ethdataset
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+const checkpointInterval uint64 = 1_000_000
+
+// RangeCheckpoint tracks progress through one key range of a partitioned walk.
+type RangeCheckpoint struct {
+	Start     hexutil.Bytes `json:"start"`
+	End       hexutil.Bytes `json:"end"`
+	LastKey   hexutil.Bytes `json:"last_key"`
+	NAccounts uint64        `json:"n_accounts"`
+	Complete  bool          `json:"complete"`
+}
+
+// Checkpoint records how far an exporter got through the state trie so that a
+// crashed run can pick up where it left off instead of starting from key zero.
+type Checkpoint struct {
+	StateRoot common.Hash       `json:"state_root"`
+	NAccounts uint64            `json:"n_accounts"`
+	Ranges    []RangeCheckpoint `json:"ranges"`
+	// NextProofId is the last proof id handed out by the ProofDB, if any.
+	NextProofId uint64 `json:"next_proof_id,omitempty"`
+	Complete    bool   `json:"complete"`
+}
+
+func checkpointPath(workDir, name string) string {
+	return filepath.Join(workDir, fmt.Sprintf("%v.checkpoint.json", name))
+}
+
+// ReadCheckpoint returns the checkpoint for name in workDir, or nil if the
+// exporter has never checkpointed there.
+func ReadCheckpoint(workDir, name string) (*Checkpoint, error) {
+	path := checkpointPath(workDir, name)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, corruptRecord(path, nil, err)
+	}
+	return &cp, nil
+}
+
+// WriteCheckpoint atomically replaces the checkpoint for name in workDir.
+func WriteCheckpoint(workDir, name string, cp *Checkpoint) error {
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(checkpointPath(workDir, name), b)
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// resumeCheckpoint loads the checkpoint for name and checks that it was taken
+// against stateRoot over the same number of ranges. A fresh checkpoint over
+// ranges is returned if none exists.
+func resumeCheckpoint(workDir, name string, stateRoot common.Hash, ranges []KeyRange) (*Checkpoint, error) {
+	cp, err := ReadCheckpoint(workDir, name)
+	if err != nil {
+		return nil, err
+	}
+	if cp == nil {
+		cp = &Checkpoint{StateRoot: stateRoot}
+		for _, r := range ranges {
+			cp.Ranges = append(cp.Ranges, RangeCheckpoint{Start: r.Start, End: r.End})
+		}
+		return cp, nil
+	}
+	if cp.StateRoot != stateRoot {
+		return nil, fmt.Errorf("refusing to resume %v: checkpoint pinned StateRoot=%v but chain has StateRoot=%v", name, cp.StateRoot, stateRoot)
+	}
+	if len(cp.Ranges) != len(ranges) {
+		return nil, fmt.Errorf("refusing to resume %v: checkpoint has %v ranges but walk_config.prefix_nibbles gives %v", name, len(cp.Ranges), len(ranges))
+	}
+	if cp.Complete {
+		log.Printf("Checkpoint for %v is already complete NAccounts=%v\n", name, cp.NAccounts)
+	} else {
+		log.Printf("Resuming %v NAccounts=%v\n", name, cp.NAccounts)
+	}
+	return cp, nil
+}
@@ -1,23 +0,0 @@
-package main
-
-import (
-	"flag"
-
-	"ethdataset"
-)
-
-var (
-	path string
-)
-
-func init() {
-	flag.StringVar(&path, "path", "./config.toml", "")
-}
-
-func main() {
-	flag.Parse()
-
-	var cfg ethdataset.BucketSimluationConfig
-	ethdataset.ReadConfig(path, &cfg)
-	ethdataset.BucketSimluation(cfg)
-}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"ethdataset"
+)
+
+type command struct {
+	name     string
+	summary  string
+	children []*command
+
+	// workDirKeys are the config fields set by the global -work-dir flag.
+	workDirKeys []string
+	newConfig   func() ethdataset.Config
+	run         func(cfg ethdataset.Config) error
+}
+
+func leaf[C any, PC interface {
+	*C
+	ethdataset.Config
+}](name, summary string, workDirKeys []string, run func(C) error) *command {
+	return &command{
+		name:        name,
+		summary:     summary,
+		workDirKeys: workDirKeys,
+		newConfig:   func() ethdataset.Config { return PC(new(C)) },
+		run:         func(cfg ethdataset.Config) error { return run(*cfg.(PC)) },
+	}
+}
+
+func group(name, summary string, children ...*command) *command {
+	return &command{name: name, summary: summary, children: children}
+}
+
+var workDir = []string{"work_dir"}
+
+var commands = group("ethdataset", "export and serve Ethereum state",
+	group("export", "export state from a local geth node",
+		leaf("accounts", "export accounts", workDir, ethdataset.ExportAccounts),
+		leaf("proofs", "export deduplicated account proofs", workDir, ethdataset.ExportProofs),
+		leaf("code", "export contract code for exported accounts", []string{"work_dir", "account_work_dir"}, ethdataset.ExportCode),
+		leaf("storage", "export storage slots", workDir, ethdataset.ExportStorage),
+		leaf("storage-proofs", "export deduplicated storage proofs", []string{"input_dir", "output_dir"}, ethdataset.ExportStorageProofs),
+		leaf("exclusion-proofs", "export deduplicated proofs that address hashes have no account", workDir, ethdataset.ExportExclusionProofs),
+		leaf("preimages", "export address and slot preimages from geth or a list", workDir, ethdataset.ExportPreimages),
+	),
+	group("pir", "build PIR datasets from exported tables",
+		leaf("generate", "generate the bucketed account and proof PIR dataset", workDir, ethdataset.GeneratePIRDataset),
+		leaf("accounts", "write accounts as fixed size PIR records", workDir, ethdataset.AccountsToPIR),
+	),
+	group("verify", "verify exported tables",
+		leaf("proofs", "verify every account proof against the state root", workDir, ethdataset.Verify),
+		leaf("storage-proofs", "verify every storage slot proof against its account's storage root", workDir, ethdataset.VerifyStorage),
+		leaf("pir", "verify account proofs read back out of a generated PIR dataset", []string{"pir_dir"}, ethdataset.VerifyPIR),
+		leaf("state-root", "recompute the state root, and optionally storage roots, from the exported tables", workDir, ethdataset.VerifyStateRoot),
+		leaf("node-encoding", "check proof segments re-encode byte for byte after parsing", workDir, ethdataset.VerifyNodeEncoding),
+		leaf("witness", "verify a witness and print the accounts and slots it proves", nil, ethdataset.VerifyWitness),
+		leaf("all", "verify accounts, code, storage and proofs against the chain", workDir, ethdataset.VerifyAll),
+	),
+	group("proofs", "maintain exported proof tables",
+		leaf("migrate-index", "rebuild a ProofDB's segment index keyed by node hash or node bytes", workDir, ethdataset.MigrateProofIndex),
+		leaf("renumber", "give proof segments dense ids ordered by trie depth and rewrite the proof id tables", workDir, ethdataset.RenumberProofs),
+		leaf("repin", "move a work dir to a new state, keeping its ProofDBs for the new proofs to share", workDir, ethdataset.Repin),
+		leaf("gc", "remove proof segments no proof refers to and report the reclaimed bytes", workDir, ethdataset.GCProofs),
+		leaf("trace", "print the node by node walk of one account proof", workDir, ethdataset.TraceProof),
+		leaf("witness", "write one deduplicated witness for a set of accounts and slots", workDir, ethdataset.BuildWitness),
+	),
+	group("lookup", "look up exported records by address",
+		leaf("account", "print the account, proof and slots of an address or address hash", workDir, ethdataset.LookupAccount),
+		leaf("preimage", "print the address or slot an exported hash is the hash of", workDir, ethdataset.LookupPreimage),
+	),
+	leaf("analyze", "walk the state trie and report proof and code sizes", workDir, func(cfg ethdataset.RunConfig) error {
+		return ethdataset.Run(cfg, &ethdataset.SizeAnalysis{})
+	}),
+	group("experiment", "bucketing and hashing experiments",
+		leaf("buckets", "simulate assigning proof segments to buckets", workDir, ethdataset.BucketSimluation),
+		leaf("bucket-mapper", "run the bucket mapper over a sample of accounts", workDir, ethdataset.BucketExperiment),
+		leaf("cuckoo", "build a cuckoo hashed account dataset", workDir, ethdataset.ExperimentDataset),
+	),
+	group("config", "inspect configuration",
+		&command{name: "print", summary: "print the fully resolved configuration of a command"},
+	),
+)
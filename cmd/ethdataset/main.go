@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"ethdataset"
+)
+
+const defaultConfigPath = "./config.toml"
+
+type globalFlags struct {
+	config       string
+	workDir      string
+	chainDataDir string
+	logLevel     string
+}
+
+// register adds the global flags to fs. They are accepted both before and
+// after the subcommand, so the current values are used as defaults.
+func (g *globalFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.config, "config", g.config, "TOML config `path`, "+defaultConfigPath+" is used if present")
+	fs.StringVar(&g.workDir, "work-dir", g.workDir, "work `dir` holding exported tables, overrides the config")
+	fs.StringVar(&g.chainDataDir, "chain-data-dir", g.chainDataDir, "geth data `dir`, overrides chain_config.data_dir")
+	fs.StringVar(&g.logLevel, "log-level", g.logLevel, "one of debug, info or error")
+}
+
+func (g *globalFlags) setupLogging() error {
+	switch g.logLevel {
+	case "debug":
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
+	case "info":
+	case "error":
+		log.SetOutput(io.Discard)
+	default:
+		return fmt.Errorf("unknown -log-level %q, want debug, info or error", g.logLevel)
+	}
+	return nil
+}
+
+func main() {
+	g := &globalFlags{logLevel: "info"}
+	g.register(flag.CommandLine)
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: ethdataset [global flags] <command> [flags]\n\nCommands:\n")
+		printCommands(out, commands, "")
+		fmt.Fprintf(out, "\nGlobal flags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(g, flag.Args()); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "ethdataset: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(g *globalFlags, args []string) error {
+	cmd, path, args, err := resolve(args)
+	if err != nil {
+		return err
+	}
+
+	printConfig := false
+	if path == "config print" {
+		printConfig = true
+		cmd, path, args, err = resolve(args)
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg, err := loadConfig(g, cmd, path, args)
+	if err != nil {
+		return err
+	}
+	if printConfig {
+		// Print even an invalid config, it's usually why it's being printed.
+		if err := toml.NewEncoder(os.Stdout).Encode(cfg); err != nil {
+			return err
+		}
+		return cfg.Validate()
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if err := g.setupLogging(); err != nil {
+		return err
+	}
+	return cmd.run(cfg)
+}
+
+// resolve walks args down the command tree to a leaf, returning the leaf, its
+// space separated path and the remaining args.
+func resolve(args []string) (*command, string, []string, error) {
+	cmd := commands
+	var path []string
+	for len(cmd.children) != 0 {
+		if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+			if len(path) == 0 {
+				flag.Usage()
+			} else {
+				printGroupUsage(cmd, path)
+			}
+			return nil, "", nil, flag.ErrHelp
+		}
+		var next *command
+		for _, child := range cmd.children {
+			if child.name == args[0] {
+				next = child
+			}
+		}
+		if next == nil {
+			return nil, "", nil, fmt.Errorf("unknown command %q, run ethdataset -h for a list", strings.Join(append(path, args[0]), " "))
+		}
+		cmd = next
+		path = append(path, args[0])
+		args = args[1:]
+	}
+	return cmd, strings.Join(path, " "), args, nil
+}
+
+// configOverride is a flag that records its value so that it can be applied on
+// top of the TOML config once that has been read.
+type configOverride struct {
+	name      string
+	isBool    bool
+	overrides *[][2]string
+}
+
+func (o *configOverride) String() string   { return "" }
+func (o *configOverride) IsBoolFlag() bool { return o.isBool }
+func (o *configOverride) Set(s string) error {
+	*o.overrides = append(*o.overrides, [2]string{o.name, s})
+	return nil
+}
+
+// loadConfig builds the config for cmd. Later sources win: the defaults, the
+// TOML file, the environment, the global flags and then the subcommand's own
+// flags. The result is not validated.
+func loadConfig(g *globalFlags, cmd *command, path string, args []string) (ethdataset.Config, error) {
+	if cmd.newConfig == nil {
+		return nil, fmt.Errorf("%v takes a command to print the config of, e.g. config print export accounts", path)
+	}
+	cfg := cmd.newConfig()
+	cfg.Defaults()
+
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	g.register(fs)
+	var overrides [][2]string
+	fields := make(map[string]bool)
+	for _, f := range ethdataset.ConfigFields(cfg) {
+		fields[f.Name] = true
+		fs.Var(&configOverride{name: f.Name, isBool: f.IsBool(), overrides: &overrides}, f.Name, fmt.Sprintf("override %v (%v, $%v)", f.Name, f.Type, ethdataset.ConfigEnvVar(f.Name)))
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: ethdataset %v [flags]\n\n%v.\n\nFlags:\n", path, cmd.summary)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 0 {
+		return nil, fmt.Errorf("%v: unexpected arguments %v", path, fs.Args())
+	}
+
+	configPath := g.config
+	if configPath == "" {
+		if _, err := os.Stat(defaultConfigPath); err == nil {
+			configPath = defaultConfigPath
+		}
+	}
+	if configPath != "" {
+		if err := ethdataset.ReadConfig(configPath, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := ethdataset.ApplyEnvOverrides(cfg); err != nil {
+		return nil, err
+	}
+
+	if g.workDir != "" {
+		for _, key := range cmd.workDirKeys {
+			if err := ethdataset.SetConfigField(cfg, key, g.workDir); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if g.chainDataDir != "" {
+		if !fields["chain_config.data_dir"] {
+			return nil, fmt.Errorf("%v does not read the chain, -chain-data-dir does not apply", path)
+		}
+		if err := ethdataset.SetConfigField(cfg, "chain_config.data_dir", g.chainDataDir); err != nil {
+			return nil, err
+		}
+	}
+	for _, o := range overrides {
+		if err := ethdataset.SetConfigField(cfg, o[0], o[1]); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func printCommands(w io.Writer, cmd *command, prefix string) {
+	for _, child := range cmd.children {
+		name := strings.TrimSpace(prefix + " " + child.name)
+		if len(child.children) == 0 {
+			fmt.Fprintf(w, "  %-26v %v\n", name, child.summary)
+		}
+		printCommands(w, child, name)
+	}
+}
+
+func printGroupUsage(cmd *command, path []string) {
+	out := flag.CommandLine.Output()
+	prefix := strings.Join(path, " ")
+	fmt.Fprintf(out, "Usage: ethdataset %v <command> [flags]\n\n%v.\n\nCommands:\n", prefix, cmd.summary)
+	printCommands(out, cmd, prefix)
+}
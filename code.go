@@ -1,38 +1,310 @@
 package ethdataset
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
-type CodeDeduper struct{}
+// CodeDeduper assigns every unique contract a dense id, starting from 1, and
+// stores it in codeHashToId and idToCode. Id 0 means no code.
+type CodeDeduper struct {
+	codeHashToId *pebble.DB
+	idToCode     *pebble.DB
+	hashToIdWo   *pebble.WriteOptions
+	idToCodeWo   *pebble.WriteOptions
 
-func NewCodeDeduper(path string) *CodeDeduper {
+	mu     sync.Mutex
+	nextId atomic.Uint64
+
+	total       atomic.Uint64
+	unique      atomic.Uint64
+	deduped     atomic.Uint64
+	missing     atomic.Uint64
+	uniqueBytes atomic.Uint64
+}
+
+func NewCodeDeduper(path string, pc PebbleConfig) (*CodeDeduper, error) {
+	return openCodeDeduper(path, pc, openPebbleDB)
+}
+
+// OpenCodeDeduperReadOnly opens the code tables in path for looking up the ids
+// and code assigned by an earlier run.
+func OpenCodeDeduperReadOnly(path string, pc PebbleConfig) (*CodeDeduper, error) {
+	return openCodeDeduper(path, pc, openPebbleDBReadOnly)
+}
+
+func openCodeDeduper(path string, pc PebbleConfig, open func(path, name string, pc PebbleConfig) (*pebble.DB, error)) (*CodeDeduper, error) {
+	codeHashToId, err := open(path, "codeHashToId", pc)
+	if err != nil {
+		return nil, err
+	}
+	idToCode, err := open(path, "idToCode", pc)
+	if err != nil {
+		codeHashToId.Close()
+		return nil, err
+	}
+	c := &CodeDeduper{
+		codeHashToId: codeHashToId,
+		idToCode:     idToCode,
+		hashToIdWo:   pc.writeOptions("codeHashToId"),
+		idToCodeWo:   pc.writeOptions("idToCode"),
+	}
+	if err := c.resumeIds(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// resumeIds finds the last id handed out. Ids are dense, so it is the largest
+// id in idToCode, unless a crash left that id's code without a codeHashToId
+// entry, in which case the id is handed out again.
+func (c *CodeDeduper) resumeIds() error {
+	var err error
+	n := sort.Search(math.MaxInt32, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var code []byte
+		code, err = pebbleGet(c.idToCode, uint64ToKey(uint64(i)+1))
+		return code == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	last := uint64(n)
+	if last > 0 {
+		code, err := pebbleGet(c.idToCode, uint64ToKey(last))
+		if err != nil {
+			return err
+		}
+		id, ok, err := c.GetId(crypto.Keccak256(code))
+		if err != nil {
+			return err
+		}
+		if !ok || id != last {
+			last -= 1
+		}
+	}
+	c.nextId.Store(last)
 	return nil
 }
 
-func (c *CodeDeduper) Dedup(key, code []byte) uint64 { return 0 }
+// Dedup returns the id of code, assigning the next id if codeHash is new.
+// Empty code gets id 0 and is counted as missing unless codeHash is the
+// empty code hash.
+func (c *CodeDeduper) Dedup(codeHash, code []byte) (uint64, error) {
+	if bytes.Equal(codeHash, types.EmptyCodeHash.Bytes()) {
+		return 0, nil
+	}
+	c.total.Add(1)
+	if len(code) == 0 {
+		c.missing.Add(1)
+		return 0, nil
+	}
+
+	id, ok, err := c.GetId(codeHash)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		c.deduped.Add(1)
+		return id, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another worker may have added it since.
+	id, ok, err = c.GetId(codeHash)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		c.deduped.Add(1)
+		return id, nil
+	}
+
+	id = c.nextId.Load() + 1
+	// idToCode goes first so that codeHashToId never points at a missing id.
+	if err := c.idToCode.Set(uint64ToKey(id), code, c.idToCodeWo); err != nil {
+		return 0, err
+	}
+	if err := c.codeHashToId.Set(codeHash, uint64ToKey(id), c.hashToIdWo); err != nil {
+		return 0, err
+	}
+	c.nextId.Store(id)
+
+	c.unique.Add(1)
+	c.uniqueBytes.Add(uint64(len(code)))
+	return id, nil
+}
+
+// GetId returns the id assigned to codeHash, if any.
+func (c *CodeDeduper) GetId(codeHash []byte) (uint64, bool, error) {
+	value, err := pebbleGet(c.codeHashToId, codeHash)
+	if err != nil || value == nil {
+		return 0, false, err
+	}
+	if len(value) != 8 {
+		return 0, false, corruptRecord("codeHashToId", codeHash, fmt.Errorf("id length %v, want 8", len(value)))
+	}
+	return binary.LittleEndian.Uint64(value), true, nil
+}
+
+// GetCode returns the code with id, or an error wrapping ErrNotFound.
+func (c *CodeDeduper) GetCode(id uint64) ([]byte, error) {
+	key := uint64ToKey(id)
+	code, err := pebbleGet(c.idToCode, key)
+	if err != nil {
+		return nil, err
+	}
+	if code == nil {
+		return nil, notFound("idToCode", key)
+	}
+	return code, nil
+}
+
+// NCodes is the number of unique contracts stored, which is also the last id.
+func (c *CodeDeduper) NCodes() uint64 {
+	return c.nextId.Load()
+}
+
+// Total is the number of accounts with code passed to Dedup.
+func (c *CodeDeduper) Total() uint64 {
+	return c.total.Load()
+}
+
+// Unique is the number of contracts added by this run.
+func (c *CodeDeduper) Unique() uint64 {
+	return c.unique.Load()
+}
+
+func (c *CodeDeduper) Deduped() uint64 {
+	return c.deduped.Load()
+}
+
+// Missing is the number of accounts whose code was empty.
+func (c *CodeDeduper) Missing() uint64 {
+	return c.missing.Load()
+}
+
+// UniqueBytes is the size of the contracts added by this run.
+func (c *CodeDeduper) UniqueBytes() uint64 {
+	return c.uniqueBytes.Load()
+}
+
+func (c *CodeDeduper) Flush() error {
+	return errors.Join(c.idToCode.Flush(), c.codeHashToId.Flush())
+}
+
+func (c *CodeDeduper) Close() error {
+	return errors.Join(c.idToCode.Close(), c.codeHashToId.Close())
+}
+
+// completeCodeTables marks the tables of c as complete in the manifest in dir.
+func completeCodeTables(dir string, c *CodeDeduper) error {
+	if err := completeTable(dir, "codeHashToId", c.NCodes()); err != nil {
+		return err
+	}
+	return completeTable(dir, "idToCode", c.NCodes())
+}
 
 // TODO: Store Code.
 type CodeTable struct {
 	DB *pebble.DB
+	wo *pebble.WriteOptions
 }
 
-func NewCodeTable(path string) *CodeTable {
+func NewCodeTable(path string, pc PebbleConfig) (*CodeTable, error) {
+	db, err := openPebbleDB(path, "code", pc)
+	if err != nil {
+		return nil, err
+	}
 	return &CodeTable{
-		DB: openPebbleDB(path, "code"),
+		DB: db,
+		wo: pc.writeOptions("code"),
+	}, nil
+}
+
+func (c *CodeTable) Save(key, code []byte) error {
+	return c.DB.Set(key, code, c.wo)
+}
+
+func (c *CodeTable) Close() error {
+	return c.DB.Close()
+}
+
+// checkCode reports whether code is the code for codeHash, i.e. it is present
+// and hashes back to codeHash.
+func checkCode(r *AccountReport, codeHash []byte, code []byte) bool {
+	if len(code) == 0 {
+		r.fail(FailureMissingCode, nil, "no code for code hash %x", codeHash)
+		return false
+	}
+	if got := crypto.Keccak256(code); !bytes.Equal(got, codeHash) {
+		r.fail(FailureValueMismatch, nil, "code for code hash %x hashes to %x", codeHash, got)
+		return false
 	}
+	return true
 }
 
-func (c *CodeTable) Save(key, code []byte) {
-	if err := c.DB.Set(key, code, pebble.NoSync); err != nil {
-		log.Fatal(err)
+// CodeStats summarises the unique contracts in a code table.
+type CodeStats struct {
+	mu sync.Mutex
+
+	NContracts  uint64
+	TotalBytes  uint64
+	Largest     common.Hash
+	LargestSize int
+}
+
+// Add counts a unique contract. It is safe for concurrent use.
+func (s *CodeStats) Add(codeHash common.Hash, code []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.NContracts += 1
+	s.TotalBytes += uint64(len(code))
+	if len(code) > s.LargestSize {
+		s.Largest = codeHash
+		s.LargestSize = len(code)
 	}
 }
 
-func (c *CodeTable) Close() {
-	if err := c.DB.Close(); err != nil {
-		log.Fatal(err)
+func (s *CodeStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("nContracts=%v totalBytes=%v largest=%v largestSize=%v", s.NContracts, s.TotalBytes, s.Largest, s.LargestSize)
+}
+
+func (s *CodeStats) log() {
+	log.Printf("Code %v\n", s)
+}
+
+// codeTableStats counts the contracts in a code table.
+func codeTableStats(db *pebble.DB) (*CodeStats, error) {
+	iter, err := db.NewIter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	stats := &CodeStats{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		stats.Add(common.BytesToHash(iter.Key()), iter.Value())
 	}
+	return stats, iter.Error()
 }
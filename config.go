@@ -1,18 +1,219 @@
 package ethdataset
 
 import (
-	"log"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
-func ReadConfig(path string, config interface{}) {
+// envPrefix prefixes the environment variables that override config fields.
+const envPrefix = "ETHDATASET_"
+
+// Config is implemented by every top level TOML config.
+type Config interface {
+	// Defaults fills in default values. It is called before decoding so that
+	// anything set in the file wins.
+	Defaults()
+	// Validate reports every invalid field as a *ConfigError.
+	Validate() error
+}
+
+// LoadConfig fills cfg from its defaults, the TOML file at path (skipped if
+// empty) and the environment, in that order, and then validates it.
+func LoadConfig(path string, cfg Config) error {
+	cfg.Defaults()
+	if path != "" {
+		if err := ReadConfig(path, cfg); err != nil {
+			return err
+		}
+	}
+	if err := ApplyEnvOverrides(cfg); err != nil {
+		return err
+	}
+	return cfg.Validate()
+}
+
+// ReadConfig decodes the TOML file at path into config. Keys that don't match
+// a field are rejected rather than silently ignored.
+func ReadConfig(path string, config interface{}) error {
 	s, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	md, err := toml.Decode(string(s), config)
+	if err != nil {
+		return fmt.Errorf("%w: %v: %v", ErrConfigInvalid, path, err)
+	}
+	var errs []error
+	for _, key := range md.Undecoded() {
+		errs = append(errs, &ConfigError{Field: key.String(), Reason: fmt.Sprintf("unknown key in %v", path)})
+	}
+	return errors.Join(errs...)
+}
+
+// ConfigEnvVar is the environment variable overriding the field with the
+// dotted toml path name, e.g. ETHDATASET_CHAIN_CONFIG_DATA_DIR.
+func ConfigEnvVar(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, ".", "_"))
+}
+
+// ApplyEnvOverrides sets every field of the config struct cfg points to whose
+// ConfigEnvVar is set in the environment.
+func ApplyEnvOverrides(cfg interface{}) error {
+	var errs []error
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", func(name string, v reflect.Value) {
+		s, ok := os.LookupEnv(ConfigEnvVar(name))
+		if !ok {
+			return
+		}
+		if err := setConfigValue(v, s); err != nil {
+			errs = append(errs, &ConfigError{Field: name, Reason: fmt.Sprintf("from $%v: %v", ConfigEnvVar(name), err)})
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func requireField(field, value string) error {
+	if value == "" {
+		return &ConfigError{Field: field, Reason: "is required"}
+	}
+	return nil
+}
+
+// validateHash accepts an empty value or a 32 byte hex string.
+func validateHash(field, value string) error {
+	if value == "" {
+		return nil
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(value, "0x"))
+	if err != nil || len(b) != 32 {
+		return &ConfigError{Field: field, Reason: fmt.Sprintf("want a 32 byte hex hash, got %q", value)}
+	}
+	return nil
+}
+
+// ConfigField is a settable leaf of a config struct. Name is the dotted path of
+// toml keys leading to it, e.g. chain_config.data_dir.
+type ConfigField struct {
+	Name string
+	Type reflect.Type
+}
+
+// IsBool reports whether the field is a bool, which flags treat specially.
+func (f ConfigField) IsBool() bool {
+	return f.Type.Kind() == reflect.Bool
+}
+
+// ConfigFields lists the settable fields of the config struct cfg points to.
+func ConfigFields(cfg interface{}) []ConfigField {
+	var fields []ConfigField
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", func(name string, v reflect.Value) {
+		t := v.Type()
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		fields = append(fields, ConfigField{Name: name, Type: t})
+	})
+	return fields
+}
+
+// SetConfigField parses s into the field of the config struct cfg points to
+// named by its dotted toml path.
+func SetConfigField(cfg interface{}, name, s string) error {
+	var (
+		found bool
+		err   error
+	)
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", func(fieldName string, v reflect.Value) {
+		if fieldName != name {
+			return
+		}
+		found = true
+		err = setConfigValue(v, s)
+	})
+	if !found {
+		return &ConfigError{Field: name, Reason: "no such field"}
+	}
+	if err != nil {
+		return &ConfigError{Field: name, Reason: err.Error()}
+	}
+	return nil
+}
+
+// walkConfig calls fn for every scalar field reachable from the struct v
+// through toml tagged fields.
+func walkConfig(v reflect.Value, prefix string, fn func(name string, v reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("toml"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + key
+		f := v.Field(i)
+
+		kind := f.Kind()
+		if kind == reflect.Pointer {
+			kind = f.Type().Elem().Kind()
+		}
+		switch kind {
+		case reflect.Struct:
+			if f.Kind() == reflect.Struct {
+				walkConfig(f, name+".", fn)
+			}
+		case reflect.String, reflect.Bool,
+			reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64,
+			reflect.Float64:
+			fn(name, f)
+		}
 	}
-	if _, err := toml.Decode(string(s), config); err != nil {
-		log.Fatal(err)
+}
+
+func setConfigValue(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Pointer {
+		p := reflect.New(v.Type().Elem())
+		if err := setConfigValue(p.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("want a bool, got %q", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.ReplaceAll(s, "_", ""), 0, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("want an integer, got %q", s)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(strings.ReplaceAll(s, "_", ""), 0, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("want a non-negative integer, got %q", s)
+		}
+		v.SetUint(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("want a number, got %q", s)
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("can't set a %v", v.Type())
 	}
+	return nil
 }
@@ -1,29 +1,34 @@
 package ethdataset
 
 import (
-	"runtime"
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	mrand "math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 
 	"github.com/cespare/xxhash/v2"
 )
 
-func newSeeds(numHashes int) []uint64 {
+// ErrTableFull is returned when an insert can't find a slot within maxKicks.
+var ErrTableFull = errors.New("cuckoo table full, rehash required")
+
+func newSeeds(numHashes int) ([]uint64, error) {
 	seeds := make([]uint64, numHashes)
 	for i := 0; i < numHashes; i++ {
 		var b [8]byte
 		if _, err := rand.Read(b[:]); err != nil {
-			log.Fatalf("failed to generate random seed: %w", err)
+			return nil, fmt.Errorf("failed to generate random seed: %w", err)
 		}
 		seeds[i] = binary.LittleEndian.Uint64(b[:])
 	}
-	return seeds
+	return seeds, nil
 }
 
 type HTConfig struct {
@@ -39,16 +44,20 @@ type HashTable struct {
 	digest *xxhash.Digest
 }
 
-func NewHashTable(k, capacity, maxKicks int) *HashTable {
+func NewHashTable(k, capacity, maxKicks int) (*HashTable, error) {
+	seeds, err := newSeeds(k)
+	if err != nil {
+		return nil, err
+	}
 	return &HashTable{
 		cfg: HTConfig{
-			HashSeeds: newSeeds(k),
+			HashSeeds: seeds,
 			Capacity:  capacity,
 		},
 		maxKicks: maxKicks,
 		table:    make([][]byte, capacity),
 		digest:   xxhash.New(),
-	}
+	}, nil
 }
 
 func (ht *HashTable) Config() HTConfig {
@@ -57,10 +66,8 @@ func (ht *HashTable) Config() HTConfig {
 
 func (ht *HashTable) hash(item []byte, seed uint64) int {
 	ht.digest.ResetWithSeed(seed)
-	_, err := ht.digest.Write(item)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// xxhash.Digest.Write never returns an error.
+	_, _ = ht.digest.Write(item)
 
 	return int(ht.digest.Sum64() % uint64(ht.cfg.Capacity))
 }
@@ -76,15 +83,13 @@ func (ht *HashTable) Get(key []byte) (int, bool) {
 	return 0, false
 }
 
-func (ht *HashTable) Insert(key []byte) {
+func (ht *HashTable) Insert(key []byte) error {
 	myKey := make([]byte, len(key))
 	copy(myKey, key)
-	for {
-		if ht.insert(myKey) {
-			return
-		}
-		log.Fatal("Rehash triggered")
+	if !ht.insert(myKey) {
+		return fmt.Errorf("inserting %x: %w", key, ErrTableFull)
 	}
+	return nil
 }
 
 func (ht *HashTable) nextPos(key []byte, avoid int) int {
@@ -129,22 +134,27 @@ func (ht *HashTable) insert(key []byte) bool {
 	return false
 }
 
-func (ht *HashTable) rehash() {
+func (ht *HashTable) rehash() error {
 	// Don't increase capacity, just try new seeds. This is intentinoal.
 	// This isn't really used rn for simplicity. In general we want to increase
 	// capacity, but we can't afford to double it so we'd need a different schedule.
 	log.Print("Rehashing")
-	ht.cfg.HashSeeds = newSeeds(len(ht.cfg.HashSeeds))
+	seeds, err := newSeeds(len(ht.cfg.HashSeeds))
+	if err != nil {
+		return err
+	}
+	ht.cfg.HashSeeds = seeds
 	oldTable := ht.table
 	ht.table = make([][]byte, len(oldTable))
 	for _, v := range oldTable {
 		if v != nil {
 			ok := ht.insert(v)
 			if !ok {
-				log.Fatal("Nested rehash!")
+				return fmt.Errorf("nested rehash: %w", ErrTableFull)
 			}
 		}
 	}
+	return nil
 }
 
 func (ht *HashTable) GetTable() [][]byte {
@@ -160,17 +170,57 @@ type ExperimentDatasetCfg struct {
 	MaxKicks int `toml:"max_kicks"`
 
 	NAccounts int `toml:"n_accounts"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
 }
 
-func ExperimentDataset(cfg ExperimentDatasetCfg) {
-	os.MkdirAll(cfg.OutDir, os.ModePerm)
+func (c *ExperimentDatasetCfg) Defaults() {
+	c.K = 3
+	c.MaxKicks = 1000
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
 
-	accountTable := NewTable(cfg.WorkDir, "accounts")
+func (c *ExperimentDatasetCfg) Validate() error {
+	var errs []error
+	errs = append(errs,
+		requireField("work_dir", c.WorkDir),
+		requireField("out_dir", c.OutDir),
+	)
+	// nextPos needs a second position to kick an item to.
+	if c.K < 2 {
+		errs = append(errs, &ConfigError{Field: "k", Reason: "must be at least 2"})
+	}
+	if c.MaxKicks < 0 {
+		errs = append(errs, &ConfigError{Field: "max_kicks", Reason: "must not be negative"})
+	}
+	if c.NAccounts <= 0 {
+		errs = append(errs, &ConfigError{Field: "n_accounts", Reason: "must be positive"})
+	}
+	if c.Capacity < c.NAccounts {
+		errs = append(errs, &ConfigError{Field: "capacity", Reason: fmt.Sprintf("must be at least n_accounts=%v", c.NAccounts)})
+	}
+	errs = append(errs, c.PebbleConfig.validate("pebble_config"))
+	return errors.Join(errs...)
+}
+
+func ExperimentDataset(cfg ExperimentDatasetCfg) error {
+	if err := os.MkdirAll(cfg.OutDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	if _, err := requireTables(cfg.WorkDir, "accounts", "accountToProof", "idToProofSegment"); err != nil {
+		return err
+	}
+
+	accountTable, err := OpenTableReadOnly(cfg.WorkDir, "accounts", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer accountTable.Close()
 
 	iter, err := accountTable.DB.NewIter(nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	log.Println("Gathering accounts!!")
@@ -193,19 +243,26 @@ func ExperimentDataset(cfg ExperimentDatasetCfg) {
 		}
 		i += 1
 	}
-	iter.Close()
+	if err := iter.Close(); err != nil {
+		return err
+	}
 
 	mrand.Shuffle(len(accounts), func(i, j int) {
         accounts[i], accounts[j] = accounts[j], accounts[i]
     })
 
-	ht := NewHashTable(cfg.K, cfg.Capacity, cfg.MaxKicks)
+	ht, err := NewHashTable(cfg.K, cfg.Capacity, cfg.MaxKicks)
+	if err != nil {
+		return err
+	}
 
 	log.Printf("Gathered %v accounts\n", len(accounts))
 
 	log.Println("Building hash table")
 	for _, addressHashBytes := range accounts {
-		ht.Insert(addressHashBytes[:])
+		if err := ht.Insert(addressHashBytes[:]); err != nil {
+			return err
+		}
 
 		nAccounts += 1
 		if nAccounts%10_000_000 == 0 {
@@ -219,16 +276,16 @@ func ExperimentDataset(cfg ExperimentDatasetCfg) {
 
 	hashTableMetadataFile, err := os.OpenFile(filepath.Join(cfg.OutDir, "hash-table.metadata.json"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer hashTableMetadataFile.Close()
 	if err := json.NewEncoder(hashTableMetadataFile).Encode(ht.Config()); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	debugFile, err := os.OpenFile(filepath.Join(cfg.OutDir, "debug.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer debugFile.Close()
 	enc := json.NewEncoder(debugFile)
@@ -239,57 +296,89 @@ func ExperimentDataset(cfg ExperimentDatasetCfg) {
 		Value            []byte `json:"value"`
 	}
 
-	proofBucketMapper := NewBucketMapper(
+	proofBucketMapper, err := NewBucketMapper(
 		cfg.WorkDir,
 		cfg.OutDir,
 		nTreeTop,
 		nBuckets,
 		proofSegmentMetadata,
+		cfg.PebbleConfig,
 	)
+	if err != nil {
+		return err
+	}
 	defer proofBucketMapper.Close()
 
-	fakeBucketMapper := NewFakeBucketMapper(
+	fakeBucketMapper, err := NewFakeBucketMapper(
 		proofBucketMapper.accountToProofIds,
 		proofBucketMapper.idToProofSegment,
 		cfg.OutDir,
 		proofSegmentMetadata,
 	)
+	if err != nil {
+		return err
+	}
 	defer fakeBucketMapper.Close()
 
-	oneBucketAccountFileTable := OpenFileTable(cfg.OutDir, "f-accounts", sizeOfAccountPirRecord, 0)
+	oneBucketAccountFileTable, err := OpenFileTable(cfg.OutDir, "f-accounts", sizeOfAccountPirRecord, 0)
+	if err != nil {
+		return err
+	}
 	defer oneBucketAccountFileTable.Close()
 
-	accountFileTable := OpenFileTable(cfg.OutDir, "accounts", sizeOfAccountPirRecord, 0)
+	accountFileTable, err := OpenFileTable(cfg.OutDir, "accounts", sizeOfAccountPirRecord, 0)
+	if err != nil {
+		return err
+	}
 	defer accountFileTable.Close()
 
 	for _, addressHashBytes := range ht.GetTable() {
 		if addressHashBytes != nil {
-			slimAccount := accountTable.Get(addressHashBytes)
+			slimAccount, err := accountTable.Get(addressHashBytes)
+			if err != nil {
+				return err
+			}
 
 			buf := make([]byte, sizeOfAccountPirRecord)
 			copy(buf, addressHashBytes)
 			copy(buf[sizeOfAddressHash:], slimAccount)
-			bucketIndexes := proofBucketMapper.MapAccountProofToBucketIndexes(addressHashBytes)
+			bucketIndexes, err := proofBucketMapper.MapAccountProofToBucketIndexes(addressHashBytes)
+			if err != nil {
+				return err
+			}
 			copy(buf[sizeOfAddressHash+sizeOfAccount:], bucketIndexesToBytes(bucketIndexes, nBuckets))
-			rowId := accountFileTable.Append(buf)
+			rowId, err := accountFileTable.Append(buf)
+			if err != nil {
+				return err
+			}
 
 			if err := enc.Encode(DeubgInput{
 				RowId:            int(rowId),
 				AddressHashBytes: addressHashBytes,
 				Value:            buf,
 			}); err != nil {
-				log.Fatal(err)
+				return err
 			}
 
 			buf = make([]byte, sizeOfAccountPirRecord)
 			copy(buf, addressHashBytes)
 			copy(buf[sizeOfAddressHash:], slimAccount)
-			fakeBucketIndexes := fakeBucketMapper.MapAccountProofToBucketIndexes(addressHashBytes)
+			fakeBucketIndexes, err := fakeBucketMapper.MapAccountProofToBucketIndexes(addressHashBytes)
+			if err != nil {
+				return err
+			}
 			copy(buf[sizeOfAddressHash+sizeOfAccount:], bucketIndexesToBytes(fakeBucketIndexes, nBuckets))
-			oneBucketAccountFileTable.Append(buf)
+			if _, err := oneBucketAccountFileTable.Append(buf); err != nil {
+				return err
+			}
 		} else {
-			accountFileTable.WriteBlank()
-			oneBucketAccountFileTable.WriteBlank()
+			if err := accountFileTable.WriteBlank(); err != nil {
+				return err
+			}
+			if err := oneBucketAccountFileTable.WriteBlank(); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
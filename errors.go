@@ -0,0 +1,45 @@
+package ethdataset
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound is returned when a key is missing from a table.
+	ErrNotFound = errors.New("not found")
+	// ErrCorruptRecord is returned when a stored record can't be decoded.
+	ErrCorruptRecord = errors.New("corrupt record")
+	// ErrConfigInvalid is returned when a config can't be read or is invalid.
+	ErrConfigInvalid = errors.New("invalid config")
+	// ErrVerificationFailed is returned when verification found bad records.
+	ErrVerificationFailed = errors.New("verification failed")
+	// ErrEmptyProofSegment is returned when a proof holds an empty node,
+	// which can't be deduplicated.
+	ErrEmptyProofSegment = errors.New("empty proof segment")
+)
+
+// ConfigError describes a problem with a single config field.
+type ConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%v: %v: %v", ErrConfigInvalid, e.Field, e.Reason)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return ErrConfigInvalid
+}
+
+func notFound(table string, key []byte) error {
+	return fmt.Errorf("%v: key %x: %w", table, key, ErrNotFound)
+}
+
+func corruptRecord(table string, key []byte, err error) error {
+	if key == nil {
+		return fmt.Errorf("%v: %w: %v", table, ErrCorruptRecord, err)
+	}
+	return fmt.Errorf("%v: key %x: %w: %v", table, key, ErrCorruptRecord, err)
+}
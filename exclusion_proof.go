@@ -0,0 +1,260 @@
+package ethdataset
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+type ExportExclusionProofsConfig struct {
+	WorkDir string `toml:"work_dir"`
+	// KeysPath is a file of address hashes to prove absent, one per line in
+	// hex. 20 byte addresses are hashed first. Empty lines and lines starting
+	// with # are skipped.
+	KeysPath string `toml:"keys_path"`
+	// NRandom adds this many address hashes drawn uniformly with Seed.
+	NRandom uint64 `toml:"n_random"`
+	Seed    int64  `toml:"seed"`
+	// ProofIndex is how proof segments are looked up while deduplicating,
+	// "segment" or "hash".
+	ProofIndex  string      `toml:"proof_index"`
+	ChainConfig ChainConfig `toml:"chain_config"`
+
+	ProofDedupConfig ProofDedupConfig `toml:"proof_dedup"`
+	PebbleConfig     PebbleConfig     `toml:"pebble_config"`
+}
+
+func (c *ExportExclusionProofsConfig) Defaults() {
+	c.ProofIndex = ProofIndexSegment
+	c.ProofDedupConfig.defaults()
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
+
+func (c *ExportExclusionProofsConfig) Validate() error {
+	var errs []error
+	errs = append(errs, requireField("work_dir", c.WorkDir))
+	if c.KeysPath == "" && c.NRandom == 0 {
+		errs = append(errs, &ConfigError{Field: "keys_path", Reason: "or n_random is required"})
+	}
+	errs = append(errs,
+		validateProofIndex("proof_index", c.ProofIndex),
+		c.ChainConfig.validate("chain_config"),
+		c.ProofDedupConfig.validate("proof_dedup"),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+	return errors.Join(errs...)
+}
+
+// readKeyList reads the address hashes in path, one per line in hex. 20 byte
+// addresses are hashed to their address hash.
+func readKeyList(path string) ([]common.Hash, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []common.Hash
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := parseAccountKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %w", path, line, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// parseAccountKey parses a hex address hash, or a hex address and hashes it.
+func parseAccountKey(s string) (common.Hash, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	switch {
+	case err != nil:
+		return common.Hash{}, err
+	case len(b) == common.AddressLength:
+		return crypto.Keccak256Hash(b), nil
+	case len(b) == common.HashLength:
+		return common.BytesToHash(b), nil
+	}
+	return common.Hash{}, fmt.Errorf("want a 20 byte address or a 32 byte hash, got %v bytes", len(b))
+}
+
+// exclusionProofKeys returns the keys of KeysPath followed by NRandom random
+// ones.
+func exclusionProofKeys(cfg ExportExclusionProofsConfig) ([]common.Hash, error) {
+	var keys []common.Hash
+	if cfg.KeysPath != "" {
+		var err error
+		if keys, err = readKeyList(cfg.KeysPath); err != nil {
+			return nil, err
+		}
+	}
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	for i := uint64(0); i < cfg.NRandom; i++ {
+		var key common.Hash
+		rng.Read(key[:])
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// proofList collects the nodes trie.Prove writes, root first.
+type proofList [][]byte
+
+func (l *proofList) Put(key, value []byte) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *proofList) Delete(key []byte) error {
+	return errors.New("proofList: delete is not supported")
+}
+
+// ExportExclusionProofs proves that address hashes have no account at the
+// pinned state and stores the proofs in absentToProof, keyed by address hash
+// like accountToProof. Their segments are deduplicated into the account
+// ProofDB, after any ids the account proofs already took, so they share the
+// upper levels of the trie with the account proofs. The account ProofDB stays
+// marked complete meanwhile.
+//
+// Keys that do have an account are skipped and counted.
+func ExportExclusionProofs(cfg ExportExclusionProofsConfig) error {
+	if err := os.MkdirAll(cfg.WorkDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	keys, err := exclusionProofKeys(cfg)
+	if err != nil {
+		return err
+	}
+
+	_, chainDB, trieDB, err := openChain(cfg.ChainConfig)
+	if err != nil {
+		return err
+	}
+	pinned, err := ResolvePinnedState(cfg.ChainConfig, chainDB, trieDB)
+	if err != nil {
+		return err
+	}
+	if err := recordPinnedState(cfg.WorkDir, pinned); err != nil {
+		return err
+	}
+	if err := checkProofIndex(cfg.WorkDir, "", cfg.ProofIndex); err != nil {
+		return err
+	}
+	_, idToSegmentName := proofTableNames("", cfg.ProofIndex)
+	lastId, err := proofDBLastId(cfg.WorkDir, idToSegmentName)
+	if err != nil {
+		return err
+	}
+	tables, err := appendProofTables(cfg.WorkDir, "absentToProof", "", cfg.ProofIndex)
+	if err != nil {
+		return err
+	}
+	if err := startTables(cfg.WorkDir, "export-exclusion-proofs", cfg, tables...); err != nil {
+		return err
+	}
+
+	proofDB, err := NewProofDeduper(cfg.WorkDir, cfg.ProofIndex, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer proofDB.Close()
+	proofDB.UseShards(cfg.ProofDedupConfig)
+	if lastId > 0 {
+		if err := proofDB.ResumeIds(lastId); err != nil {
+			return err
+		}
+	}
+
+	absentToProof, err := NewTable(cfg.WorkDir, "absentToProof", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer absentToProof.Close()
+
+	tr, err := trie.New(trie.StateTrieID(pinned.StateRoot), trieDB)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Proving nKeys=%v absent\n", len(keys))
+	var nAbsent, nPresent uint64
+	start := time.Now()
+	for i, key := range keys {
+		if i > 0 && i%100_000 == 0 {
+			log.Printf("%v %v nAbsent=%v nPresent=%v\n", i, time.Since(start), nAbsent, nPresent)
+		}
+
+		ok, err := absentToProof.Contains(key.Bytes())
+		if err != nil {
+			return err
+		}
+		if ok {
+			nAbsent += 1
+			continue
+		}
+		value, err := tr.Get(key.Bytes())
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			nPresent += 1
+			continue
+		}
+
+		var proof proofList
+		if err := tr.Prove(key.Bytes(), &proof); err != nil {
+			return err
+		}
+		pc := proofDB.NewProofContainer()
+		if err := pc.DedupAll(proof); err != nil {
+			return err
+		}
+		if err := absentToProof.Set(key.Bytes(), uint64SliceToBytesUnsafe(pc.AsIds())); err != nil {
+			return err
+		}
+		nAbsent += 1
+	}
+	log.Printf("Finished in %v. nAbsent=%v nPresent=%v\n", time.Since(start), nAbsent, nPresent)
+	proofDB.LogStats()
+
+	return completeAppendedProofs(cfg.WorkDir, "absentToProof", nAbsent, "", proofDB)
+}
+
+// verifyExclusionProof recovers the proof of an address hash in
+// absentToProof and checks that it shows there is no account at stateRoot.
+func verifyExclusionProof(r *AccountReport, proofDB *ProofDB, stateRoot common.Hash, addressHashBytes, proofIdBytes []byte) error {
+	proofBytes, err := proofDB.RecoverProof(bytesToUint64(proofIdBytes))
+	if errors.Is(err, ErrNotFound) {
+		r.fail(FailureMissingProofId, nil, "%v", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	walk, err := CrossCheckProof(stateRoot, addressHashBytes, proofBytes)
+	switch {
+	case err != nil:
+		r.fail(FailureBadProof, nil, "%v", err)
+	case walk.Included():
+		r.fail(FailureBadProof, nil, "proof shows the account is present")
+	}
+	return nil
+}
@@ -1,11 +1,10 @@
 package ethdataset
 
 import (
+	"errors"
 	"log"
 	"os"
-	"time"
 
-	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
@@ -13,45 +12,90 @@ type ExportAccountsConfig struct {
 	WorkDir     string      `toml:"work_dir"`
 	NAccounts   uint64      `toml:"n_accounts"`
 	ChainConfig ChainConfig `toml:"chain_config"`
+	WalkConfig  WalkConfig  `toml:"walk_config"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
 }
 
-func ExportAccounts(cfg ExportAccountsConfig) {
-	os.MkdirAll(cfg.WorkDir, os.ModePerm)
+func (c *ExportAccountsConfig) Defaults() {
+	c.WalkConfig.defaults()
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
 
-	stack := newNode(cfg.ChainConfig.DataDir)
-	chainDB := newChainDB(cfg.ChainConfig.AncientsDir, stack)
-	trieDB := newTrieDB(stack, chainDB)
+func (c *ExportAccountsConfig) Validate() error {
+	return errors.Join(
+		requireField("work_dir", c.WorkDir),
+		c.ChainConfig.validate("chain_config"),
+		c.WalkConfig.validate("walk_config"),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+}
 
-	header := rawdb.ReadHeadHeader(chainDB)
-	stateRoot := header.Root
+func ExportAccounts(cfg ExportAccountsConfig) error {
+	if err := os.MkdirAll(cfg.WorkDir, os.ModePerm); err != nil {
+		return err
+	}
 
-	log.Println("Starting iteration")
+	_, chainDB, trieDB, err := openChain(cfg.ChainConfig)
+	if err != nil {
+		return err
+	}
 
-	accountTable := NewAccountTable(cfg.WorkDir)
-	defer accountTable.Close()
+	pinned, err := ResolvePinnedState(cfg.ChainConfig, chainDB, trieDB)
+	if err != nil {
+		return err
+	}
+	if err := recordPinnedState(cfg.WorkDir, pinned); err != nil {
+		return err
+	}
+	if err := startTables(cfg.WorkDir, "export-accounts", cfg, "accounts"); err != nil {
+		return err
+	}
+	stateRoot := pinned.StateRoot
 
-	accountIt := newTrieIter(trie.StateTrieID(stateRoot), nil, trieDB)
+	log.Println("Starting iteration")
 
-	start := time.Now()
-	epochStart := time.Now()
-	nAccounts := uint64(0)
+	accountTable, err := NewAccountTable(cfg.WorkDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer accountTable.Close()
 
-	for accountIt.Next() {
-		addressHashBytes := accountIt.Key
-		accountBytes := accountIt.Value
+	walk, err := NewStateWalk(cfg.WalkConfig, trieDB, stateRoot, cfg.WorkDir, "accounts")
+	if err != nil {
+		return err
+	}
+	walk.Limit = cfg.NAccounts
+	walk.Flush = []Flusher{accountTable.DB}
 
-		accountTable.Save(addressHashBytes, accountBytes)
+	var loader *BulkLoader
+	if cfg.PebbleConfig.BulkWrite {
+		loader, err = NewBulkLoader(accountTable.DB, cfg.WorkDir, "accounts")
+		if err != nil {
+			return err
+		}
+		walk.Flush = []Flusher{loader}
+	}
 
-		if nAccounts > 0 && nAccounts%1_000_000 == 0 {
-			elapsed := time.Since(start)
-			epochElapsed := time.Since(epochStart)
-			epochStart = time.Now()
-			accountsPerSec := float64(nAccounts) / elapsed.Seconds()
-			log.Printf("Accounts=%v Elapsed=%v EpochElapsed=%v AccountsPerSec=%v\n", nAccounts, elapsed, epochElapsed, accountsPerSec)
+	err = walk.RunRanges(func(r int, accountIt *trie.Iterator) error {
+		if loader != nil {
+			return loader.Writer(r).Set(accountIt.Key, accountIt.Value)
 		}
-		nAccounts += 1
-		if cfg.NAccounts != 0 && nAccounts == cfg.NAccounts {
-			break
+		return accountTable.Save(accountIt.Key, accountIt.Value)
+	})
+	if err != nil {
+		return err
+	}
+	if loader != nil {
+		if err := loader.Close(); err != nil {
+			return err
 		}
 	}
+
+	// A walk stopped at n_accounts is complete as far as this run was asked
+	// to go.
+	if cp := walk.Checkpoint(); cp.Complete || walk.LimitReached() {
+		return completeTable(cfg.WorkDir, "accounts", cp.NAccounts)
+	}
+	return nil
 }
@@ -2,8 +2,10 @@ package ethdataset
 
 import (
 	"bytes"
+	"errors"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -16,30 +18,80 @@ type ExportCodeConfig struct {
 	WorkDir        string      `toml:"work_dir"`
 	AccountWorkDir string      `toml:"account_work_dir"`
 	ChainConfig    ChainConfig `toml:"chain_config"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *ExportCodeConfig) Defaults() {
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
+
+func (c *ExportCodeConfig) Validate() error {
+	return errors.Join(
+		requireField("work_dir", c.WorkDir),
+		requireField("account_work_dir", c.AccountWorkDir),
+		c.ChainConfig.validate("chain_config"),
+		c.PebbleConfig.validate("pebble_config"),
+	)
 }
 
-func ExportCode(cfg ExportCodeConfig) {
-	os.MkdirAll(cfg.WorkDir, os.ModePerm)
+func ExportCode(cfg ExportCodeConfig) error {
+	if err := os.MkdirAll(cfg.WorkDir, os.ModePerm); err != nil {
+		return err
+	}
 
 	log.Println("Opening stack")
-	stack := newNode(cfg.ChainConfig.DataDir)
+	stack, err := newNode(cfg.ChainConfig.DataDir)
+	if err != nil {
+		return err
+	}
 	log.Println("Opening chainDB")
-	chainDB := newChainDB(cfg.ChainConfig.AncientsDir, stack)
+	chainDB, err := newChainDB(cfg.ChainConfig.AncientsDir, stack)
+	if err != nil {
+		return err
+	}
+
+	m, err := requireTables(cfg.AccountWorkDir, "accounts")
+	if err != nil {
+		return err
+	}
+	if err := recordPinnedState(cfg.WorkDir, m.PinnedState); err != nil {
+		return err
+	}
+	if err := startTables(cfg.WorkDir, "export-code", cfg, "code"); err != nil {
+		return err
+	}
 
 	log.Println("Opening tables")
-	codeTable := NewCodeTable(cfg.WorkDir)
+	codeTable, err := NewCodeTable(cfg.WorkDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer codeTable.Close()
 
-	accountTable := NewAccountTable(cfg.AccountWorkDir)
+	accountTable, err := OpenAccountTableReadOnly(cfg.AccountWorkDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer accountTable.Close()
 
 	iter, err := accountTable.DB.NewIter(nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer iter.Close()
 
+	// Accounts whose code is missing from the chain DB, or doesn't hash to
+	// its code hash, are reported rather than exported.
+	reportPath := filepath.Join(cfg.WorkDir, "export-code-report.jsonl")
+	report, err := NewVerifyReport(reportPath, 0)
+	if err != nil {
+		return err
+	}
+
+	// codeHashes holds whether the code of each code hash seen so far was good.
 	codeHashes := make(map[common.Hash]bool)
+	var stats CodeStats
 
 	log.Println("Starting iteration")
 
@@ -49,15 +101,28 @@ func ExportCode(cfg ExportCodeConfig) {
 		var slim SlimAccount
 		buf := iter.Value()
 		if err := rlp.DecodeBytes(buf, &slim); err != nil {
-			log.Fatal(err)
+			return corruptRecord("accounts", iter.Key(), err)
 		}
-		codeHashHash := common.BytesToHash(slim.CodeHash)
-		if _, ok := codeHashes[codeHashHash]; !ok {
-			if !bytes.Equal(slim.CodeHash, types.EmptyCodeHash.Bytes()) {
-				code := rawdb.ReadCode(chainDB, common.BytesToHash(slim.CodeHash))
-				codeTable.Save(slim.CodeHash, code)
+		r := &AccountReport{Account: common.BytesToHash(iter.Key())}
+		if !bytes.Equal(slim.CodeHash, types.EmptyCodeHash.Bytes()) {
+			codeHash := common.BytesToHash(slim.CodeHash)
+			ok, seen := codeHashes[codeHash]
+			if !seen {
+				code := rawdb.ReadCode(chainDB, codeHash)
+				ok = checkCode(r, slim.CodeHash, code)
+				if ok {
+					if err := codeTable.Save(slim.CodeHash, code); err != nil {
+						return err
+					}
+					stats.Add(codeHash, code)
+				}
+				codeHashes[codeHash] = ok
+			} else if !ok {
+				r.fail(FailureMissingCode, nil, "no valid code for code hash %x", slim.CodeHash)
 			}
-			codeHashes[codeHashHash] = true
+		}
+		if _, err := report.Add(r); err != nil {
+			return err
 		}
 
 		i += 1
@@ -66,4 +131,18 @@ func ExportCode(cfg ExportCodeConfig) {
 			log.Printf("%v %v %v\n", i, elapsed, len(codeHashes))
 		}
 	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	summary, err := report.Close()
+	if err != nil {
+		return err
+	}
+	stats.log()
+	if summary.NFailures > 0 {
+		log.Printf("%v accounts have missing or bad code, see %v\n", summary.NFailedAccounts, reportPath)
+	}
+
+	return completeTable(cfg.WorkDir, "code", stats.NContracts)
 }
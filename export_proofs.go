@@ -1,62 +1,140 @@
 package ethdataset
 
 import (
+	"errors"
 	"log"
 	"os"
-	"time"
 
-	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
 type ExportProofsConfig struct {
-	WorkDir     string      `toml:"work_dir"`
-	NAccounts   uint64      `toml:"n_accounts"`
+	WorkDir   string `toml:"work_dir"`
+	NAccounts uint64 `toml:"n_accounts"`
+	// ProofIndex is how proof segments are looked up while deduplicating,
+	// "segment" or "hash".
+	ProofIndex  string      `toml:"proof_index"`
 	ChainConfig ChainConfig `toml:"chain_config"`
+	WalkConfig  WalkConfig  `toml:"walk_config"`
+
+	ProofDedupConfig ProofDedupConfig `toml:"proof_dedup"`
+	PebbleConfig     PebbleConfig     `toml:"pebble_config"`
+}
+
+func (c *ExportProofsConfig) Defaults() {
+	c.ProofIndex = ProofIndexSegment
+	c.WalkConfig.defaults()
+	c.ProofDedupConfig.defaults()
+	c.PebbleConfig.defaults(ProfileBulkLoad)
 }
 
-func ExportProofs(cfg ExportProofsConfig) {
-	os.MkdirAll(cfg.WorkDir, os.ModePerm)
+func (c *ExportProofsConfig) Validate() error {
+	return errors.Join(
+		requireField("work_dir", c.WorkDir),
+		validateProofIndex("proof_index", c.ProofIndex),
+		c.ChainConfig.validate("chain_config"),
+		c.WalkConfig.validate("walk_config"),
+		c.ProofDedupConfig.validate("proof_dedup"),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+}
+
+func ExportProofs(cfg ExportProofsConfig) error {
+	if err := os.MkdirAll(cfg.WorkDir, os.ModePerm); err != nil {
+		return err
+	}
 
-	stack := newNode(cfg.ChainConfig.DataDir)
-	chainDB := newChainDB(cfg.ChainConfig.AncientsDir, stack)
-	trieDB := newTrieDB(stack, chainDB)
+	_, chainDB, trieDB, err := openChain(cfg.ChainConfig)
+	if err != nil {
+		return err
+	}
 
-	header := rawdb.ReadHeadHeader(chainDB)
-	stateRoot := header.Root
+	pinned, err := ResolvePinnedState(cfg.ChainConfig, chainDB, trieDB)
+	if err != nil {
+		return err
+	}
+	if err := recordPinnedState(cfg.WorkDir, pinned); err != nil {
+		return err
+	}
+	if err := checkProofIndex(cfg.WorkDir, "", cfg.ProofIndex); err != nil {
+		return err
+	}
+	// A ProofDB kept by Repin is appended to.
+	tables, err := appendProofTables(cfg.WorkDir, "accountToProof", "", cfg.ProofIndex)
+	if err != nil {
+		return err
+	}
+	if err := startTables(cfg.WorkDir, "export-proofs", cfg, tables...); err != nil {
+		return err
+	}
+	stateRoot := pinned.StateRoot
 
 	log.Println("Starting iteration")
 
-	proofDeduper := NewProofDeduper(cfg.WorkDir)
+	proofDeduper, err := NewProofDeduper(cfg.WorkDir, cfg.ProofIndex, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer proofDeduper.Close()
+	proofDeduper.UseShards(cfg.ProofDedupConfig)
 
-	accountToProof := NewAccountToProof(cfg.WorkDir)
+	accountToProof, err := NewAccountToProof(cfg.WorkDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer accountToProof.Close()
 
-	accountIt := newTrieIter(trie.StateTrieID(stateRoot), nil, trieDB)
+	walk, err := NewStateWalk(cfg.WalkConfig, trieDB, stateRoot, cfg.WorkDir, "proofs")
+	if err != nil {
+		return err
+	}
+	walk.Limit = cfg.NAccounts
+	walk.Flush = []Flusher{proofDeduper, accountToProof.db}
+
+	var loader *BulkLoader
+	if cfg.PebbleConfig.BulkWrite {
+		proofDeduper.UseBatchedWrites()
+		loader, err = NewBulkLoader(accountToProof.db, cfg.WorkDir, "accountToProof")
+		if err != nil {
+			return err
+		}
+		walk.Flush = []Flusher{proofDeduper, loader}
+	}
+	walk.OnCheckpoint = func(cp *Checkpoint) {
+		cp.NextProofId = proofDeduper.NextId()
+		log.Printf("Total=%v Unique=%v Deduped=%v\n", proofDeduper.Total(), proofDeduper.Unique(), proofDeduper.Deduped())
+	}
 
-	start := time.Now()
-	epochStart := time.Now()
-	nAccounts := uint64(0)
+	if err := resumeProofDB(cfg.WorkDir, "", proofDeduper, walk.Checkpoint().NextProofId); err != nil {
+		return err
+	}
 
-	for accountIt.Next() {
-		addressHashBytes := accountIt.Key
+	err = walk.RunRanges(func(r int, accountIt *trie.Iterator) error {
 		accountProof := accountIt.Prove()
 		p := proofDeduper.NewProofContainer()
-		p.DedupAll(accountProof)
+		if err := p.DedupAll(accountProof); err != nil {
+			return err
+		}
 		proofIds := p.AsIds()
-		accountToProof.Save(addressHashBytes, proofIds)
-
-		if nAccounts > 0 && nAccounts%1_000_000 == 0 {
-			elapsed := time.Since(start)
-			epochElapsed := time.Since(epochStart)
-			epochStart = time.Now()
-			accountsPerSec := float64(nAccounts) / elapsed.Seconds()
-			log.Printf("Accounts=%v Elapsed=%v EpochElapsed=%v AccountsPerSec=%v\n", nAccounts, elapsed, epochElapsed, accountsPerSec)
+		if loader != nil {
+			return loader.Writer(r).Set(accountIt.Key, uint64SliceToBytesUnsafe(proofIds))
 		}
-		nAccounts += 1
-		if cfg.NAccounts != 0 && nAccounts == cfg.NAccounts {
-			break
+		return accountToProof.Save(accountIt.Key, proofIds)
+	})
+	if err != nil {
+		return err
+	}
+	if loader != nil {
+		if err := loader.Close(); err != nil {
+			return err
 		}
 	}
+	proofDeduper.LogStats()
+
+	// A walk stopped at n_accounts is complete as far as this run was asked
+	// to go.
+	if cp := walk.Checkpoint(); cp.Complete || walk.LimitReached() {
+		return completeAppendedProofs(cfg.WorkDir, "accountToProof", cp.NAccounts, "", proofDeduper)
+	}
+	return nil
 }
@@ -2,12 +2,12 @@ package ethdataset
 
 import (
 	"bytes"
+	"errors"
 	"log"
 	"os"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
@@ -16,30 +16,77 @@ import (
 type ExportStorageConfig struct {
 	WorkDir     string      `toml:"work_dir"`
 	ChainConfig ChainConfig `toml:"chain_config"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
 }
 
-func ExportStorage(cfg ExportStorageConfig) {
-	os.MkdirAll(cfg.WorkDir, os.ModePerm)
+func (c *ExportStorageConfig) Defaults() {
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
 
-	stack := newNode(cfg.ChainConfig.DataDir)
-	chainDB := newChainDB(cfg.ChainConfig.AncientsDir, stack)
-	trieDB := newTrieDB(stack, chainDB)
+func (c *ExportStorageConfig) Validate() error {
+	return errors.Join(
+		requireField("work_dir", c.WorkDir),
+		c.ChainConfig.validate("chain_config"),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+}
 
-	header := rawdb.ReadHeadHeader(chainDB)
-	stateRoot := header.Root
+func ExportStorage(cfg ExportStorageConfig) error {
+	if err := os.MkdirAll(cfg.WorkDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	_, chainDB, trieDB, err := openChain(cfg.ChainConfig)
+	if err != nil {
+		return err
+	}
+
+	pinned, err := ResolvePinnedState(cfg.ChainConfig, chainDB, trieDB)
+	if err != nil {
+		return err
+	}
+	if err := recordPinnedState(cfg.WorkDir, pinned); err != nil {
+		return err
+	}
+	if _, err := requireTables(cfg.WorkDir, "accounts"); err != nil {
+		return err
+	}
+	if err := startTables(cfg.WorkDir, "export-storage", cfg, "storage"); err != nil {
+		return err
+	}
+	stateRoot := pinned.StateRoot
 
-	storageTable := NewStorageTable(cfg.WorkDir)
+	storageTable, err := NewStorageTable(cfg.WorkDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer storageTable.Close()
 
-	accountTable := NewAccountTable(cfg.WorkDir)
+	accountTable, err := OpenAccountTableReadOnly(cfg.WorkDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer accountTable.Close()
 
 	iter, err := accountTable.DB.NewIter(nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer iter.Close()
 
+	// Accounts and each account's slots are both walked in key order, so the
+	// whole table is one sorted run.
+	save := storageTable.Save
+	var loader *BulkLoader
+	if cfg.PebbleConfig.BulkWrite {
+		loader, err = NewBulkLoader(storageTable.DB, cfg.WorkDir, "storage")
+		if err != nil {
+			return err
+		}
+		save = loader.Writer(0).Set
+	}
+
 	log.Println("Starting iteration")
 
 	i := 0
@@ -52,13 +99,16 @@ func ExportStorage(cfg ExportStorageConfig) {
 		addressHashBytes := iter.Key()
 		buf := iter.Value()
 		if err := rlp.DecodeBytes(buf, &slim); err != nil {
-			log.Fatal(err)
+			return corruptRecord("accounts", addressHashBytes, err)
 		}
 		storageRoot := common.BytesToHash(slim.Root)
 
 		if !bytes.Equal(slim.Root, types.EmptyCodeHash.Bytes()) {
 			addressHash := common.Hash(addressHashBytes)
-			storageIt := newTrieIter(trie.StorageTrieID(stateRoot, addressHash, storageRoot), nil, trieDB)
+			storageIt, err := newTrieIter(trie.StorageTrieID(stateRoot, addressHash, storageRoot), nil, trieDB)
+			if err != nil {
+				return err
+			}
 
 			for storageIt.Next() {
 				key := make([]byte, 32+32)
@@ -67,9 +117,14 @@ func ExportStorage(cfg ExportStorageConfig) {
 
 				valueBytes := storageIt.Value
 
-				storageTable.Save(key, valueBytes)
+				if err := save(key, valueBytes); err != nil {
+					return err
+				}
 				nSlots += 1
 			}
+			if storageIt.Err != nil {
+				return storageIt.Err
+			}
 		}
 
 		i += 1
@@ -78,4 +133,14 @@ func ExportStorage(cfg ExportStorageConfig) {
 			log.Printf("%v %v %v\n", i, elapsed, nSlots)
 		}
 	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if loader != nil {
+		if err := loader.Close(); err != nil {
+			return err
+		}
+	}
+
+	return completeTable(cfg.WorkDir, "storage", uint64(nSlots))
 }
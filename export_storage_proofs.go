@@ -2,6 +2,8 @@ package ethdataset
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"sync"
@@ -9,43 +11,206 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
 type ExportStorageProofsConfig struct {
-	InputDir    string      `toml:"input_dir"`
-	OutputDir   string      `toml:"output_dir"`
-	ChainConfig ChainConfig `toml:"chain_config"`
+	InputDir  string `toml:"input_dir"`
+	OutputDir string `toml:"output_dir"`
+	// ProofIndex is how proof segments are looked up while deduplicating,
+	// "segment" or "hash".
+	ProofIndex string `toml:"proof_index"`
+	// SharedProofDB dedups storage proof segments in the account ProofDB in
+	// output_dir, continuing after the account proofs' ids, rather than in a
+	// separate storage ProofDB.
+	SharedProofDB bool        `toml:"shared_proof_db"`
+	ChainConfig   ChainConfig `toml:"chain_config"`
+
+	ProofDedupConfig ProofDedupConfig `toml:"proof_dedup"`
+	PebbleConfig     PebbleConfig     `toml:"pebble_config"`
 }
 
-func ExportStorageProofs(cfg ExportStorageProofsConfig) {
-	os.MkdirAll(cfg.OutputDir, os.ModePerm)
+func (c *ExportStorageProofsConfig) Defaults() {
+	c.ProofIndex = ProofIndexSegment
+	c.ProofDedupConfig.defaults()
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
 
-	stack := newNode(cfg.ChainConfig.DataDir)
-	chainDB := newChainDB(cfg.ChainConfig.AncientsDir, stack)
-	trieDB := newTrieDB(stack, chainDB)
+func (c *ExportStorageProofsConfig) Validate() error {
+	return errors.Join(
+		requireField("input_dir", c.InputDir),
+		requireField("output_dir", c.OutputDir),
+		validateProofIndex("proof_index", c.ProofIndex),
+		c.ChainConfig.validate("chain_config"),
+		c.ProofDedupConfig.validate("proof_dedup"),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+}
 
-	header := rawdb.ReadHeadHeader(chainDB)
-	stateRoot := header.Root
+func ExportStorageProofs(cfg ExportStorageProofsConfig) error {
+	if err := os.MkdirAll(cfg.OutputDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	_, chainDB, trieDB, err := openChain(cfg.ChainConfig)
+	if err != nil {
+		return err
+	}
+
+	pinned, err := ResolvePinnedState(cfg.ChainConfig, chainDB, trieDB)
+	if err != nil {
+		return err
+	}
+	if err := recordPinnedState(cfg.OutputDir, pinned); err != nil {
+		return err
+	}
+	stateRoot := pinned.StateRoot
+	// The input dir is only read from, so its manifest is checked, not written.
+	input, err := requireTables(cfg.InputDir, "accounts")
+	if err != nil {
+		return err
+	}
+	if input.StateRoot != stateRoot {
+		return fmt.Errorf("%v was exported from StateRoot=%v (block %v), but the chain is pinned to StateRoot=%v (block %v)", cfg.InputDir, input.StateRoot, input.BlockNumber, stateRoot, pinned.BlockNumber)
+	}
+	scope := "storage"
+	if cfg.SharedProofDB {
+		scope = ""
+	}
+	if err := checkProofIndex(cfg.OutputDir, scope, cfg.ProofIndex); err != nil {
+		return err
+	}
+	_, idToSegmentName := proofTableNames(scope, cfg.ProofIndex)
+	lastId, err := sharedProofDBLastId(cfg.OutputDir, cfg.SharedProofDB, idToSegmentName)
+	if err != nil {
+		return err
+	}
+	tables, err := appendProofTables(cfg.OutputDir, "slotAndIndexToProofIds", scope, cfg.ProofIndex)
+	if err != nil {
+		return err
+	}
+	if err := startTables(cfg.OutputDir, "export-storage-proofs", cfg, tables...); err != nil {
+		return err
+	}
 
-	proofDB := NewScopedProofDB(cfg.OutputDir, "storage")
-	slotAndIndexToProofIds := NewTable(cfg.OutputDir, "slotAndIndexToProofIds")
+	proofDB, err := NewScopedProofDB(cfg.OutputDir, scope, cfg.ProofIndex, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer proofDB.Close()
+	proofDB.UseShards(cfg.ProofDedupConfig)
+	if err := resumeProofDB(cfg.OutputDir, scope, proofDB, lastId); err != nil {
+		return err
+	}
+
+	slotAndIndexToProofIds, err := NewTable(cfg.OutputDir, "slotAndIndexToProofIds", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer slotAndIndexToProofIds.Close()
 
-	accountTable := NewAccountTable(cfg.InputDir)
+	accountTable, err := OpenAccountTableReadOnly(cfg.InputDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer accountTable.Close()
 
+	// Each worker walks its prefixes in key order, making it one sorted run.
+	var loader *BulkLoader
+	if cfg.PebbleConfig.BulkWrite {
+		proofDB.UseBatchedWrites()
+		loader, err = NewBulkLoader(slotAndIndexToProofIds.DB, cfg.OutputDir, "slotAndIndexToProofIds")
+		if err != nil {
+			return err
+		}
+	}
+
 	var (
-		wg    sync.WaitGroup
-		total atomic.Uint64
+		wg         sync.WaitGroup
+		total      atomic.Uint64
+		totalSlots atomic.Uint64
+
+		errOnce  sync.Once
+		firstErr error
+		failed   atomic.Bool
 	)
 
+	exportPrefix := func(w, p int, prefix []byte, i, nSlots *int, start time.Time) error {
+		save := slotAndIndexToProofIds.Set
+		if loader != nil {
+			save = loader.Writer(w).Set
+		}
+
+		iter, err := accountTable.DB.NewIter(PrefixIterOptions(prefix))
+		if err != nil {
+			return err
+		}
+		defer iter.Close()
+
+		for iter.First(); iter.Valid() && !failed.Load(); iter.Next() {
+			var slim SlimAccount
+			addressHashBytes := iter.Key()
+			buf := iter.Value()
+			if err := rlp.DecodeBytes(buf, &slim); err != nil {
+				return corruptRecord("accounts", addressHashBytes, err)
+			}
+			if !bytes.Equal(slim.Root, types.EmptyCodeHash.Bytes()) {
+				storageRoot := common.BytesToHash(slim.Root)
+				addressHash := common.Hash(addressHashBytes)
+				storageIt, err := newTrieIter(trie.StorageTrieID(stateRoot, addressHash, storageRoot), nil, trieDB)
+				if err != nil {
+					return err
+				}
+
+				for storageIt.Next() {
+					key := make([]byte, 32+32)
+					copy(key, addressHashBytes)
+					copy(key[32:], storageIt.Key)
+
+					ok, err := slotAndIndexToProofIds.Contains(key)
+					if err != nil {
+						return err
+					}
+					if !ok {
+						proof := storageIt.Prove()
+						pc := proofDB.NewScopedProofContainer(ProofScopeStorage)
+						if err := pc.DedupAll(proof); err != nil {
+							return err
+						}
+
+						proofIds := pc.AsIds()
+						if err := save(key, uint64SliceToBytesUnsafe(proofIds)); err != nil {
+							return err
+						}
+
+						*nSlots += 1
+					}
+					// Slots exported by an earlier run count too, so that
+					// the manifest holds every slot of the table.
+					totalSlots.Add(1)
+				}
+				if storageIt.Err != nil {
+					return storageIt.Err
+				}
+			}
+
+			*i += 1
+			t := total.Add(1)
+			if *i > 0 && *i%100_000 == 0 {
+				elapsed := time.Since(start)
+				log.Printf("%v %v %v total=%v nSlots=%v\n", p, *i, elapsed, t, *nSlots)
+			}
+		}
+		return iter.Error()
+	}
+
 	for w := 0; w < 16; w++ {
 		wg.Add(1)
 		go func(w int) {
+			defer wg.Done()
+
 			i := 0
 			nSlots := 0
 
@@ -53,58 +218,59 @@ func ExportStorageProofs(cfg ExportStorageProofsConfig) {
 
 			log.Printf("Starting iteration on worker %v\n", w)
 
-			for p := 0; p < 16; p++ {
+			for p := 0; p < 16 && !failed.Load(); p++ {
 				prefix := []byte{byte(w<<4) | byte(p)}
 				log.Printf("Worker=%v starting on prefix=%x\n", w, prefix)
-				iter, err := accountTable.DB.NewIter(PrefixIterOptions(prefix))
-				if err != nil {
-					log.Fatal(err)
-				}
-				defer iter.Close()
-
-				for iter.First(); iter.Valid(); iter.Next() {
-					var slim SlimAccount
-					addressHashBytes := iter.Key()
-					buf := iter.Value()
-					if err := rlp.DecodeBytes(buf, &slim); err != nil {
-						log.Fatal(err)
-					}
-					if !bytes.Equal(slim.Root, types.EmptyCodeHash.Bytes()) {
-						storageRoot := common.BytesToHash(slim.Root)
-						addressHash := common.Hash(addressHashBytes)
-						storageIt := newTrieIter(trie.StorageTrieID(stateRoot, addressHash, storageRoot), nil, trieDB)
-
-						for storageIt.Next() {
-							key := make([]byte, 32+32)
-							copy(key, addressHashBytes)
-							copy(key[32:], storageIt.Key)
-
-							if !slotAndIndexToProofIds.Contains(key) {
-								proof := storageIt.Prove()
-								pc := proofDB.NewProofContainer()
-								pc.DedupAll(proof)
-
-								proofIds := pc.AsIds()
-								slotAndIndexToProofIds.Set(key, uint64SliceToBytesUnsafe(proofIds))
-
-								nSlots += 1
-							}
-						}
-					}
-
-					i += 1
-					t := total.Add(1)
-					if i > 0 && i%100_000 == 0 {
-						elapsed := time.Since(start)
-						log.Printf("%v %v %v total=%v nSlots=%v\n", p, i, elapsed, t, nSlots)
-					}
+				if err := exportPrefix(w, p, prefix, &i, &nSlots, start); err != nil {
+					errOnce.Do(func() { firstErr = err })
+					failed.Store(true)
+					return
 				}
 			}
-			wg.Done()
 		}(w)
 	}
 
 	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	log.Printf("Finished. %v nSlots=%v\n", total.Load(), totalSlots.Load())
+	proofDB.LogStats()
+
+	if loader != nil {
+		if err := loader.Close(); err != nil {
+			return err
+		}
+	}
 
-	log.Printf("Finished. %v\n", total.Load())
+	return completeAppendedProofs(cfg.OutputDir, "slotAndIndexToProofIds", totalSlots.Load(), scope, proofDB)
+}
+
+// sharedProofDBLastId returns the last id of the account ProofDB in dir that
+// storage proofs are about to be added to, or 0 if there is none yet. The
+// account proofs must be finished, and dir must not also hold a storage
+// ProofDB, which would leave it unclear which one the storage proofs are in.
+func sharedProofDBLastId(dir string, shared bool, idToSegmentName string) (uint64, error) {
+	if !shared {
+		return 0, nil
+	}
+	m, err := ReadManifest(dir)
+	if err != nil || m == nil {
+		return 0, err
+	}
+	if m.Tables["storage-idToProofSegment"] != nil {
+		return 0, fmt.Errorf("%v already holds a separate storage ProofDB, export to a new output_dir to share the account one", dir)
+	}
+	return proofDBLastId(dir, idToSegmentName)
+}
+
+// storageProofScope returns the scope of the ProofDB holding the storage
+// proofs in a dir with manifest m: "storage", or "" if they share the account
+// ProofDB.
+func storageProofScope(m *Manifest) string {
+	if m.Tables["storage-idToProofSegment"] == nil && m.Tables["idToProofSegment"] != nil {
+		return ""
+	}
+	return "storage"
 }
@@ -2,8 +2,10 @@ package ethdataset
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"io"
 	"math"
-	// "bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -12,6 +14,8 @@ import (
 	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/cockroachdb/pebble"
 	// "github.com/ethereum/go-ethereum/common"
 	//"github.com/ethereum/go-ethereum/trie"
 )
@@ -22,6 +26,21 @@ type GeneratePIRDatasetConfig struct {
 
 	StateRoot string `toml:"state_root"`
 	// NAccountShards int    `toml:"n_account_shards"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *GeneratePIRDatasetConfig) Defaults() {
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
+
+func (c *GeneratePIRDatasetConfig) Validate() error {
+	return errors.Join(
+		requireField("work_dir", c.WorkDir),
+		requireField("out_dir", c.OutDir),
+		validateHash("state_root", c.StateRoot),
+		c.PebbleConfig.validate("pebble_config"),
+	)
 }
 
 type Metadata struct {
@@ -51,17 +70,35 @@ var (
 	sizeOfAccountPirRecord int = sizeOfAddressHash + sizeOfAccount + maxProofLen*sizeOfBucketIndex
 )
 
-func WriteMetadataToFile(path, file string, metadata Metadata) {
+// accountPirRecord lays out an account PIR record: the address hash, the slim
+// account zero padded to sizeOfAccount and the bucket indexes of its proof.
+// An address hash with no account, from absentToProof, gets a nil account,
+// i.e. all zeros, and the bucket indexes of its exclusion proof. No slim
+// account RLP starts with a zero byte, not even the empty account's, so
+// clients can tell a missing account from an empty one.
+func accountPirRecord(addressHash, slimAccount []byte, bucketIndexes []BucketIndex) []byte {
+	buf := make([]byte, sizeOfAccountPirRecord)
+	copy(buf, addressHash)
+	copy(buf[sizeOfAddressHash:], slimAccount)
+	copy(buf[sizeOfAddressHash+sizeOfAccount:], bucketIndexesToBytes(bucketIndexes, nBuckets))
+	return buf
+}
+
+// pirRecordAbsent reports whether the account of a PIR record says there is
+// no account.
+func pirRecordAbsent(account []byte) bool {
+	return len(account) == 0 || account[0] == 0
+}
+
+func WriteMetadataToFile(path, file string, metadata Metadata) error {
 	metadataFile, err := os.OpenFile(filepath.Join(path, file), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer metadataFile.Close()
 	enc := json.NewEncoder(metadataFile)
 
-	if err := enc.Encode(metadata); err != nil {
-		log.Fatal(err)
-	}
+	return enc.Encode(metadata)
 }
 
 type FileTableMetadata struct {
@@ -83,17 +120,18 @@ type FileTable struct {
 	startOffset int
 }
 
-func OpenFileTable(path, name string, recordSize, startOffset int) FileTable {
+func OpenFileTable(path, name string, recordSize, startOffset int) (FileTable, error) {
 	metadataFilePath := filepath.Join(path, fmt.Sprintf("%v.metadata.json", name))
 	metadataFile, err := os.OpenFile(metadataFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return FileTable{}, err
 	}
 
 	dataFilePath := filepath.Join(path, fmt.Sprintf("%v.bin", name))
 	dataFile, err := os.OpenFile(dataFilePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		log.Fatal(err)
+		metadataFile.Close()
+		return FileTable{}, err
 	}
 	dataWriter := bufio.NewWriter(dataFile)
 
@@ -109,110 +147,106 @@ func OpenFileTable(path, name string, recordSize, startOffset int) FileTable {
 		dataFile:       dataFile,
 		dataWriter:     dataWriter,
 		startOffset:    startOffset,
-	}
+	}, nil
 }
 
 func (f *FileTable) NextId() uint32 {
 	return f.nextId
 }
 
-func (f *FileTable) Append(b []byte) uint32 {
+func (f *FileTable) Append(b []byte) (uint32, error) {
 	id := f.nextId
-	f.nextId += 1
 
+	var nPaddingInt int
 	if len(b) < f.recordSize {
-		nPaddingInt := f.recordSize - len(b) + f.alwaysZeros
+		nPaddingInt = f.recordSize - len(b) + f.alwaysZeros
 		if nPaddingInt > 65535 {
-			log.Fatalf("requires more than 65535 bytes of padding, got=%v\n", nPaddingInt)
-		}
-		p := make([]byte, 2)
-		binary.LittleEndian.PutUint16(p, uint16(nPaddingInt))
-		if _, err := f.dataWriter.Write(p); err != nil {
-			log.Fatal(err)
-		}
-		if _, err := f.dataWriter.Write(b); err != nil {
-			log.Fatal(err)
-		}
-		if _, err := f.dataWriter.Write(make([]byte, nPaddingInt)); err != nil {
-			log.Fatal(err)
+			return 0, fmt.Errorf("FileTable.Append: requires more than 65535 bytes of padding, got=%v", nPaddingInt)
 		}
 	} else if len(b) > f.recordSize {
-		log.Fatalf("FileTable.Append: invalid record size got=%v, want=%v\n", len(b), f.recordSize)
+		return 0, fmt.Errorf("FileTable.Append: invalid record size got=%v, want=%v", len(b), f.recordSize)
 	} else {
-		p := make([]byte, 2)
-		binary.LittleEndian.PutUint16(p, uint16(f.alwaysZeros))
-		if _, err := f.dataWriter.Write(p); err != nil {
-			log.Fatal(err)
-		}
-		if _, err := f.dataWriter.Write(b); err != nil {
-			log.Fatal(err)
-		}
-		if _, err := f.dataWriter.Write(make([]byte, f.alwaysZeros)); err != nil {
-			log.Fatal(err)
-		}
+		nPaddingInt = f.alwaysZeros
 	}
 
-	return id
-}
+	p := make([]byte, 2)
+	binary.LittleEndian.PutUint16(p, uint16(nPaddingInt))
+	if _, err := f.dataWriter.Write(p); err != nil {
+		return 0, err
+	}
+	if _, err := f.dataWriter.Write(b); err != nil {
+		return 0, err
+	}
+	if _, err := f.dataWriter.Write(make([]byte, nPaddingInt)); err != nil {
+		return 0, err
+	}
 
-func (f *FileTable) WriteBlank() {
 	f.nextId += 1
+	return id, nil
+}
+
+func (f *FileTable) WriteBlank() error {
 	b := make([]byte, f.fullRecordSize)
 	if _, err := f.dataWriter.Write(b); err != nil {
-		log.Fatal(err)
+		return err
 	}
+	f.nextId += 1
+	return nil
 }
 
-func (f *FileTable) Get(rowId uint32) []byte {
+func (f *FileTable) Get(rowId uint32) ([]byte, error) {
 	// This will interact poorly with the buffered writer, this is just for testing.
 	if err := f.dataWriter.Flush(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	if _, err := f.dataFile.Seek(int64(int(rowId)*f.fullRecordSize), os.SEEK_SET); err != nil {
-		log.Fatal(err)
+	if _, err := f.dataFile.Seek(int64(int(rowId)*f.fullRecordSize), io.SeekStart); err != nil {
+		return nil, err
 	}
 
 	buf := make([]byte, f.fullRecordSize)
-	if _, err := f.dataFile.Read(buf); err != nil {
-		log.Fatal(err)
+	if _, err := io.ReadFull(f.dataFile, buf); err != nil {
+		return nil, err
 	}
 	padding := binary.LittleEndian.Uint16(buf)
+	if int(padding) > f.fullRecordSize-2 {
+		return nil, corruptRecord(f.dataFile.Name(), uint64ToKey(uint64(rowId)), fmt.Errorf("padding %v exceeds record size %v", padding, f.fullRecordSize))
+	}
 
 	// reset fd for write
-	if _, err := f.dataFile.Seek(0, os.SEEK_END); err != nil {
-		log.Fatal(err)
+	if _, err := f.dataFile.Seek(0, io.SeekEnd); err != nil {
+		return nil, err
 	}
 
-	return buf[2 : f.fullRecordSize-int(padding)]
+	return buf[2 : f.fullRecordSize-int(padding)], nil
 }
 
 func (f *FileTable) Size() int {
 	return int(f.nextId)
 }
 
-func (f *FileTable) Close() {
+func (f *FileTable) Close() error {
 	if err := json.NewEncoder(f.metadataFile).Encode(FileTableMetadata{
 		NRecords:    f.nextId,
 		RecordSize:  f.fullRecordSize,
 		StartOffset: f.startOffset,
 	}); err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if err := f.metadataFile.Close(); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	f.dataWriter.Flush()
-
-	if err := f.dataFile.Close(); err != nil {
-		log.Fatal(err)
+	if err := f.dataWriter.Flush(); err != nil {
+		return err
 	}
+
+	return f.dataFile.Close()
 }
 
-func metadataOfTable(t *Table) Metadata {
+func metadataOfTable(t *Table) (Metadata, error) {
 	iter, err := t.DB.NewIter(nil)
 	if err != nil {
-		log.Fatal(err)
+		return Metadata{}, err
 	}
 	defer iter.Close()
 
@@ -231,7 +265,7 @@ func metadataOfTable(t *Table) Metadata {
 			log.Printf("%v %v %v\n", m.NRecords, elapsed, m.RecordLen)
 		}
 	}
-	return m
+	return m, iter.Error()
 }
 
 type BucketIndex struct {
@@ -246,14 +280,14 @@ func bucketIndexToBytes(bucketIndex BucketIndex) []byte {
 	return b
 }
 
-func bucketIndexFromBytes(b []byte) BucketIndex {
+func bucketIndexFromBytes(b []byte) (BucketIndex, error) {
 	if len(b) < sizeOfBucketIndex {
-		log.Fatalf("buffer too small: got %d, want %d", len(b), sizeOfBucketIndex)
+		return BucketIndex{}, fmt.Errorf("%w: bucket index buffer too small: got %d, want %d", ErrCorruptRecord, len(b), sizeOfBucketIndex)
 	}
 	return BucketIndex{
 		BucketId: b[0],
 		RowId:    binary.LittleEndian.Uint32(b[1:5]),
-	}
+	}, nil
 }
 
 func bucketIndexesToBytes(bucketIndexes []BucketIndex, maxBuckets int) []byte {
@@ -311,15 +345,31 @@ func NewBucketMapper(
 	nTreeTop int,
 	nBuckets int,
 	bucketsMetadata Metadata,
-) *BucketMapper {
-	accountToProofIds := NewTable(workDir, "accountToProof")
-	idToProofSegment := NewTable(workDir, "idToProofSegment")
+	pc PebbleConfig,
+) (*BucketMapper, error) {
+	accountToProofIds, err := OpenTableReadOnly(workDir, "accountToProof", pc)
+	if err != nil {
+		return nil, err
+	}
+	idToProofSegment, err := OpenTableReadOnly(workDir, "idToProofSegment", pc)
+	if err != nil {
+		return nil, err
+	}
 
-	treeTop := OpenFileTable(outDir, "treeTop", bucketsMetadata.RecordLen, 0)
-	proofIdToBucketIndex := NewTable(outDir, "proofIdToBucketIndex")
+	treeTop, err := OpenFileTable(outDir, "treeTop", bucketsMetadata.RecordLen, 0)
+	if err != nil {
+		return nil, err
+	}
+	proofIdToBucketIndex, err := NewTable(outDir, "proofIdToBucketIndex", pc)
+	if err != nil {
+		return nil, err
+	}
 	buckets := make([]FileTable, nBuckets)
 	for i := 0; i < nBuckets; i++ {
-		b := OpenFileTable(outDir, fmt.Sprintf("account-proofs-%v", i), bucketsMetadata.RecordLen, 0)
+		b, err := OpenFileTable(outDir, fmt.Sprintf("account-proofs-%v", i), bucketsMetadata.RecordLen, 0)
+		if err != nil {
+			return nil, err
+		}
 
 		buckets[i] = b
 	}
@@ -341,46 +391,60 @@ func NewBucketMapper(
 		buckets:                 buckets,
 		initialRemainingBuckets: initialRemainingBuckets,
 		remainingBuckets:        remainingBuckets,
-	}
+	}, nil
 }
 
-func (b *BucketMapper) getBucketIndex(proofId uint64) *BucketIndex {
-	buf := b.proofIdToBucketIndex.MaybeGet(uint64ToKey(proofId))
-	if buf == nil {
-		return nil
-	} else {
-		bucketIndex := bucketIndexFromBytes(buf)
-		return &bucketIndex
+func (b *BucketMapper) getBucketIndex(proofId uint64) (*BucketIndex, error) {
+	buf, err := b.proofIdToBucketIndex.MaybeGet(uint64ToKey(proofId))
+	if err != nil || buf == nil {
+		return nil, err
 	}
+	bucketIndex, err := bucketIndexFromBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &bucketIndex, nil
 }
 
-func (b *BucketMapper) setBucketIndex(proofId uint64, bucketIndex *BucketIndex) {
-	b.proofIdToBucketIndex.Set(uint64ToKey(proofId), bucketIndexToBytes(*bucketIndex))
+func (b *BucketMapper) setBucketIndex(proofId uint64, bucketIndex *BucketIndex) error {
+	return b.proofIdToBucketIndex.Set(uint64ToKey(proofId), bucketIndexToBytes(*bucketIndex))
 }
 
-func (b *BucketMapper) addToBucket(bucketId uint8, proofId uint64) uint32 {
-	proofSegment := b.idToProofSegment.Get(uint64ToKey(proofId))
-	rowId := b.buckets[bucketId].Append(proofSegment)
-	return rowId
+func (b *BucketMapper) addToBucket(bucketId uint8, proofId uint64) (uint32, error) {
+	proofSegment, err := b.idToProofSegment.Get(uint64ToKey(proofId))
+	if err != nil {
+		return 0, err
+	}
+	return b.buckets[bucketId].Append(proofSegment)
 }
 
-func (b *BucketMapper) MapAccountProofToBucketIndexes(addressHashBytes []byte) []BucketIndex {
-	proofIdBytes := b.accountToProofIds.Get(addressHashBytes)
+func (b *BucketMapper) MapAccountProofToBucketIndexes(addressHashBytes []byte) ([]BucketIndex, error) {
+	proofIdBytes, err := b.accountToProofIds.Get(addressHashBytes)
+	if err != nil {
+		return nil, err
+	}
 	proofIds := bytesToUint64(proofIdBytes)
 	return b.MapProofToBucketIndexes(proofIds)
 }
 
-func (b *BucketMapper) MapProofToBucketIndexes(proofIds []uint64) []BucketIndex {
+func (b *BucketMapper) MapProofToBucketIndexes(proofIds []uint64) ([]BucketIndex, error) {
 	copy(b.remainingBuckets, b.initialRemainingBuckets)
 
 	var bucketIndexes []BucketIndex
 
-	for i := 0; i < b.nTreeTop; i++ {
+	// Proofs, exclusion proofs especially, can end within the tree top.
+	for i := 0; i < min(b.nTreeTop, len(proofIds)); i++ {
 		proofId := proofIds[i]
 		rowId, ok := b.treeTopProofIdToRow[proofId]
 		if !ok {
-			proofSegment := b.idToProofSegment.Get(uint64ToKey(proofId))
-			rowId = b.treeTop.Append(proofSegment)
+			proofSegment, err := b.idToProofSegment.Get(uint64ToKey(proofId))
+			if err != nil {
+				return nil, err
+			}
+			rowId, err = b.treeTop.Append(proofSegment)
+			if err != nil {
+				return nil, err
+			}
 			b.treeTopProofIdToRow[proofId] = rowId
 		}
 		bucketIndex := BucketIndex{
@@ -392,7 +456,10 @@ func (b *BucketMapper) MapProofToBucketIndexes(proofIds []uint64) []BucketIndex
 
 	for i := 0; i < len(proofIds)-b.nTreeTop; i++ {
 		proofId := proofIds[b.nTreeTop+i]
-		bucketIndex := b.getBucketIndex(proofId)
+		bucketIndex, err := b.getBucketIndex(proofId)
+		if err != nil {
+			return nil, err
+		}
 		if bucketIndex == nil {
 			mod := b.nBuckets - i
 
@@ -412,13 +479,18 @@ func (b *BucketMapper) MapProofToBucketIndexes(proofIds []uint64) []BucketIndex
 			}
 			b.roundRobinStart += 1
 
-			rowId := b.addToBucket(winningBucketId, proofId)
+			rowId, err := b.addToBucket(winningBucketId, proofId)
+			if err != nil {
+				return nil, err
+			}
 
 			bucketIndex = &BucketIndex{
 				BucketId: winningBucketId,
 				RowId:    rowId,
 			}
-			b.setBucketIndex(proofId, bucketIndex)
+			if err := b.setBucketIndex(proofId, bucketIndex); err != nil {
+				return nil, err
+			}
 
 			b.remainingBuckets[winningJ] = b.remainingBuckets[b.nBuckets-i-1]
 		} else {
@@ -431,32 +503,49 @@ func (b *BucketMapper) MapProofToBucketIndexes(proofIds []uint64) []BucketIndex
 		}
 		bucketIndexes = append(bucketIndexes, *bucketIndex)
 	}
-	return bucketIndexes
+	return bucketIndexes, nil
 }
 
-func (b *BucketMapper) GetProof(bucketIndexes []BucketIndex) [][]byte {
+func (b *BucketMapper) GetProof(bucketIndexes []BucketIndex) ([][]byte, error) {
 	var proofBytes [][]byte
 	for _, bucketIndex := range bucketIndexes {
-		var buf []byte
+		var (
+			buf []byte
+			err error
+		)
 		if bucketIndex.BucketId == 255 {
-			buf = b.treeTop.Get(bucketIndex.RowId)
+			buf, err = b.treeTop.Get(bucketIndex.RowId)
 		} else {
-			buf = b.buckets[bucketIndex.BucketId].Get(bucketIndex.RowId)
+			buf, err = b.buckets[bucketIndex.BucketId].Get(bucketIndex.RowId)
+		}
+		if err != nil {
+			return nil, err
 		}
 		proofBytes = append(proofBytes, buf)
 
 	}
-	return proofBytes
+	return proofBytes, nil
 }
 
-func (b *BucketMapper) Close() {
-	b.accountToProofIds.Close()
-	b.idToProofSegment.Close()
-	b.proofIdToBucketIndex.Close()
-	b.treeTop.Close()
+func (b *BucketMapper) Close() error {
+	errs := []error{
+		b.accountToProofIds.Close(),
+		b.idToProofSegment.Close(),
+		b.proofIdToBucketIndex.Close(),
+		b.treeTop.Close(),
+	}
 	for _, bucket := range b.buckets {
-		bucket.Close()
+		errs = append(errs, bucket.Close())
 	}
+	return errors.Join(errs...)
+}
+
+// NRecords returns the number of rows in the tree top and across all buckets.
+func (b *BucketMapper) NRecords() (treeTop uint64, buckets uint64) {
+	for _, bucket := range b.buckets {
+		buckets += uint64(bucket.nextId)
+	}
+	return uint64(b.treeTop.Size()), buckets
 }
 
 func (b *BucketMapper) Stats() BucketMapperStats {
@@ -479,45 +568,71 @@ func (b *BucketMapper) Stats() BucketMapperStats {
 	}
 }
 
-func getMetadata(accountTable, idToProofSegment *Table) (accountMetadata Metadata, proofSegmentMetadata Metadata) {
-	var wg sync.WaitGroup
+func getMetadata(accountTable, idToProofSegment *Table) (accountMetadata Metadata, proofSegmentMetadata Metadata, err error) {
+	var (
+		wg                 sync.WaitGroup
+		accountErr, segErr error
+	)
 	wg.Add(1)
 	go func() {
-		accountMetadata = metadataOfTable(accountTable)
+		accountMetadata, accountErr = metadataOfTable(accountTable)
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		proofSegmentMetadata = metadataOfTable(idToProofSegment)
+		proofSegmentMetadata, segErr = metadataOfTable(idToProofSegment)
 		wg.Done()
 	}()
 
 	wg.Wait()
-	return accountMetadata, proofSegmentMetadata
+	return accountMetadata, proofSegmentMetadata, errors.Join(accountErr, segErr)
 }
 
-func GeneratePIRDataset(cfg GeneratePIRDatasetConfig) {
+func GeneratePIRDataset(cfg GeneratePIRDatasetConfig) error {
 	// stateRoot := common.HexToHash(cfg.StateRoot)
 
-	os.MkdirAll(cfg.OutDir, os.ModePerm)
+	if err := os.MkdirAll(cfg.OutDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	m, err := requireTables(cfg.WorkDir, "accounts", "accountToProof", "idToProofSegment")
+	if err != nil {
+		return err
+	}
+	if err := requireStateRoot(cfg.WorkDir, m, cfg.StateRoot); err != nil {
+		return err
+	}
+	if err := recordPinnedState(cfg.OutDir, m.PinnedState); err != nil {
+		return err
+	}
+	if err := startTables(cfg.OutDir, "generate-pir-dataset", cfg, "accounts-pir", "treeTop", "account-proofs"); err != nil {
+		return err
+	}
 
-	accountTable := NewTable(cfg.WorkDir, "accounts")
+	accountTable, err := OpenTableReadOnly(cfg.WorkDir, "accounts", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer accountTable.Close()
 
 	iter, err := accountTable.DB.NewIter(nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer iter.Close()
 
-	proofBucketMapper := NewBucketMapper(
+	proofBucketMapper, err := NewBucketMapper(
 		cfg.WorkDir,
 		cfg.OutDir,
 		nTreeTop,
 		nBuckets,
 		proofSegmentMetadata,
+		cfg.PebbleConfig,
 	)
+	if err != nil {
+		return err
+	}
 	defer proofBucketMapper.Close()
 
 	nAccountsProcessed := 0
@@ -528,25 +643,73 @@ func GeneratePIRDataset(cfg GeneratePIRDatasetConfig) {
 
 	accountShardNumber := 0
 
-	NextAccountTable := func() *FileTable {
-		t := OpenFileTable(cfg.OutDir, fmt.Sprintf("accounts-pir-%v", accountShardNumber), sizeOfAccountPirRecord, 0)
+	NextAccountTable := func() (*FileTable, error) {
+		t, err := OpenFileTable(cfg.OutDir, fmt.Sprintf("accounts-pir-%v", accountShardNumber), sizeOfAccountPirRecord, 0)
+		if err != nil {
+			return nil, err
+		}
 		accountShardNumber += 1
-		return &t
+		return &t, nil
+	}
+	accountPirTable, err := NextAccountTable()
+	if err != nil {
+		return err
 	}
-	accountPirTable := NextAccountTable()
 
-	for iter.First(); iter.Valid(); iter.Next() {
-		addressHashBytes := iter.Key()
-		slimAccount := iter.Value()
+	// Address hashes proven absent are merged in, keeping the rows in address
+	// hash order.
+	var (
+		absentIter  *pebble.Iterator
+		absentValid bool
+		nAbsent     int
+	)
+	if m.Tables["absentToProof"] != nil {
+		if _, err := requireTables(cfg.WorkDir, "absentToProof"); err != nil {
+			return err
+		}
+		absentTable, err := OpenTableReadOnly(cfg.WorkDir, "absentToProof", cfg.PebbleConfig)
+		if err != nil {
+			return err
+		}
+		defer absentTable.Close()
+		if absentIter, err = absentTable.DB.NewIter(nil); err != nil {
+			return err
+		}
+		defer absentIter.Close()
+		absentValid = absentIter.First()
+	}
 
-		bucketIndexes := proofBucketMapper.MapAccountProofToBucketIndexes(addressHashBytes)
+	valid := iter.First()
+	for valid || absentValid {
+		absent := absentValid && (!valid || bytes.Compare(absentIter.Key(), iter.Key()) <= 0)
 
-		buf := make([]byte, sizeOfAccountPirRecord)
-		copy(buf, addressHashBytes)
-		copy(buf[sizeOfAddressHash:], slimAccount)
-		copy(buf[sizeOfAddressHash+sizeOfAccount:], bucketIndexesToBytes(bucketIndexes, nBuckets))
+		var buf []byte
+		if absent {
+			addressHashBytes := absentIter.Key()
+			if valid && bytes.Equal(addressHashBytes, iter.Key()) {
+				return corruptRecord("absentToProof", addressHashBytes, errors.New("address hash has an account"))
+			}
+			bucketIndexes, err := proofBucketMapper.MapProofToBucketIndexes(bytesToUint64(absentIter.Value()))
+			if err != nil {
+				return err
+			}
+			buf = accountPirRecord(addressHashBytes, nil, bucketIndexes)
+			nAbsent += 1
+		} else {
+			addressHashBytes := iter.Key()
+			slimAccount := iter.Value()
+
+			bucketIndexes, err := proofBucketMapper.MapAccountProofToBucketIndexes(addressHashBytes)
+			if err != nil {
+				return err
+			}
+			buf = accountPirRecord(addressHashBytes, slimAccount, bucketIndexes)
+		}
 
-		rowId := accountPirTable.Append(buf)
+		rowId, err := accountPirTable.Append(buf)
+		if err != nil {
+			return err
+		}
 		_ = rowId
 		// got := accountPirTable.Get(rowId)
 		// if !bytes.Equal(buf, got) {
@@ -561,14 +724,46 @@ func GeneratePIRDataset(cfg GeneratePIRDatasetConfig) {
 		// }
 
 		if nAccountsProcessed > 0 && nAccountsProcessed%accountChunkSize == 0 {
-			accountPirTable.Close()
-			accountPirTable = NextAccountTable()
+			if err := accountPirTable.Close(); err != nil {
+				return err
+			}
+			accountPirTable, err = NextAccountTable()
+			if err != nil {
+				return err
+			}
 		}
 
 		nAccountsProcessed += 1
 		if nAccountsProcessed > 0 && nAccountsProcessed%100_000 == 0 {
-			log.Printf("nAccountsProcessed=%v\n", nAccountsProcessed)
+			log.Printf("nAccountsProcessed=%v nAbsent=%v\n", nAccountsProcessed, nAbsent)
+		}
+
+		if absent {
+			absentValid = absentIter.Next()
+		} else {
+			valid = iter.Next()
+		}
+	}
+	if absentIter != nil {
+		if err := absentIter.Error(); err != nil {
+			return err
 		}
 	}
-	accountPirTable.Close()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := accountPirTable.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("Finished nRecords=%v nAbsent=%v\n", nAccountsProcessed, nAbsent)
+
+	nTreeTop, nSegments := proofBucketMapper.NRecords()
+	if err := completeTable(cfg.OutDir, "accounts-pir", uint64(nAccountsProcessed)); err != nil {
+		return err
+	}
+	if err := completeTable(cfg.OutDir, "treeTop", nTreeTop); err != nil {
+		return err
+	}
+	return completeTable(cfg.OutDir, "account-proofs", nSegments)
 }
@@ -1,7 +1,7 @@
 package ethdataset
 
 import (
-	"log"
+	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/fdlimit"
@@ -17,7 +17,7 @@ import (
 	"github.com/ethereum/go-ethereum/triedb/pathdb"
 )
 
-func newNode(dataDir string) *node.Node {
+func newNode(dataDir string) (*node.Node, error) {
 	stack, err := node.New(&node.Config{
 		DataDir: dataDir,
 		Name:    "geth",
@@ -36,40 +36,47 @@ func newNode(dataDir string) *node.Node {
 		},
 	})
 	if err != nil {
-		log.Fatalf("Failed to create the protocol stack: %v", err)
+		return nil, fmt.Errorf("failed to create the protocol stack: %w", err)
 	}
-	return stack
+	return stack, nil
 }
 
-func numDBHandles() int {
+func numDBHandles() (int, error) {
 	limit, err := fdlimit.Maximum()
 	if err != nil {
-		log.Fatalf("Failed to retrieve file descriptor allowance: %v", err)
+		return 0, fmt.Errorf("failed to retrieve file descriptor allowance: %w", err)
 	}
 	raised, err := fdlimit.Raise(uint64(limit))
 	if err != nil {
-		log.Fatalf("Failed to raise file descriptor allowance: %v", err)
+		return 0, fmt.Errorf("failed to raise file descriptor allowance: %w", err)
 	}
-	return int(raised / 2) // Leave half for networking and other stuff
+	return int(raised / 2), nil // Leave half for networking and other stuff
 }
 
-func newChainDB(ancientsDir string, stack *node.Node) ethdb.Database {
+func newChainDB(ancientsDir string, stack *node.Node) (ethdb.Database, error) {
+	handles, err := numDBHandles()
+	if err != nil {
+		return nil, err
+	}
 	options := node.DatabaseOptions{
 		ReadOnly:          false,
 		Cache:             1024 * 50 / 100,
-		Handles:           numDBHandles(),
+		Handles:           handles,
 		AncientsDirectory: ancientsDir,
 		MetricsNamespace:  "eth/db/chaindata/",
 		EraDirectory:      "ancient/chain",
 	}
 	chainDB, err := stack.OpenDatabaseWithOptions("chaindata", options)
 	if err != nil {
-		log.Fatalf("Could not open database: %v", err)
+		return nil, fmt.Errorf("could not open database: %w", err)
 	}
-	return chainDB
+	return chainDB, nil
 }
 
 func newTrieDB(stack *node.Node, chainDB ethdb.Database) *triedb.Database {
+	// Preimages only records the preimages of keys written through the trie
+	// database, which we never do. ExportPreimages reads the ones geth
+	// recorded straight from the chain database.
 	config := &triedb.Config{
 		Preimages: false,
 		IsVerkle:  false,
@@ -87,10 +94,24 @@ func newTrieDB(stack *node.Node, chainDB ethdb.Database) *triedb.Database {
 	return triedb.NewDatabase(chainDB, config)
 }
 
-func newTrieIter(id *trie.ID, prefix []byte, trieDB *triedb.Database) *trie.Iterator {
+// openChain opens the geth node, chain database and trie database described
+// by cfg.
+func openChain(cfg ChainConfig) (*node.Node, ethdb.Database, *triedb.Database, error) {
+	stack, err := newNode(cfg.DataDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	chainDB, err := newChainDB(cfg.AncientsDir, stack)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return stack, chainDB, newTrieDB(stack, chainDB), nil
+}
+
+func newTrieIter(id *trie.ID, prefix []byte, trieDB *triedb.Database) (*trie.Iterator, error) {
 	tr, err := trie.New(id, trieDB)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	var trieIt trie.NodeIterator
@@ -100,18 +121,14 @@ func newTrieIter(id *trie.ID, prefix []byte, trieDB *triedb.Database) *trie.Iter
 		trieIt, err = tr.NodeIterator(nil)
 	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	it := trie.NewIterator(trieIt)
-	return it
+	return it, nil
 }
 
-func newStateDBForRoot(chainDB ethdb.Database, trieDB *triedb.Database, snaptree *snapshot.Tree, root common.Hash) *state.StateDB {
+func newStateDBForRoot(chainDB ethdb.Database, trieDB *triedb.Database, snaptree *snapshot.Tree, root common.Hash) (*state.StateDB, error) {
 	db := state.NewDatabase(trieDB, snaptree)
-	statedb, err := state.New(root, db)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return statedb
+	return state.New(root, db)
 }
@@ -1,8 +1,8 @@
 package ethdataset
 
 import (
+	"errors"
 	"io"
-	"log"
 	"os"
 
 	"github.com/golang/snappy"
@@ -14,16 +14,16 @@ type ColumnFile struct {
 	io.Reader
 }
 
-func NewColumnFile(path string) *ColumnFile {
+func NewColumnFile(path string) (*ColumnFile, error) {
 	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	return &ColumnFile{
 		File:        file,
 		WriteCloser: snappy.NewBufferedWriter(file),
 		Reader:      snappy.NewReader(file),
-	}
+	}, nil
 }
 
 type KeyValue struct {
@@ -31,31 +31,39 @@ type KeyValue struct {
 	Value *ColumnFile
 }
 
-func NewKeyValue(path string) *KeyValue {
-	return &KeyValue{
-		Key:   NewColumnFile(path + "_key.bin.sz"),
-		Value: NewColumnFile(path + "_value.bin.sz"),
+func NewKeyValue(path string) (*KeyValue, error) {
+	key, err := NewColumnFile(path + "_key.bin.sz")
+	if err != nil {
+		return nil, err
+	}
+	value, err := NewColumnFile(path + "_value.bin.sz")
+	if err != nil {
+		key.File.Close()
+		return nil, err
 	}
+	return &KeyValue{
+		Key:   key,
+		Value: value,
+	}, nil
 }
 
 func (kv *KeyValue) Write(key, value []byte) (int, error) {
 	if _, err := kv.Key.Write(key); err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 	if _, err := kv.Value.Write(value); err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 	return 0, nil
 }
 
 func (kv *KeyValue) Close() error {
-	if err := kv.Key.Close(); err != nil {
-		log.Fatal(err)
-	}
-	if err := kv.Value.Close(); err != nil {
-		log.Fatal(err)
-	}
-	return nil
+	return errors.Join(
+		kv.Key.Close(),
+		kv.Value.Close(),
+		kv.Key.File.Close(),
+		kv.Value.File.Close(),
+	)
 }
 
 func (kv *KeyValue) Iter(keySize, valueSize uint64) Iter {
@@ -79,6 +87,8 @@ type Iter struct {
 
 	currentKey   []byte
 	currentValue []byte
+
+	err error
 }
 
 func (i *Iter) Next() bool {
@@ -89,16 +99,16 @@ func (i *Iter) Next() bool {
 	}
 
 	key := make([]byte, i.keySize)
-	_, err := io.ReadFull(i.kv.Key.Reader, key)
-	if err != nil {
-		log.Fatal(err)
+	if _, err := io.ReadFull(i.kv.Key.Reader, key); err != nil {
+		i.err = err
+		return false
 	}
 	i.currentKey = key
 
 	value := make([]byte, i.valueSize)
-	_, err = io.ReadFull(i.kv.Value.Reader, value)
-	if err != nil {
-		log.Fatal(err)
+	if _, err := io.ReadFull(i.kv.Value.Reader, value); err != nil {
+		i.err = err
+		return false
 	}
 	i.currentValue = value
 
@@ -112,3 +122,8 @@ func (i *Iter) Key() []byte {
 func (i *Iter) Value() []byte {
 	return i.currentValue
 }
+
+// Err returns the error that stopped iteration, if any.
+func (i *Iter) Err() error {
+	return i.err
+}
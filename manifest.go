@@ -0,0 +1,227 @@
+package ethdataset
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const manifestFileName = "manifest.json"
+
+const (
+	TableInProgress = "in_progress"
+	TableComplete   = "complete"
+)
+
+// TableManifest records which command produced a table and whether it
+// finished. NRecords counts the records of the table, except that exports
+// can't cheaply count the segments of a ProofDB: they leave it 0 for its
+// tables and only record LastId. Commands visiting every segment set both.
+type TableManifest struct {
+	Command     string    `json:"command"`
+	ToolVersion string    `json:"tool_version"`
+	ConfigHash  string    `json:"config_hash"`
+	NRecords    uint64    `json:"n_records"`
+	Status      string    `json:"status"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// LastId is the last id handed out by a ProofDB, recorded on its index
+	// and idToProofSegment tables. Shard id blocks, resumes and gc leave gaps
+	// below it, so it bounds the ids rather than counting them.
+	LastId uint64 `json:"last_id,omitempty"`
+}
+
+// lastId returns the LastId of a ProofDB table. Manifests written before
+// LastId existed kept the last id in NRecords.
+func (t *TableManifest) lastId() uint64 {
+	if t.LastId == 0 {
+		return t.NRecords
+	}
+	return t.LastId
+}
+
+// Manifest describes the state a work dir was exported from and every table
+// written into it.
+type Manifest struct {
+	PinnedState
+	Tables map[string]*TableManifest `json:"tables"`
+}
+
+// ReadManifest returns the manifest in dir, or nil if there is none.
+func ReadManifest(dir string) (*Manifest, error) {
+	path := filepath.Join(dir, manifestFileName)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, corruptRecord(path, nil, err)
+	}
+	if m.Tables == nil {
+		m.Tables = make(map[string]*TableManifest)
+	}
+	return &m, nil
+}
+
+// WriteManifest atomically replaces the manifest in dir.
+func WriteManifest(dir string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, manifestFileName), b)
+}
+
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			version += "+" + s.Value
+		}
+	}
+	return version
+}
+
+func configHash(cfg interface{}) (string, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// recordPinnedState records pinned in the manifest in dir. A work dir only
+// holds tables for a single state, so a manifest for a different state root is
+// an error until the work dir is moved over with Repin.
+func recordPinnedState(dir string, pinned PinnedState) error {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return WriteManifest(dir, &Manifest{
+			PinnedState: pinned,
+			Tables:      make(map[string]*TableManifest),
+		})
+	}
+	if m.StateRoot != pinned.StateRoot {
+		return fmt.Errorf("%v already holds StateRoot=%v (block %v), refusing to add StateRoot=%v (block %v), run proofs repin to move it over", dir, m.StateRoot, m.BlockNumber, pinned.StateRoot, pinned.BlockNumber)
+	}
+	return nil
+}
+
+// startTables marks tables in dir as being written by command with cfg. The
+// state must already have been recorded with recordPinnedState.
+func startTables(dir, command string, cfg interface{}, tables ...string) error {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("%v has no manifest, record the pinned state first", dir)
+	}
+	hash, err := configHash(cfg)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		m.Tables[table] = &TableManifest{
+			Command:     command,
+			ToolVersion: toolVersion(),
+			ConfigHash:  hash,
+			Status:      TableInProgress,
+			UpdatedAt:   time.Now().UTC(),
+		}
+	}
+	return WriteManifest(dir, m)
+}
+
+// completeTable marks table in dir as finished with nRecords records.
+func completeTable(dir, table string, nRecords uint64) error {
+	return completeProofDBTable(dir, table, nRecords, 0)
+}
+
+// completeProofDBTable marks the ProofDB table in dir as finished with
+// nRecords segments, 0 if they weren't counted, and ids up to lastId.
+func completeProofDBTable(dir, table string, nRecords, lastId uint64) error {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	if m == nil || m.Tables[table] == nil {
+		return fmt.Errorf("%v: table %v was never started", dir, table)
+	}
+	t := m.Tables[table]
+	t.NRecords = nRecords
+	t.LastId = lastId
+	t.Status = TableComplete
+	t.UpdatedAt = time.Now().UTC()
+	return WriteManifest(dir, m)
+}
+
+// requireTables loads the manifest in dir and fails unless every table was
+// written to completion and is not halfway through being renumbered.
+func requireTables(dir string, tables ...string) (*Manifest, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("%v has no %v, was it produced by an exporter?", dir, manifestFileName)
+	}
+	if err := requireNoRenumberSwap(dir, tables); err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		t, ok := m.Tables[table]
+		if !ok {
+			return nil, fmt.Errorf("%v: missing table %v", dir, table)
+		}
+		if t.Status != TableComplete {
+			return nil, fmt.Errorf("%v: table %v is %v (written by %v), rerun it to completion", dir, table, t.Status, t.Command)
+		}
+	}
+	return m, nil
+}
+
+// requireStateRoot fails if m was exported from a state other than stateRoot.
+// An empty stateRoot accepts any state.
+func requireStateRoot(dir string, m *Manifest, stateRoot string) error {
+	if stateRoot == "" {
+		return nil
+	}
+	if want := common.HexToHash(stateRoot); m.StateRoot != want {
+		return fmt.Errorf("%v was exported from StateRoot=%v (block %v), want StateRoot=%v", dir, m.StateRoot, m.BlockNumber, want)
+	}
+	return nil
+}
+
+// dropTable removes table from the manifest in dir, e.g. after deleting it.
+func dropTable(dir, table string) error {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return nil
+	}
+	delete(m.Tables, table)
+	return WriteManifest(dir, m)
+}
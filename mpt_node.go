@@ -3,6 +3,8 @@ package ethdataset
 import (
 	"fmt"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
@@ -87,6 +89,27 @@ func compactToHex(compact []byte) []byte {
 	return hex
 }
 
+// hexToCompact is the inverse of compactToHex: it packs hex nibbles, with a
+// trailing 16 for leaves, into the compact encoding used for node keys.
+func hexToCompact(hex []byte) []byte {
+	flags := byte(0)
+	if hasTerminatorFlag(hex) {
+		flags = 2
+		hex = hex[:len(hex)-1]
+	}
+	compact := make([]byte, len(hex)/2+1)
+	if len(hex)%2 == 1 {
+		flags |= 1
+		compact[0] = hex[0]
+		hex = hex[1:]
+	}
+	compact[0] |= flags << 4
+	for i := 0; i < len(hex); i += 2 {
+		compact[1+i/2] = hex[i]<<4 | hex[i+1]
+	}
+	return compact
+}
+
 func hasTerminatorFlag(s []byte) bool {
 	return len(s) > 0 && s[len(s)-1] == 16
 }
@@ -200,3 +223,58 @@ func ParseNode(b []byte) (*MPTNode, error) {
 		return nil, fmt.Errorf("invalid number of MPT Node elements, got=%v, want 2 or 17.", c)
 	}
 }
+
+// Encode returns the canonical RLP encoding of n, the same bytes ParseNode
+// parsed it from. Embedded children are encoded inline.
+func (n *MPTNode) Encode() []byte {
+	w := rlp.NewEncoderBuffer(nil)
+	n.encode(w)
+	b := w.ToBytes()
+	w.Flush()
+	return b
+}
+
+// Hash returns the keccak hash of n's encoding, which is how a parent refers
+// to n unless n is embedded.
+func (n *MPTNode) Hash() common.Hash {
+	return crypto.Keccak256Hash(n.Encode())
+}
+
+// Ref returns how a parent refers to n: its encoding if that is shorter than
+// a hash, in which case n is embedded in the parent, and its hash otherwise.
+func (n *MPTNode) Ref() []byte {
+	b := n.Encode()
+	if len(b) < 32 {
+		return b
+	}
+	return crypto.Keccak256(b)
+}
+
+func (n *MPTNode) encode(w rlp.EncoderBuffer) {
+	list := w.List()
+	switch {
+	case n.IsLeafNode():
+		w.WriteBytes(hexToCompact(append(append([]byte{}, n.Leaf.Key...), 16)))
+		w.WriteBytes(n.Leaf.Value)
+	case n.IsExtensionNode():
+		w.WriteBytes(hexToCompact(n.Extension.Key))
+		if n.Extension.IsEmbedded() {
+			n.Extension.Embedded.encode(w)
+		} else {
+			w.WriteBytes(n.Extension.NodeHash)
+		}
+	case n.IsBranchNode():
+		for _, child := range n.Branch.Children {
+			switch {
+			case child == nil:
+				w.WriteBytes(nil)
+			case child.IsEmbedded():
+				child.Embedded.encode(w)
+			default:
+				w.WriteBytes(child.Hash)
+			}
+		}
+		w.WriteBytes(n.Branch.Value)
+	}
+	w.ListEnd(list)
+}
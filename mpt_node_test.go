@@ -0,0 +1,169 @@
+package ethdataset
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/trie/trienode"
+	"github.com/ethereum/go-ethereum/triedb"
+)
+
+// testTrie builds a trie from keys and values with geth's trie.
+func testTrie(t *testing.T, kvs map[string]string) *trie.Trie {
+	t.Helper()
+	tr := trie.NewEmpty(triedb.NewDatabase(rawdb.NewMemoryDatabase(), nil))
+	for k, v := range kvs {
+		tr.MustUpdate([]byte(k), []byte(v))
+	}
+	return tr
+}
+
+// prove returns the proof of key in tr, root first.
+func prove(t *testing.T, tr *trie.Trie, key string) [][]byte {
+	t.Helper()
+	var list trienode.ProofList
+	if err := tr.Prove([]byte(key), &list); err != nil {
+		t.Fatal(err)
+	}
+	proof := make([][]byte, len(list))
+	for i, b := range list {
+		proof[i] = b
+	}
+	return proof
+}
+
+// proofNodes returns every node on the proofs of keys in tr.
+func proofNodes(t *testing.T, tr *trie.Trie, keys []string) [][]byte {
+	t.Helper()
+	seen := make(map[string]bool)
+	var nodes [][]byte
+	for _, k := range keys {
+		for _, b := range prove(t, tr, k) {
+			if !seen[string(b)] {
+				seen[string(b)] = true
+				nodes = append(nodes, b)
+			}
+		}
+	}
+	return nodes
+}
+
+// nodeShapes counts the kinds of nodes in n and its embedded children.
+type nodeShapes struct {
+	leaves, extensions, branches, branchValues, embedded int
+}
+
+func (s *nodeShapes) add(n *MPTNode) {
+	switch {
+	case n.IsLeafNode():
+		s.leaves++
+	case n.IsExtensionNode():
+		s.extensions++
+		if n.Extension.IsEmbedded() {
+			s.embedded++
+			s.add(n.Extension.Embedded)
+		}
+	case n.IsBranchNode():
+		s.branches++
+		if len(n.Branch.Value) > 0 {
+			s.branchValues++
+		}
+		for _, child := range n.Branch.Children {
+			if child != nil && child.IsEmbedded() {
+				s.embedded++
+				s.add(child.Embedded)
+			}
+		}
+	}
+}
+
+func TestParseNodeRoundTrip(t *testing.T) {
+	kvs := map[string]string{
+		// "do" is a prefix of "dog", so the branch below it holds a value.
+		"do":   "verb",
+		"dog":  "puppy",
+		"doge": "coin",
+		// Short keys and values make nodes under 32 bytes, which are
+		// embedded in their parent.
+		"a1": "x",
+		"a2": "y",
+		"a3": "z",
+		// Long values can't be embedded.
+		"horse":     string(bytes.Repeat([]byte("stallion"), 8)),
+		"horseshoe": string(bytes.Repeat([]byte("iron"), 16)),
+	}
+	tr := testTrie(t, kvs)
+	var keys []string
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+
+	var shapes nodeShapes
+	for _, b := range proofNodes(t, tr, keys) {
+		n, err := ParseNode(b)
+		if err != nil {
+			t.Fatalf("ParseNode(%x): %v", b, err)
+		}
+		if got := n.Encode(); !bytes.Equal(got, b) {
+			t.Errorf("Encode(ParseNode(%x)) = %x", b, got)
+		}
+		shapes.add(n)
+	}
+	if shapes.leaves == 0 || shapes.extensions == 0 || shapes.branches == 0 || shapes.branchValues == 0 || shapes.embedded == 0 {
+		t.Errorf("test trie is missing node shapes: %+v", shapes)
+	}
+}
+
+func TestParseNodeHashAndRef(t *testing.T) {
+	// The keys differ in the first nibble, so the root is a branch.
+	tr := testTrie(t, map[string]string{"\x10": "x", "\x20": "y", "\x30": "z"})
+	nodes := proofNodes(t, tr, []string{"\x10"})
+	root, err := ParseNode(nodes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := root.Hash(), tr.Hash(); got != want {
+		t.Errorf("Hash() = %v, want %v", got, want)
+	}
+	var embedded *MPTNode
+	for _, child := range root.Branch.Children {
+		if child != nil && child.IsEmbedded() {
+			embedded = child.Embedded
+		}
+	}
+	if embedded == nil {
+		t.Fatal("root has no embedded child")
+	}
+	if ref := embedded.Ref(); !bytes.Equal(ref, embedded.Encode()) {
+		t.Errorf("Ref() of an embedded node = %x, want its encoding %x", ref, embedded.Encode())
+	}
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	// Every nibble string up to 4 nibbles long, with and without the leaf
+	// terminator.
+	var hexes [][]byte
+	hexes = append(hexes, []byte{})
+	for n := 1; n <= 4; n++ {
+		for i := 0; i < 1<<(4*n); i++ {
+			hex := make([]byte, n)
+			for j := range hex {
+				hex[j] = byte(i>>(4*j)) & 0x0f
+			}
+			hexes = append(hexes, hex)
+		}
+	}
+	for _, hex := range hexes {
+		for _, h := range [][]byte{hex, append(append([]byte{}, hex...), 16)} {
+			compact := hexToCompact(h)
+			if got := compactToHex(compact); !bytes.Equal(got, h) {
+				t.Fatalf("compactToHex(hexToCompact(%x)) = %x", h, got)
+			}
+			if got := hexToCompact(compactToHex(compact)); !bytes.Equal(got, compact) {
+				t.Fatalf("hexToCompact(compactToHex(%x)) = %x", compact, got)
+			}
+		}
+	}
+}
@@ -1,31 +1,194 @@
 package ethdataset
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+
 	"github.com/cockroachdb/pebble"
 	"github.com/cockroachdb/pebble/bloom"
 )
 
-func FastUnsafeOptions() *pebble.Options {
-	// Large unified cache (data/index/filter blocks). Adjust for your RAM budget.
-	cache := pebble.NewCache(8 << 30) // 8 GiB
-
-	opts := &pebble.Options{
-		Cache:                       cache,
-		MemTableSize:                256 << 20,
-		MemTableStopWritesThreshold: 64,
-		L0CompactionThreshold:       40,
-		L0StopWritesThreshold:       200,
+const (
+	// ProfileBulkLoad favours write throughput: huge memtables, lazy
+	// compaction, a big cache and no fsync. It's what every table used to be
+	// opened with.
+	ProfileBulkLoad = "bulk-load"
+	// ProfileReadMostly favours point reads and scans of finished tables.
+	ProfileReadMostly = "read-mostly"
+	// ProfileDurable syncs every write, for tables we keep long-term.
+	ProfileDurable = "durable"
+	// ProfileLowMemory keeps the cache and memtables small for dev boxes.
+	ProfileLowMemory = "low-memory"
+)
+
+type pebbleProfile struct {
+	cacheSize                   uint64
+	memTableSize                uint64
+	memTableStopWritesThreshold int
+	l0CompactionThreshold       int
+	l0StopWritesThreshold       int
+	maxOpenFiles                int
+	bytesPerSync                int
+	sync                        bool
+}
+
+var pebbleProfiles = map[string]pebbleProfile{
+	ProfileBulkLoad: {
+		cacheSize:                   8 << 30,
+		memTableSize:                256 << 20,
+		memTableStopWritesThreshold: 64,
+		l0CompactionThreshold:       40,
+		l0StopWritesThreshold:       200,
+		maxOpenFiles:                100_000,
+	},
+	ProfileReadMostly: {
+		cacheSize:                   4 << 30,
+		memTableSize:                64 << 20,
+		memTableStopWritesThreshold: 4,
+		l0CompactionThreshold:       4,
+		l0StopWritesThreshold:       12,
+		maxOpenFiles:                10_000,
+		bytesPerSync:                512 << 10,
+	},
+	ProfileDurable: {
+		cacheSize:                   1 << 30,
+		memTableSize:                64 << 20,
+		memTableStopWritesThreshold: 4,
+		l0CompactionThreshold:       4,
+		l0StopWritesThreshold:       12,
+		maxOpenFiles:                10_000,
+		bytesPerSync:                512 << 10,
+		sync:                        true,
+	},
+	ProfileLowMemory: {
+		cacheSize:                   64 << 20,
+		memTableSize:                16 << 20,
+		memTableStopWritesThreshold: 2,
+		l0CompactionThreshold:       4,
+		l0StopWritesThreshold:       12,
+		maxOpenFiles:                1_000,
+		bytesPerSync:                512 << 10,
+	},
+}
+
+func pebbleProfileNames() []string {
+	var names []string
+	for name := range pebbleProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// maxMemTableSize is the largest memtable Pebble accepts.
+const maxMemTableSize = 4<<30 - 1
+
+// PebbleConfig picks the Pebble profile each table is opened with. The sizes
+// override the profile when set and apply to each table separately.
+type PebbleConfig struct {
+	// Profile applies to every table not named in Tables.
+	Profile string `toml:"profile"`
+	// Tables maps a table name, e.g. accounts or idToProofSegment, to a
+	// profile.
+	Tables map[string]string `toml:"tables"`
+
+	CacheSize                   uint64 `toml:"cache_size"`
+	MemTableSize                uint64 `toml:"memtable_size"`
+	MemTableStopWritesThreshold int    `toml:"memtable_stop_writes_threshold"`
+	MaxOpenFiles                int    `toml:"max_open_files"`
+
+	// BulkWrite makes exporters ingest tables written in key order as SSTs
+	// and batch writes to the rest.
+	BulkWrite bool `toml:"bulk_write"`
+}
+
+func (c *PebbleConfig) defaults(profile string) {
+	c.Profile = profile
+}
+
+func (c PebbleConfig) validate(prefix string) error {
+	var errs []error
+	checkProfile := func(field, profile string) {
+		if _, ok := pebbleProfiles[profile]; !ok {
+			errs = append(errs, &ConfigError{Field: field, Reason: fmt.Sprintf("unknown profile %q, want one of %v", profile, pebbleProfileNames())})
+		}
+	}
+	if c.Profile != "" {
+		checkProfile(prefix+".profile", c.Profile)
+	}
+	for table, profile := range c.Tables {
+		checkProfile(prefix+".tables."+table, profile)
+	}
+	if c.MemTableSize > maxMemTableSize {
+		errs = append(errs, &ConfigError{Field: prefix + ".memtable_size", Reason: "must be less than 4 GiB"})
+	}
+	if c.MemTableStopWritesThreshold < 0 {
+		errs = append(errs, &ConfigError{Field: prefix + ".memtable_stop_writes_threshold", Reason: "must not be negative"})
+	}
+	if c.MaxOpenFiles < 0 {
+		errs = append(errs, &ConfigError{Field: prefix + ".max_open_files", Reason: "must not be negative"})
+	}
+	return errors.Join(errs...)
+}
+
+func (c PebbleConfig) profileFor(table string) pebbleProfile {
+	name := c.Profile
+	if p, ok := c.Tables[table]; ok {
+		name = p
+	}
+	profile, ok := pebbleProfiles[name]
+	if !ok {
+		profile = pebbleProfiles[ProfileBulkLoad]
+	}
+	if c.CacheSize != 0 {
+		profile.cacheSize = c.CacheSize
+	}
+	if c.MemTableSize != 0 {
+		profile.memTableSize = c.MemTableSize
+	}
+	if c.MemTableStopWritesThreshold != 0 {
+		profile.memTableStopWritesThreshold = c.MemTableStopWritesThreshold
+	}
+	if c.MaxOpenFiles != 0 {
+		profile.maxOpenFiles = c.MaxOpenFiles
+	}
+	return profile
+}
+
+func (p pebbleProfile) options() *pebble.Options {
+	return &pebble.Options{
+		Cache:                       pebble.NewCache(int64(p.cacheSize)),
+		MemTableSize:                p.memTableSize,
+		MemTableStopWritesThreshold: p.memTableStopWritesThreshold,
+		L0CompactionThreshold:       p.l0CompactionThreshold,
+		L0StopWritesThreshold:       p.l0StopWritesThreshold,
 		Levels: []pebble.LevelOptions{
 			{
 				FilterPolicy: bloom.FilterPolicy(10),
 			},
 		},
-		BytesPerSync:    0,
-		WALBytesPerSync: 0,
-		MaxOpenFiles:    100_000,
+		BytesPerSync:    p.bytesPerSync,
+		WALBytesPerSync: p.bytesPerSync,
+		MaxOpenFiles:    p.maxOpenFiles,
+	}
+}
+
+func (p pebbleProfile) writeOptions() *pebble.WriteOptions {
+	if p.sync {
+		return pebble.Sync
 	}
+	return pebble.NoSync
+}
 
-	return opts
+// writeOptions returns the write options for table's profile.
+func (c PebbleConfig) writeOptions(table string) *pebble.WriteOptions {
+	return c.profileFor(table).writeOptions()
+}
+
+// FastUnsafeOptions returns the options of the bulk-load profile.
+func FastUnsafeOptions() *pebble.Options {
+	return pebbleProfiles[ProfileBulkLoad].options()
 }
 
 func KeyUpperBound(b []byte) []byte {
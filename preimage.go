@@ -0,0 +1,531 @@
+package ethdataset
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+type ExportPreimagesConfig struct {
+	WorkDir string `toml:"work_dir"`
+	// ChainConfig, if its data_dir is set, copies the address and slot
+	// preimages geth recorded. Geth only records them when run with
+	// --cache.preimages.
+	ChainConfig ChainConfig `toml:"chain_config"`
+	// PreimagesPath is a file of addresses and slots, one per line in hex: 20
+	// byte values are addresses and 32 byte values slots. Empty lines and
+	// lines starting with # are skipped.
+	PreimagesPath string `toml:"preimages_path"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *ExportPreimagesConfig) Defaults() {
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
+
+func (c *ExportPreimagesConfig) Validate() error {
+	var errs []error
+	errs = append(errs, requireField("work_dir", c.WorkDir))
+	if c.ChainConfig.DataDir == "" && c.PreimagesPath == "" {
+		errs = append(errs, &ConfigError{Field: "preimages_path", Reason: "or chain_config.data_dir is required"})
+	}
+	if c.ChainConfig.DataDir != "" {
+		errs = append(errs, c.ChainConfig.validate("chain_config"))
+	}
+	errs = append(errs, c.PebbleConfig.validate("pebble_config"))
+	return errors.Join(errs...)
+}
+
+// readPreimageList reads the addresses and slots in path, see
+// ExportPreimagesConfig.PreimagesPath.
+func readPreimageList(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var preimages [][]byte
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		b, err := hex.DecodeString(strings.TrimPrefix(text, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %w", path, line, err)
+		}
+		if len(b) != common.AddressLength && len(b) != common.HashLength {
+			return nil, fmt.Errorf("%v:%v: want a 20 byte address or a 32 byte slot, got %v bytes", path, line, len(b))
+		}
+		preimages = append(preimages, b)
+	}
+	return preimages, scanner.Err()
+}
+
+// ExportPreimages writes the preimages table, mapping keccak(address) to
+// address and keccak(slot) to slot, so that the address and slot hashes every
+// other table is keyed by can be mapped back. The preimages come from geth's
+// preimage store, from PreimagesPath or both. Preimages are the same at every
+// state, so the table isn't tied to the pinned state; the work dir must
+// already have a manifest though.
+func ExportPreimages(cfg ExportPreimagesConfig) error {
+	var listed [][]byte
+	if cfg.PreimagesPath != "" {
+		var err error
+		if listed, err = readPreimageList(cfg.PreimagesPath); err != nil {
+			return err
+		}
+	}
+	if err := startTables(cfg.WorkDir, "export-preimages", cfg, "preimages"); err != nil {
+		return err
+	}
+
+	table, err := NewTable(cfg.WorkDir, "preimages", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer table.Close()
+	w := NewBatchWriter(table.DB, cfg.PebbleConfig.writeOptions("preimages"))
+
+	var nAddresses, nSlots uint64
+	add := func(hash common.Hash, preimage []byte) error {
+		if len(preimage) == common.AddressLength {
+			nAddresses += 1
+		} else {
+			nSlots += 1
+		}
+		return w.Set(hash.Bytes(), preimage)
+	}
+
+	start := time.Now()
+	if cfg.ChainConfig.DataDir != "" {
+		_, chainDB, _, err := openChain(cfg.ChainConfig)
+		if err != nil {
+			return err
+		}
+		log.Println("Copying geth preimages")
+		it := chainDB.NewIterator(rawdb.PreimagePrefix, nil)
+		defer it.Release()
+
+		var nSkipped uint64
+		for it.Next() {
+			key, preimage := it.Key(), it.Value()
+			if len(key) != len(rawdb.PreimagePrefix)+common.HashLength {
+				continue
+			}
+			// Preimages of other lengths are of keys of other tries.
+			hash := common.BytesToHash(key[len(rawdb.PreimagePrefix):])
+			if len(preimage) != common.AddressLength && len(preimage) != common.HashLength || crypto.Keccak256Hash(preimage) != hash {
+				nSkipped += 1
+				continue
+			}
+			if err := add(hash, preimage); err != nil {
+				return err
+			}
+			if n := nAddresses + nSlots; n%1_000_000 == 0 {
+				log.Printf("%v %v nAddresses=%v nSlots=%v\n", n, time.Since(start), nAddresses, nSlots)
+			}
+		}
+		if err := it.Error(); err != nil {
+			return err
+		}
+		if nAddresses+nSlots == 0 {
+			log.Println("Geth has no address or slot preimages, was it run with --cache.preimages?")
+		}
+		log.Printf("Copied nAddresses=%v nSlots=%v, skipped nPreimages=%v\n", nAddresses, nSlots, nSkipped)
+	}
+
+	for _, preimage := range listed {
+		if err := add(crypto.Keccak256Hash(preimage), preimage); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// Addresses or slots found in both sources are counted twice.
+	log.Printf("Wrote nAddresses=%v nSlots=%v in %v\n", nAddresses, nSlots, time.Since(start))
+	return completeTable(cfg.WorkDir, "preimages", nAddresses+nSlots)
+}
+
+// Preimages reads the preimages table.
+type Preimages struct {
+	db *pebble.DB
+}
+
+func OpenPreimagesReadOnly(dir string, pc PebbleConfig) (*Preimages, error) {
+	if _, err := requireTables(dir, "preimages"); err != nil {
+		return nil, err
+	}
+	db, err := openPebbleDBReadOnly(dir, "preimages", pc)
+	if err != nil {
+		return nil, err
+	}
+	return &Preimages{db: db}, nil
+}
+
+// Get returns the preimage of hash, or nil if it isn't known.
+func (p *Preimages) Get(hash common.Hash) ([]byte, error) {
+	return pebbleGet(p.db, hash.Bytes())
+}
+
+// Address returns the address hashing to addressHash, if it is known.
+func (p *Preimages) Address(addressHash common.Hash) (common.Address, bool, error) {
+	preimage, err := p.Get(addressHash)
+	if err != nil || len(preimage) != common.AddressLength {
+		return common.Address{}, false, err
+	}
+	return common.BytesToAddress(preimage), true, nil
+}
+
+// Slot returns the slot hashing to slotHash, if it is known.
+func (p *Preimages) Slot(slotHash common.Hash) (common.Hash, bool, error) {
+	preimage, err := p.Get(slotHash)
+	if err != nil || len(preimage) != common.HashLength {
+		return common.Hash{}, false, err
+	}
+	return common.BytesToHash(preimage), true, nil
+}
+
+func (p *Preimages) Close() error {
+	return p.db.Close()
+}
+
+// AccountRecord is what a work dir holds about one account.
+type AccountRecord struct {
+	AddressHash common.Hash
+	// Address is only set if it was looked up by address or its preimage is
+	// known.
+	Address *common.Address
+	// Account is the exported slim account, nil if there is none.
+	Account []byte
+	// Proof is the inclusion, or exclusion, proof of the account, nil if
+	// neither was exported.
+	Proof [][]byte
+	// CodeId and Code are the account's code in the deduplicated code
+	// tables. Code is nil if the account has none or they weren't exported.
+	CodeId uint64
+	Code   []byte
+}
+
+// AccountLookup finds accounts and their proofs in a work dir by address or
+// address hash. Only accounts is required, the proof, code and preimage
+// tables are used if they were exported.
+type AccountLookup struct {
+	StateRoot common.Hash
+
+	accounts *pebble.DB
+	// Any of these are nil if they weren't exported.
+	storage        *pebble.DB
+	accountToProof *pebble.DB
+	absentToProof  *pebble.DB
+	proofDB        *ProofDB
+	codes          *CodeDeduper
+	preimages      *Preimages
+}
+
+func OpenAccountLookup(dir string, pc PebbleConfig) (_ *AccountLookup, err error) {
+	m, err := requireTables(dir, "accounts")
+	if err != nil {
+		return nil, err
+	}
+	l := &AccountLookup{StateRoot: m.StateRoot}
+	defer func() {
+		if err != nil {
+			l.Close()
+		}
+	}()
+
+	complete := func(name string) bool {
+		t := m.Tables[name]
+		return t != nil && t.Status == TableComplete
+	}
+	if l.accounts, err = openPebbleDBReadOnly(dir, "accounts", pc); err != nil {
+		return nil, err
+	}
+	if complete("storage") {
+		if l.storage, err = openPebbleDBReadOnly(dir, "storage", pc); err != nil {
+			return nil, err
+		}
+	}
+	if complete("accountToProof") && complete("idToProofSegment") {
+		if l.accountToProof, err = openPebbleDBReadOnly(dir, "accountToProof", pc); err != nil {
+			return nil, err
+		}
+		if l.proofDB, err = OpenProofDBReadOnly(dir, pc); err != nil {
+			return nil, err
+		}
+		if complete("absentToProof") {
+			if l.absentToProof, err = openPebbleDBReadOnly(dir, "absentToProof", pc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if complete("codeHashToId") && complete("idToCode") {
+		if l.codes, err = OpenCodeDeduperReadOnly(dir, pc); err != nil {
+			return nil, err
+		}
+	}
+	if complete("preimages") {
+		if l.preimages, err = OpenPreimagesReadOnly(dir, pc); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Preimages returns the preimages table, nil if it wasn't exported.
+func (l *AccountLookup) Preimages() *Preimages {
+	return l.preimages
+}
+
+// ByAddress looks up the account of address.
+func (l *AccountLookup) ByAddress(address common.Address) (*AccountRecord, error) {
+	info, err := l.ByHash(crypto.Keccak256Hash(address.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	info.Address = &address
+	return info, nil
+}
+
+// ByHash looks up the account of addressHash.
+func (l *AccountLookup) ByHash(addressHash common.Hash) (*AccountRecord, error) {
+	info := &AccountRecord{AddressHash: addressHash}
+	var err error
+	if info.Account, err = pebbleGet(l.accounts, addressHash.Bytes()); err != nil {
+		return nil, err
+	}
+	if info.Account != nil && l.codes != nil {
+		if err := l.readCode(info); err != nil {
+			return nil, err
+		}
+	}
+	if l.preimages != nil {
+		address, ok, err := l.preimages.Address(addressHash)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			info.Address = &address
+		}
+	}
+
+	for _, db := range []*pebble.DB{l.accountToProof, l.absentToProof} {
+		if db == nil {
+			continue
+		}
+		proofIds, err := pebbleGet(db, addressHash.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if proofIds != nil {
+			info.Proof, err = l.proofDB.RecoverProof(bytesToUint64(proofIds))
+			return info, err
+		}
+	}
+	return info, nil
+}
+
+// readCode sets the code of info's account from the code tables.
+func (l *AccountLookup) readCode(info *AccountRecord) error {
+	var account SlimAccount
+	if err := rlp.DecodeBytes(info.Account, &account); err != nil {
+		return corruptRecord("accounts", info.AddressHash.Bytes(), err)
+	}
+	if len(account.CodeHash) == 0 || bytes.Equal(account.CodeHash, types.EmptyCodeHash.Bytes()) {
+		return nil
+	}
+	id, ok, err := l.codes.GetId(account.CodeHash)
+	if err != nil || !ok {
+		return err
+	}
+	info.CodeId = id
+	info.Code, err = l.codes.GetCode(id)
+	return err
+}
+
+// Slot returns the exported value of slot of the account of addressHash, nil
+// if the slot is empty.
+func (l *AccountLookup) Slot(addressHash, slot common.Hash) ([]byte, error) {
+	if l.storage == nil {
+		return nil, errors.New("storage was not exported")
+	}
+	key := append(addressHash.Bytes(), crypto.Keccak256(slot.Bytes())...)
+	return pebbleGet(l.storage, key)
+}
+
+func (l *AccountLookup) Close() error {
+	var errs []error
+	for _, db := range []*pebble.DB{l.accounts, l.storage, l.accountToProof, l.absentToProof} {
+		if db != nil {
+			errs = append(errs, db.Close())
+		}
+	}
+	if l.proofDB != nil {
+		errs = append(errs, l.proofDB.Close())
+	}
+	if l.codes != nil {
+		errs = append(errs, l.codes.Close())
+	}
+	if l.preimages != nil {
+		errs = append(errs, l.preimages.Close())
+	}
+	return errors.Join(errs...)
+}
+
+type LookupAccountConfig struct {
+	WorkDir string `toml:"work_dir"`
+	// Account is a hex address or address hash.
+	Account string `toml:"account"`
+	// Slots is a comma separated list of hex slots, not slot hashes, to read
+	// from the storage table.
+	Slots string `toml:"slots"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *LookupAccountConfig) Defaults() {
+	c.PebbleConfig.defaults(ProfileReadMostly)
+}
+
+func (c *LookupAccountConfig) slots() []string {
+	if c.Slots == "" {
+		return nil
+	}
+	return strings.Split(c.Slots, ",")
+}
+
+func (c *LookupAccountConfig) Validate() error {
+	var errs []error
+	errs = append(errs, requireField("work_dir", c.WorkDir), requireField("account", c.Account))
+	if c.Account != "" {
+		if _, err := parseAccountKey(c.Account); err != nil {
+			errs = append(errs, &ConfigError{Field: "account", Reason: err.Error()})
+		}
+	}
+	for _, slot := range c.slots() {
+		errs = append(errs, validateHash("slots", slot))
+	}
+	errs = append(errs, c.PebbleConfig.validate("pebble_config"))
+	return errors.Join(errs...)
+}
+
+// LookupAccount prints the exported account, code, proof and slots of an address
+// or address hash, checking the proof against the pinned state root.
+func LookupAccount(cfg LookupAccountConfig) error {
+	l, err := OpenAccountLookup(cfg.WorkDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	var info *AccountRecord
+	if b, _ := hex.DecodeString(strings.TrimPrefix(cfg.Account, "0x")); len(b) == common.AddressLength {
+		info, err = l.ByAddress(common.BytesToAddress(b))
+	} else {
+		info, err = l.ByHash(common.HexToHash(cfg.Account))
+	}
+	if err != nil {
+		return err
+	}
+
+	address := "unknown"
+	if info.Address != nil {
+		address = info.Address.Hex()
+	}
+	fmt.Printf("Address=%v AddressHash=%v\n", address, info.AddressHash)
+	if info.Account == nil {
+		fmt.Println("Account: none")
+	} else {
+		fmt.Printf("Account: %x\n", info.Account)
+	}
+	if info.Code != nil {
+		fmt.Printf("Code: id=%v size=%v\n", info.CodeId, len(info.Code))
+	}
+
+	if info.Proof == nil {
+		fmt.Println("Proof: not exported")
+	} else {
+		walk, err := CrossCheckProof(l.StateRoot, info.AddressHash.Bytes(), info.Proof)
+		if err != nil {
+			return fmt.Errorf("%w: proof of %v: %v", ErrVerificationFailed, info.AddressHash, err)
+		}
+		if walk.Included() {
+			fmt.Printf("Proof: %v nodes, proves the account is included at StateRoot=%v\n", len(info.Proof), l.StateRoot)
+		} else {
+			fmt.Printf("Proof: %v nodes, proves the account is absent (%v) at StateRoot=%v\n", len(info.Proof), walk.Absent, l.StateRoot)
+		}
+	}
+
+	for _, s := range cfg.slots() {
+		slot := common.HexToHash(s)
+		value, err := l.Slot(info.AddressHash, slot)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Slot %v: %x\n", slot, value)
+	}
+	return nil
+}
+
+type LookupPreimageConfig struct {
+	WorkDir string `toml:"work_dir"`
+	// Hash is an address or slot hash.
+	Hash string `toml:"hash"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *LookupPreimageConfig) Defaults() {
+	c.PebbleConfig.defaults(ProfileReadMostly)
+}
+
+func (c *LookupPreimageConfig) Validate() error {
+	return errors.Join(
+		requireField("work_dir", c.WorkDir),
+		requireField("hash", c.Hash),
+		validateHash("hash", c.Hash),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+}
+
+// LookupPreimage prints the address or slot hashing to a hash.
+func LookupPreimage(cfg LookupPreimageConfig) error {
+	p, err := OpenPreimagesReadOnly(cfg.WorkDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	hash := common.HexToHash(cfg.Hash)
+	preimage, err := p.Get(hash)
+	switch {
+	case err != nil:
+		return err
+	case preimage == nil:
+		return fmt.Errorf("preimage of %v: %w", hash, ErrNotFound)
+	case len(preimage) == common.AddressLength:
+		fmt.Printf("%v: address %v\n", hash, common.BytesToAddress(preimage))
+	default:
+		fmt.Printf("%v: slot %v\n", hash, common.BytesToHash(preimage))
+	}
+	return nil
+}
@@ -2,24 +2,78 @@ package ethdataset
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 const TOP_THRESHOLD int = 4
 
+const (
+	// ProofIndexSegment keys the segment to id index, proofSegmentToId, by
+	// the raw RLP node bytes.
+	ProofIndexSegment = "segment"
+	// ProofIndexHash keys the segment to id index, proofHashToId, by the
+	// keccak hash of the node, like the trie itself does.
+	ProofIndexHash = "hash"
+)
+
+func validateProofIndex(field, index string) error {
+	if index != ProofIndexSegment && index != ProofIndexHash {
+		return &ConfigError{Field: field, Reason: fmt.Sprintf("unknown proof index %q, want %q or %q", index, ProofIndexSegment, ProofIndexHash)}
+	}
+	return nil
+}
+
+// proofTableNames returns the names of the index and idToProofSegment tables
+// of a ProofDB.
+func proofTableNames(scope, index string) (indexName, idToSegmentName string) {
+	prefix := ""
+	if scope != "" {
+		prefix = scope + "-"
+	}
+	indexName = prefix + "proofSegmentToId"
+	if index == ProofIndexHash {
+		indexName = prefix + "proofHashToId"
+	}
+	return indexName, prefix + "idToProofSegment"
+}
+
+// detectProofIndex returns the index of the ProofDB in path, going by which
+// index table the manifest lists.
+func detectProofIndex(path, scope string) (string, error) {
+	m, err := ReadManifest(path)
+	if err != nil {
+		return "", err
+	}
+	hashName, _ := proofTableNames(scope, ProofIndexHash)
+	segmentName, _ := proofTableNames(scope, ProofIndexSegment)
+	if m != nil && m.Tables[hashName] != nil && m.Tables[segmentName] == nil {
+		return ProofIndexHash, nil
+	}
+	return ProofIndexSegment, nil
+}
+
 type ProofDB struct {
 	// nextId uint64
 	nextId atomic.Uint64
 
-	path             string
+	path  string
+	index string
+	// scope is the ProofScope of NewProofContainer.
+	scope string
+	// proofSegmentToId is the index named by index, i.e. it may be keyed by
+	// node hash rather than node bytes.
 	proofSegmentToId *pebble.DB
 	idToProofSegment *pebble.DB
+	segmentToIdWo    *pebble.WriteOptions
+	idToSegmentWo    *pebble.WriteOptions
 
 	//topCache map[string]uint64
 	disableTopCache bool
@@ -29,34 +83,107 @@ type ProofDB struct {
 	total   atomic.Uint64
 	unique  atomic.Uint64
 	deduped atomic.Uint64
+
+	// The batches are set by UseBatchedWrites. pending holds the ids written
+	// to them but not yet committed so that lookups still find them.
+	batchMu          sync.Mutex
+	segmentToIdBatch *pebble.Batch
+	idToSegmentBatch *pebble.Batch
+	pending          sync.Map
+
+	// The shards are set by UseShards, which replaces the key locker, top
+	// cache and batches above.
+	shards         []*proofShard
+	idBlock        uint64
+	shardBatchSize int
+
+	// scopeStats maps scope to *ProofScopeStats.
+	scopeStats sync.Map
 }
 
 // TODO: rename
-func NewProofDeduper(path string) ProofDB {
-	return ProofDB{
+func NewProofDeduper(path, index string, pc PebbleConfig) (*ProofDB, error) {
+	return NewScopedProofDB(path, "", index, pc)
+}
+
+func NewScopedProofDB(path, scope, index string, pc PebbleConfig) (*ProofDB, error) {
+	return openProofDB(path, scope, index, scope != "", pc, openPebbleDB)
+}
+
+// checkProofIndex fails if dir already holds a ProofDB with a different
+// index. The new index wouldn't know the ids the old one handed out.
+func checkProofIndex(dir, scope, index string) error {
+	m, err := ReadManifest(dir)
+	if err != nil || m == nil {
+		return err
+	}
+	for _, other := range []string{ProofIndexSegment, ProofIndexHash} {
+		otherName, _ := proofTableNames(scope, other)
+		if other != index && m.Tables[otherName] != nil {
+			return fmt.Errorf("%v already holds a %q proof index in %v, migrate it or keep proof_index = %q", dir, other, otherName, other)
+		}
+	}
+	return nil
+}
+
+// OpenProofDBReadOnly opens the account ProofDB in path for reading proofs
+// back, e.g. to verify them.
+func OpenProofDBReadOnly(path string, pc PebbleConfig) (*ProofDB, error) {
+	return OpenScopedProofDBReadOnly(path, "", pc)
+}
+
+// OpenScopedProofDBReadOnly is OpenProofDBReadOnly for a scoped ProofDB.
+func OpenScopedProofDBReadOnly(path, scope string, pc PebbleConfig) (*ProofDB, error) {
+	index, err := detectProofIndex(path, scope)
+	if err != nil {
+		return nil, err
+	}
+	return openProofDB(path, scope, index, scope != "", pc, openPebbleDBReadOnly)
+}
+
+func openProofDB(path, scope, index string, disableTopCache bool, pc PebbleConfig, open func(path, name string, pc PebbleConfig) (*pebble.DB, error)) (*ProofDB, error) {
+	segmentToIdName, idToSegmentName := proofTableNames(scope, index)
+	proofSegmentToId, err := open(path, segmentToIdName, pc)
+	if err != nil {
+		return nil, err
+	}
+	idToProofSegment, err := open(path, idToSegmentName, pc)
+	if err != nil {
+		proofSegmentToId.Close()
+		return nil, err
+	}
+	statsScope := ProofScopeAccount
+	if scope != "" {
+		statsScope = scope
+	}
+	return &ProofDB{
 		path:             path,
-		proofSegmentToId: openPebbleDB(path, "proofSegmentToId"),
-		idToProofSegment: openPebbleDB(path, "idToProofSegment"),
+		index:            index,
+		scope:            statsScope,
+		proofSegmentToId: proofSegmentToId,
+		idToProofSegment: idToProofSegment,
+		segmentToIdWo:    pc.writeOptions(segmentToIdName),
+		idToSegmentWo:    pc.writeOptions(idToSegmentName),
+		disableTopCache:  disableTopCache,
 		//topCache:         make(map[string]uint64),
 		topCache:  sync.Map{},
 		keyLocker: NewKeyLocker(256),
-	}
+	}, nil
 }
 
-func NewScopedProofDB(path, scope string) ProofDB {
-	return ProofDB{
-		path:             path,
-		proofSegmentToId: openPebbleDB(path, fmt.Sprintf("%s-proofSegmentToId", scope)),
-		idToProofSegment: openPebbleDB(path, fmt.Sprintf("%s-idToProofSegment", scope)),
-		disableTopCache:  true,
-		topCache:         sync.Map{},
-		keyLocker:        NewKeyLocker(256),
-	}
+// NewProofContainer deduplicates proofs of the ProofDB's own scope, account
+// proofs unless it was opened with a scope.
+func (pd *ProofDB) NewProofContainer() ProofContainer {
+	return pd.NewScopedProofContainer(pd.scope)
 }
 
-func (pd *ProofDB) NewProofContainer() ProofContainer {
+// NewScopedProofContainer deduplicates proofs of scope, e.g.
+// ProofScopeStorage, which are counted separately in ScopeStats.
+func (pd *ProofDB) NewScopedProofContainer(scope string) ProofContainer {
 	return ProofContainer{
-		pd: pd,
+		pd:    pd,
+		scope: scope,
+		stats: pd.ScopeStats(scope),
 	}
 }
 
@@ -72,37 +199,99 @@ func (pd *ProofDB) Deduped() uint64 {
 	return pd.deduped.Load()
 }
 
-func (pd *ProofDB) GetId(b []byte) (uint64, bool) {
-	value, closer, err := pd.proofSegmentToId.Get(b)
-	if err == pebble.ErrNotFound {
-		return 0, false
+// NextId returns the last id handed out by the ProofDB.
+func (pd *ProofDB) NextId() uint64 {
+	return pd.nextId.Load()
+}
+
+// ResumeIds restores id assignment after a restart. Writes that landed after
+// the checkpoint may have persisted ids beyond checkpointed, so we probe
+// idToProofSegment forward and skip past anything already in use.
+func (pd *ProofDB) ResumeIds(checkpointed uint64) error {
+	// Shards leave gaps of up to a block each between the ids they persist.
+	slack := max(uint64(1024), pd.idBlock*uint64(len(pd.shards)))
+
+	last := checkpointed
+	for id, misses := checkpointed+1, uint64(0); misses < slack; id++ {
+		_, closer, err := pd.idToProofSegment.Get(uint64ToKey(id))
+		if err == pebble.ErrNotFound {
+			misses += 1
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		closer.Close()
+		last = id
+		misses = 0
 	}
-	if err != nil {
-		log.Fatal(err)
+
+	if last != checkpointed {
+		last += slack
 	}
-	id := binary.LittleEndian.Uint64(value)
-	if err := closer.Close(); err != nil {
-		log.Fatal(err)
+	pd.nextId.Store(last)
+	return nil
+}
+
+// indexKey returns the key of segment ps in the segment to id index.
+func (pd *ProofDB) indexKey(ps []byte) []byte {
+	if pd.index == ProofIndexHash {
+		return crypto.Keccak256(ps)
 	}
-	return id, true
+	return ps
+}
+
+// GetId returns the id of proof segment b, if it has one.
+func (pd *ProofDB) GetId(b []byte) (uint64, bool, error) {
+	return pd.getIdByKey(pd.indexKey(b))
+}
 
+func (pd *ProofDB) getIdByKey(b []byte) (uint64, bool, error) {
+	if pd.shards != nil {
+		s := pd.shard(b)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return pd.shardLookup(s, b)
+	}
+	if len(b) != 0 {
+		if id, ok := pd.pending.Load(unsafe.String(&b[0], len(b))); ok {
+			return id.(uint64), true, nil
+		}
+	}
+	value, err := pebbleGet(pd.proofSegmentToId, b)
+	if err != nil {
+		return 0, false, err
+	}
+	if value == nil {
+		return 0, false, nil
+	}
+	if len(value) != 8 {
+		return 0, false, corruptRecord("proofSegmentToId", b, fmt.Errorf("id length %v, want 8", len(value)))
+	}
+	return binary.LittleEndian.Uint64(value), true, nil
 }
 
-func (pd *ProofDB) getOrCreateId(i int, ps []byte) uint64 {
+// getOrCreateId returns the id of segment ps, which is at depth i of its
+// proof, and whether it was just created. The top cache is only consulted
+// with useTop set.
+func (pd *ProofDB) getOrCreateId(i int, ps []byte, useTop bool) (uint64, bool, error) {
+	if len(ps) == 0 {
+		return 0, false, ErrEmptyProofSegment
+	}
 	pd.total.Add(1)
+	if pd.shards != nil {
+		return pd.shardedGetOrCreateId(ps)
+	}
 
 	var isInTop bool
-	if !pd.disableTopCache {
+	if !pd.disableTopCache && useTop {
 		isInTop = i <= TOP_THRESHOLD
 		if isInTop {
-			if len(ps) == 0 {
-				panic("Expected non empty proof segment")
-			}
 			key := unsafe.String(&ps[0], len(ps))
 			// if id, ok := pd.topCache[key]; ok {
 			if id, ok := pd.topCache.Load(key); ok {
 				pd.deduped.Add(1)
-				return id.(uint64)
+				return id.(uint64), false, nil
 			}
 		}
 	}
@@ -110,70 +299,230 @@ func (pd *ProofDB) getOrCreateId(i int, ps []byte) uint64 {
 	pd.keyLocker.Lock(ps)
 	defer pd.keyLocker.Unlock(ps)
 
-	if id, ok := pd.GetId(ps); ok {
+	key := pd.indexKey(ps)
+	id, ok, err := pd.getIdByKey(key)
+	if err != nil {
+		return 0, false, err
+	}
+	if ok {
 		pd.deduped.Add(1)
-		return id
+		return id, false, nil
 	}
 
 	pd.unique.Add(1)
 
-	id := pd.nextId.Add(1)
+	id = pd.nextId.Add(1)
 
-	idBytes := uint64ToKey(id)
-	if err := pd.proofSegmentToId.Set(ps, idBytes, pebble.NoSync); err != nil {
-		log.Fatal(err)
-	}
-	if err := pd.idToProofSegment.Set(idBytes, ps, pebble.NoSync); err != nil {
-		log.Fatal(err)
+	if err := pd.put(ps, key, id); err != nil {
+		return 0, false, err
 	}
 
-	if !pd.disableTopCache && isInTop {
+	if isInTop {
 		//pd.topCache[string(ps)] = id
 		pd.topCache.Store(string(ps), id)
 	}
 
-	return id
+	return id, true, nil
+}
+
+// put stores segment ps, whose index key is key, under id.
+func (pd *ProofDB) put(ps, key []byte, id uint64) error {
+	idBytes := uint64ToKey(id)
+	if pd.segmentToIdBatch == nil {
+		// Like commit, write the id before the segment pointing at it.
+		if err := pd.idToProofSegment.Set(idBytes, ps, pd.idToSegmentWo); err != nil {
+			return err
+		}
+		return pd.proofSegmentToId.Set(key, idBytes, pd.segmentToIdWo)
+	}
+
+	pd.batchMu.Lock()
+	defer pd.batchMu.Unlock()
+	if err := pd.segmentToIdBatch.Set(key, idBytes, nil); err != nil {
+		return err
+	}
+	if err := pd.idToSegmentBatch.Set(idBytes, ps, nil); err != nil {
+		return err
+	}
+	pd.pending.Store(string(key), id)
+	if pd.segmentToIdBatch.Len()+pd.idToSegmentBatch.Len() >= batchWriteSize {
+		return pd.commit()
+	}
+	return nil
+}
+
+// UseBatchedWrites buffers new ids in batches instead of writing each one to
+// Pebble as it's assigned. Flush or Close commits them.
+func (pd *ProofDB) UseBatchedWrites() {
+	if pd.shards != nil {
+		// Shards already batch their writes.
+		return
+	}
+	pd.segmentToIdBatch = pd.proofSegmentToId.NewBatch()
+	pd.idToSegmentBatch = pd.idToProofSegment.NewBatch()
 }
 
-func (pd *ProofDB) Close() {
-	pd.proofSegmentToId.Close()
-	pd.idToProofSegment.Close()
+// commit writes out the batches. batchMu must be held.
+func (pd *ProofDB) commit() error {
+	if pd.segmentToIdBatch == nil || pd.segmentToIdBatch.Empty() {
+		return nil
+	}
+	// Commit ids before the segments pointing at them so that a segment is
+	// never found with a dangling id.
+	if err := pd.idToSegmentBatch.Commit(pd.idToSegmentWo); err != nil {
+		return err
+	}
+	if err := pd.segmentToIdBatch.Commit(pd.segmentToIdWo); err != nil {
+		return err
+	}
+	if err := errors.Join(pd.idToSegmentBatch.Close(), pd.segmentToIdBatch.Close()); err != nil {
+		return err
+	}
+	pd.segmentToIdBatch = pd.proofSegmentToId.NewBatch()
+	pd.idToSegmentBatch = pd.idToProofSegment.NewBatch()
+	pd.pending.Clear()
+	return nil
 }
 
-func (pd *ProofDB) RecoverProof(ids []uint64) [][]byte {
+// Flush commits any batched writes and flushes both tables to disk.
+func (pd *ProofDB) Flush() error {
+	pd.batchMu.Lock()
+	err := errors.Join(pd.commit(), pd.commitShards(false))
+	pd.batchMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return errors.Join(pd.proofSegmentToId.Flush(), pd.idToProofSegment.Flush())
+}
+
+func (pd *ProofDB) Close() error {
+	pd.batchMu.Lock()
+	err := pd.commit()
+	if pd.segmentToIdBatch != nil {
+		err = errors.Join(err, pd.segmentToIdBatch.Close(), pd.idToSegmentBatch.Close())
+	}
+	err = errors.Join(err, pd.commitShards(true))
+	pd.batchMu.Unlock()
+	return errors.Join(err, pd.proofSegmentToId.Close(), pd.idToProofSegment.Close())
+}
+
+// RecoverProof returns the proof segments for ids, or an error wrapping
+// ErrNotFound if any id is unknown.
+func (pd *ProofDB) RecoverProof(ids []uint64) ([][]byte, error) {
 	var proof [][]byte
 
 	for _, id := range ids {
-		b, c, err := pd.idToProofSegment.Get(uint64ToKey(id))
+		key := uint64ToKey(id)
+		b, err := pebbleGet(pd.idToProofSegment, key)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
+		}
+		if b == nil {
+			return nil, notFound("idToProofSegment", key)
 		}
 
-		dst := make([]byte, len(b))
-		copy(dst, b)
+		proof = append(proof, b)
+	}
+
+	return proof, nil
+}
 
-		if err := c.Close(); err != nil {
-			log.Fatal(err)
+// appendProofTables returns the tables a command adding proofs to the
+// ProofDB of scope in dir has to start: table, plus the ProofDB itself if it
+// does not exist yet. An existing ProofDB stays marked complete while proofs
+// are appended, as the tables already referring to it remain valid.
+func appendProofTables(dir, table, scope, index string) ([]string, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	indexName, idToSegmentName := proofTableNames(scope, index)
+	if m != nil && m.Tables[idToSegmentName] != nil {
+		return []string{table}, nil
+	}
+	return []string{table, indexName, idToSegmentName}, nil
+}
+
+// completeAppendedProofs marks table complete with nRecords and records the
+// ids pd handed out on its ProofDB, which is marked complete too if this run
+// created it, in the same manifest write. Until then an existing ProofDB
+// keeps its old last id, so a crashed run only leaves segments past it, which
+// ResumeIds skips on the rerun and gc-proofs removes.
+func completeAppendedProofs(dir, table string, nRecords uint64, scope string, pd *ProofDB) error {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	indexName, idToSegmentName := proofTableNames(scope, pd.index)
+	now := time.Now().UTC()
+	for _, name := range []string{table, indexName, idToSegmentName} {
+		if m == nil || m.Tables[name] == nil {
+			return fmt.Errorf("%v: table %v was never started", dir, name)
+		}
+		t := m.Tables[name]
+		if name == table {
+			t.NRecords = nRecords
+		} else {
+			// The appended segments weren't counted.
+			t.NRecords = 0
+			t.LastId = pd.NextId()
 		}
+		t.Status = TableComplete
+		t.UpdatedAt = now
+	}
+	return WriteManifest(dir, m)
+}
 
-		proof = append(proof, dst)
+// proofDBLastId returns the last id of the ProofDB whose segments are in
+// idToSegmentName in dir, which must be complete, or 0 if there is none yet.
+func proofDBLastId(dir, idToSegmentName string) (uint64, error) {
+	m, err := ReadManifest(dir)
+	if err != nil || m == nil || m.Tables[idToSegmentName] == nil {
+		return 0, err
+	}
+	if _, err := requireTables(dir, idToSegmentName); err != nil {
+		return 0, err
 	}
+	return m.Tables[idToSegmentName].lastId(), nil
+}
 
-	return proof
+// resumeProofDB makes pd hand out ids past every segment already in its
+// tables in dir: past checkpointed, the last id of the walk checkpoint if
+// any, and past the last id of a complete ProofDB, e.g. one kept by Repin.
+// A ProofDB a crashed run was creating is probed from checkpointed.
+func resumeProofDB(dir, scope string, pd *ProofDB, checkpointed uint64) error {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	_, idToSegmentName := proofTableNames(scope, pd.index)
+	if m != nil && m.Tables[idToSegmentName] != nil && m.Tables[idToSegmentName].Status == TableComplete {
+		checkpointed = max(checkpointed, m.Tables[idToSegmentName].lastId())
+	}
+	return pd.ResumeIds(checkpointed)
 }
 
 type ProofContainer struct {
-	pd  *ProofDB
-	ids []uint64
+	pd    *ProofDB
+	scope string
+	stats *ProofScopeStats
+	ids   []uint64
 }
 
 func (pc *ProofContainer) AsIds() []uint64 {
 	return pc.ids
 }
 
-func (pc *ProofContainer) DedupAll(ps [][]byte) {
+func (pc *ProofContainer) DedupAll(ps [][]byte) error {
 	for i, b := range ps {
-		id := pc.pd.getOrCreateId(i, b)
+		// The top of a storage trie is only shared with its clones, so
+		// storage segments stay out of the top cache.
+		id, created, err := pc.pd.getOrCreateId(i, b, pc.scope == ProofScopeAccount)
+		if err != nil {
+			return err
+		}
+		pc.stats.add(i, created)
 		pc.ids = append(pc.ids, id)
 	}
+	return nil
 }
@@ -0,0 +1,97 @@
+package ethdataset
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// benchProofDepth is the depth of the synthetic proofs, about that of an
+// account proof on mainnet.
+const benchProofDepth = 8
+
+// benchProof fills proof with the segments of synthetic proof p. They mimic a
+// hexary trie: the segment at depth d is shared by every proof that agrees on
+// the top 4*d bits of p, so the top of the trie dedups heavily and the leaves
+// not at all. Branch nodes are 532 bytes and leaves 110, like the real ones.
+func benchProof(p uint64, proof [][]byte) {
+	for d := range proof {
+		size := 532
+		if d == len(proof)-1 {
+			size = 110
+		}
+		if cap(proof[d]) < size {
+			proof[d] = make([]byte, size)
+		}
+		proof[d] = proof[d][:size]
+		node := p >> (4 * (len(proof) - 1 - d))
+		binary.LittleEndian.PutUint64(proof[d], node)
+		proof[d][8] = byte(d)
+		for i := 9; i < size; i++ {
+			proof[d][i] = byte(node*31+uint64(i)) ^ byte(d)
+		}
+	}
+}
+
+func benchDedup(pd *ProofDB, nProofs, nWorkers int) error {
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, nWorkers)
+	)
+	for w := 0; w < nWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			proof := make([][]byte, benchProofDepth)
+			// Workers take interleaved proofs so that they contend for the
+			// same top segments like the walk's workers do.
+			for p := w; p < nProofs; p += nWorkers {
+				benchProof(uint64(p), proof)
+				pc := pd.NewProofContainer()
+				if err := pc.DedupAll(proof); err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// BenchmarkProofDedup deduplicates b.N synthetic account proofs from 16
+// goroutines with the striped lock ProofDB and the sharded one, each into a
+// fresh ProofDB in a temp dir.
+func BenchmarkProofDedup(b *testing.B) {
+	var sharded ProofDedupConfig
+	sharded.defaults()
+	sharded.Shards = 64
+
+	for _, c := range []struct {
+		name  string
+		dedup ProofDedupConfig
+	}{
+		{"locked", ProofDedupConfig{}},
+		{"sharded", sharded},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			pd, err := NewProofDeduper(b.TempDir(), ProofIndexSegment, testPebbleConfig())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer pd.Close()
+			pd.UseShards(c.dedup)
+
+			b.ResetTimer()
+			if err := benchDedup(pd, b.N, 16); err != nil {
+				b.Fatal(err)
+			}
+			if err := pd.Flush(); err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(b.N*benchProofDepth)/b.Elapsed().Seconds(), "segments/s")
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package ethdataset
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+type GCProofsConfig struct {
+	WorkDir string `toml:"work_dir"`
+	// Scope selects the ProofDB to collect, as for proofs renumber.
+	Scope string `toml:"scope"`
+	// DryRun only counts what would be removed.
+	DryRun bool `toml:"dry_run"`
+	// Compact compacts both tables afterwards so that the space of the
+	// removed segments is actually given back to the file system.
+	Compact bool `toml:"compact"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *GCProofsConfig) Defaults() {
+	c.Compact = true
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
+
+func (c *GCProofsConfig) Validate() error {
+	var errs []error
+	errs = append(errs, requireField("work_dir", c.WorkDir))
+	if _, err := proofRefTable(c.Scope); err != nil {
+		errs = append(errs, &ConfigError{Field: "scope", Reason: err.Error()})
+	}
+	errs = append(errs, c.PebbleConfig.validate("pebble_config"))
+	return errors.Join(errs...)
+}
+
+// proofIdSet is a bitmap of proof ids.
+type proofIdSet []uint64
+
+func newProofIdSet(lastId uint64) proofIdSet {
+	return make(proofIdSet, lastId/64+1)
+}
+
+func (s proofIdSet) add(id uint64) {
+	s[id/64] |= 1 << (id % 64)
+}
+
+func (s proofIdSet) has(id uint64) bool {
+	return id/64 < uint64(len(s)) && s[id/64]&(1<<(id%64)) != 0
+}
+
+// gcSweep counts what sweeping one table removed.
+type gcSweep struct {
+	nRecords uint64
+	nRemoved uint64
+	// removedBytes is the size of the removed keys and values.
+	removedBytes uint64
+	diskBefore   uint64
+	diskAfter    uint64
+}
+
+// GCProofs removes the segments no proof refers to any more from a ProofDB by
+// mark and sweep: every id in the proof id tables is marked, then every
+// segment in idToProofSegment and every entry of its index with an unmarked
+// id is deleted. The reclaimed bytes are logged per table.
+//
+// After Repin and a re-export the proof id tables only refer to the new
+// state, so the segments collected are the nodes only the old state had.
+// Segments interrupted exports wrote but never referred to go too.
+//
+// The mark bitmap takes 1 bit per id in memory.
+func GCProofs(cfg GCProofsConfig) error {
+	m, err := ReadManifest(cfg.WorkDir)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("%v has no manifest", cfg.WorkDir)
+	}
+	refNames, err := proofRefTables(m, cfg.Scope)
+	if err != nil {
+		return err
+	}
+	index, err := detectProofIndex(cfg.WorkDir, cfg.Scope)
+	if err != nil {
+		return err
+	}
+	indexName, idToSegmentName := proofTableNames(cfg.Scope, index)
+	if m, err = requireTables(cfg.WorkDir, append([]string{indexName, idToSegmentName}, refNames...)...); err != nil {
+		return err
+	}
+	lastId := m.Tables[idToSegmentName].lastId()
+
+	start := time.Now()
+	marked := newProofIdSet(lastId)
+	var nMarked uint64
+	for _, refName := range refNames {
+		log.Printf("Marking proof ids in %v\n", refName)
+		n, err := markProofIds(cfg.WorkDir, refName, lastId, marked, cfg.PebbleConfig)
+		if err != nil {
+			return err
+		}
+		nMarked += n
+	}
+	log.Printf("Marked nIds=%v of lastId=%v in %v\n", nMarked, lastId, time.Since(start))
+
+	if !cfg.DryRun {
+		if err := startTables(cfg.WorkDir, "gc-proofs", cfg, indexName, idToSegmentName); err != nil {
+			return err
+		}
+	}
+
+	// Records that aren't a valid id get id 0, which is never marked.
+	sweeps := []struct {
+		name string
+		// id returns the id of a record.
+		id func(key, value []byte) uint64
+	}{
+		{idToSegmentName, func(key, _ []byte) uint64 { return idOf(key) }},
+		{indexName, func(_, value []byte) uint64 { return idOf(value) }},
+	}
+	var total gcSweep
+	nKept := make(map[string]uint64)
+	for _, s := range sweeps {
+		log.Printf("Sweeping %v\n", s.name)
+		r, err := sweepProofTable(cfg, s.name, marked, s.id)
+		if err != nil {
+			return err
+		}
+		log.Printf("%v: removed %v of %v records, %v bytes of keys and values, disk usage %v -> %v\n",
+			s.name, r.nRemoved, r.nRecords, r.removedBytes, r.diskBefore, r.diskAfter)
+		nKept[s.name] = r.nRecords - r.nRemoved
+		total.nRemoved += r.nRemoved
+		total.removedBytes += r.removedBytes
+		total.diskBefore += r.diskBefore
+		total.diskAfter += r.diskAfter
+	}
+
+	reclaimed := int64(total.diskBefore) - int64(total.diskAfter)
+	if cfg.DryRun {
+		log.Printf("Dry run: would remove %v records, %v bytes of keys and values\n", total.nRemoved, total.removedBytes)
+		return nil
+	}
+	log.Printf("Removed %v records, %v bytes of keys and values, reclaimed %v bytes on disk in %v\n",
+		total.nRemoved, total.removedBytes, reclaimed, time.Since(start))
+
+	// Ids aren't reused, so the last id stays the same.
+	for _, name := range []string{indexName, idToSegmentName} {
+		if err := completeProofDBTable(cfg.WorkDir, name, nKept[name], lastId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func idOf(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// markProofIds marks every id in refName and returns how many were not
+// marked yet.
+func markProofIds(dir, refName string, lastId uint64, marked proofIdSet, pc PebbleConfig) (uint64, error) {
+	db, err := openPebbleDBReadOnly(dir, refName, pc)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	iter, err := db.NewIter(nil)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	var n uint64
+	for iter.First(); iter.Valid(); iter.Next() {
+		value := iter.Value()
+		if len(value)%8 != 0 {
+			return 0, corruptRecord(refName, iter.Key(), fmt.Errorf("length %v is not a multiple of 8", len(value)))
+		}
+		for i := 0; i < len(value); i += 8 {
+			id := binary.LittleEndian.Uint64(value[i:])
+			if id == 0 || id > lastId {
+				return 0, corruptRecord(refName, iter.Key(), fmt.Errorf("proof id %v out of range [1, %v]", id, lastId))
+			}
+			if !marked.has(id) {
+				marked.add(id)
+				n += 1
+			}
+		}
+	}
+	return n, iter.Error()
+}
+
+// sweepProofTable deletes every record of table name whose id isn't marked.
+// Disk usage is measured with the table closed, once Pebble has deleted the
+// files compactions made obsolete.
+func sweepProofTable(cfg GCProofsConfig, name string, marked proofIdSet, id func(key, value []byte) uint64) (gcSweep, error) {
+	var r gcSweep
+	path := filepath.Join(cfg.WorkDir, name)
+	var err error
+	if r.diskBefore, err = dirSize(path); err != nil {
+		return r, err
+	}
+
+	open := openPebbleDB
+	if cfg.DryRun {
+		open = openPebbleDBReadOnly
+	}
+	db, err := open(cfg.WorkDir, name, cfg.PebbleConfig)
+	if err != nil {
+		return r, err
+	}
+	err = sweepProofDB(cfg, db, name, marked, id, &r)
+	if err := errors.Join(err, db.Close()); err != nil {
+		return r, err
+	}
+
+	r.diskAfter, err = dirSize(path)
+	return r, err
+}
+
+func sweepProofDB(cfg GCProofsConfig, db *pebble.DB, name string, marked proofIdSet, id func(key, value []byte) uint64, r *gcSweep) error {
+	iter, err := db.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	var (
+		w           *BatchWriter
+		first, last []byte
+	)
+	if !cfg.DryRun {
+		w = NewBatchWriter(db, cfg.PebbleConfig.writeOptions(name))
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		r.nRecords += 1
+		if first == nil {
+			first = append([]byte(nil), iter.Key()...)
+		}
+		last = append(last[:0], iter.Key()...)
+		if marked.has(id(iter.Key(), iter.Value())) {
+			continue
+		}
+		r.nRemoved += 1
+		r.removedBytes += uint64(len(iter.Key()) + len(iter.Value()))
+		if !cfg.DryRun {
+			if err := w.Delete(iter.Key()); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+	}
+	if err := errors.Join(iter.Error(), iter.Close()); err != nil {
+		return err
+	}
+	if cfg.DryRun {
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := db.Flush(); err != nil {
+		return err
+	}
+	if cfg.Compact && first != nil {
+		return db.Compact(first, append(last, 0), true)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package ethdataset
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// testAccounts returns n address hashes with values too long to be embedded,
+// and a copy with every tenth value changed.
+func testAccounts(n int) (old, changed map[string]string) {
+	old = make(map[string]string)
+	changed = make(map[string]string)
+	for i := 0; i < n; i++ {
+		key := string(crypto.Keccak256([]byte(fmt.Sprint(i))))
+		old[key] = fmt.Sprintf("%040d", i)
+		changed[key] = old[key]
+		if i%10 == 0 {
+			changed[key] = fmt.Sprintf("%040d", -i)
+		}
+	}
+	return old, changed
+}
+
+func testPebbleConfig() PebbleConfig {
+	var pc PebbleConfig
+	pc.defaults(ProfileBulkLoad)
+	return pc
+}
+
+// exportTestProofs writes the proofs of every key of tr to accountToProof
+// and the ProofDB in dir the way ExportProofs does, appending to a ProofDB
+// that is already there.
+func exportTestProofs(t *testing.T, dir string, tr *trie.Trie, kvs map[string]string) {
+	t.Helper()
+	pc := testPebbleConfig()
+	if err := recordPinnedState(dir, PinnedState{StateRoot: tr.Hash()}); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := appendProofTables(dir, "accountToProof", "", ProofIndexSegment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := startTables(dir, "test", nil, tables...); err != nil {
+		t.Fatal(err)
+	}
+	pd, err := NewProofDeduper(dir, ProofIndexSegment, pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pd.Close()
+	if err := resumeProofDB(dir, "", pd, 0); err != nil {
+		t.Fatal(err)
+	}
+	accountToProof, err := NewAccountToProof(dir, pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accountToProof.Close()
+
+	for k := range kvs {
+		p := pd.NewProofContainer()
+		if err := p.DedupAll(prove(t, tr, k)); err != nil {
+			t.Fatal(err)
+		}
+		if err := accountToProof.Save([]byte(k), p.AsIds()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := completeAppendedProofs(dir, "accountToProof", uint64(len(kvs)), "", pd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkTestProofs checks that every proof in dir verifies against tr and
+// returns the segments in idToProofSegment.
+func checkTestProofs(t *testing.T, dir string, tr *trie.Trie, kvs map[string]string) map[string]bool {
+	t.Helper()
+	pc := testPebbleConfig()
+	pd, err := OpenProofDBReadOnly(dir, pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pd.Close()
+	db, err := openPebbleDBReadOnly(dir, "accountToProof", pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	accountToProof := &AccountToProof{db: db}
+
+	for k, v := range kvs {
+		ids, err := accountToProof.Get([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := pd.RecoverProof(ids)
+		if err != nil {
+			t.Fatalf("RecoverProof(%x): %v", k, err)
+		}
+		value, err := trie.VerifyProof(tr.Hash(), []byte(k), NewProofKV(proof))
+		if err != nil {
+			t.Fatalf("VerifyProof(%x): %v", k, err)
+		}
+		if !bytes.Equal(value, []byte(v)) {
+			t.Fatalf("proof of %x has value %q, want %q", k, value, v)
+		}
+	}
+
+	segments := make(map[string]bool)
+	iter, err := pd.idToProofSegment.NewIter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		segments[string(iter.Value())] = true
+	}
+	return segments
+}
+
+func TestRepinAndGCProofs(t *testing.T) {
+	dir := t.TempDir()
+	old, changed := testAccounts(200)
+	oldTrie, newTrie := testTrie(t, old), testTrie(t, changed)
+
+	exportTestProofs(t, dir, oldTrie, old)
+	if err := recordPinnedState(dir, PinnedState{StateRoot: newTrie.Hash()}); err == nil {
+		t.Fatal("recordPinnedState accepted another state root before repinning")
+	}
+
+	if err := repinWorkDir(dir, PinnedState{StateRoot: newTrie.Hash()}, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.StateRoot != newTrie.Hash() || m.Tables["accountToProof"] != nil || m.Tables["idToProofSegment"] == nil {
+		t.Fatalf("manifest after repin: root %v, tables %v", m.StateRoot, m.Tables)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "accountToProof")); !os.IsNotExist(err) {
+		t.Fatalf("accountToProof is still there after repin: %v", err)
+	}
+	lastId := m.Tables["idToProofSegment"].LastId
+
+	exportTestProofs(t, dir, newTrie, changed)
+	before := checkTestProofs(t, dir, newTrie, changed)
+
+	want := make(map[string]bool)
+	for k := range changed {
+		for _, node := range prove(t, newTrie, k) {
+			want[string(node)] = true
+		}
+	}
+	if len(before) <= len(want) {
+		t.Fatalf("re-export left %v segments, want more than the %v of the new proofs", len(before), len(want))
+	}
+
+	if err := GCProofs(GCProofsConfig{WorkDir: dir, Compact: true, PebbleConfig: testPebbleConfig()}); err != nil {
+		t.Fatal(err)
+	}
+	after := checkTestProofs(t, dir, newTrie, changed)
+	if len(after) != len(want) {
+		t.Errorf("gc kept %v segments, want %v", len(after), len(want))
+	}
+	for node := range after {
+		if !want[node] {
+			t.Errorf("gc kept segment %x no new proof has", node)
+		}
+	}
+
+	m, err = ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idToSegment := m.Tables["idToProofSegment"]
+	if idToSegment.NRecords != uint64(len(want)) || idToSegment.LastId <= lastId {
+		t.Errorf("idToProofSegment manifest after gc: NRecords=%v LastId=%v, want %v and above %v", idToSegment.NRecords, idToSegment.LastId, len(want), lastId)
+	}
+	if m.StateRoot != newTrie.Hash() {
+		t.Errorf("StateRoot = %v, want %v", m.StateRoot, newTrie.Hash())
+	}
+}
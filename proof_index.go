@@ -0,0 +1,199 @@
+package ethdataset
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+type MigrateProofIndexConfig struct {
+	WorkDir string `toml:"work_dir"`
+	// Scope selects a scoped ProofDB, e.g. "storage", empty for accounts.
+	Scope string `toml:"scope"`
+	// To is the index to build, "segment" or "hash".
+	To string `toml:"to"`
+	// RemoveOld deletes the old index once the new one is built.
+	RemoveOld bool `toml:"remove_old"`
+	// NLookups is how many random segments are looked up in both indexes to
+	// compare them, 0 to skip.
+	NLookups int   `toml:"n_lookups"`
+	Seed     int64 `toml:"seed"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *MigrateProofIndexConfig) Defaults() {
+	c.To = ProofIndexHash
+	c.NLookups = 100_000
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
+
+func (c *MigrateProofIndexConfig) Validate() error {
+	var errs []error
+	errs = append(errs,
+		requireField("work_dir", c.WorkDir),
+		validateProofIndex("to", c.To),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+	if c.NLookups < 0 {
+		errs = append(errs, &ConfigError{Field: "n_lookups", Reason: "must not be negative"})
+	}
+	return errors.Join(errs...)
+}
+
+// MigrateProofIndex rebuilds the segment to id index of a ProofDB in the other
+// layout from idToProofSegment, keeping every id, and compares the size and
+// lookup speed of the two.
+func MigrateProofIndex(cfg MigrateProofIndexConfig) error {
+	from, err := detectProofIndex(cfg.WorkDir, cfg.Scope)
+	if err != nil {
+		return err
+	}
+	if from == cfg.To {
+		return fmt.Errorf("%v already has a %q proof index", cfg.WorkDir, cfg.To)
+	}
+	fromName, idToSegmentName := proofTableNames(cfg.Scope, from)
+	toName, _ := proofTableNames(cfg.Scope, cfg.To)
+
+	if _, err := requireTables(cfg.WorkDir, fromName, idToSegmentName); err != nil {
+		return err
+	}
+	if err := startTables(cfg.WorkDir, "migrate-proof-index", cfg, toName); err != nil {
+		return err
+	}
+
+	idToSegment, err := openPebbleDBReadOnly(cfg.WorkDir, idToSegmentName, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer idToSegment.Close()
+	toDB, err := openPebbleDB(cfg.WorkDir, toName, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer toDB.Close()
+
+	log.Printf("Building %v from %v\n", toName, idToSegmentName)
+	nSegments, lastId, elapsed, err := buildProofIndex(idToSegment, toDB, cfg.To, cfg.PebbleConfig.writeOptions(toName))
+	if err != nil {
+		return err
+	}
+	log.Printf("Built %v with %v segments in %v (%.0f segments/s)\n", toName, nSegments, elapsed, float64(nSegments)/elapsed.Seconds())
+	if err := completeProofDBTable(cfg.WorkDir, toName, nSegments, lastId); err != nil {
+		return err
+	}
+
+	fromDB, err := openPebbleDBReadOnly(cfg.WorkDir, fromName, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	for _, t := range []struct {
+		name  string
+		index string
+		db    *pebble.DB
+	}{{fromName, from, fromDB}, {toName, cfg.To, toDB}} {
+		lookupsPerSec := 0.0
+		if cfg.NLookups > 0 && lastId > 0 {
+			if lookupsPerSec, err = measureProofIndexLookups(idToSegment, t.db, t.index, lastId, cfg.NLookups, cfg.Seed); err != nil {
+				fromDB.Close()
+				return err
+			}
+		}
+		log.Printf("%v: index=%v size=%v lookups/s=%.0f\n", t.name, t.index, t.db.Metrics().DiskSpaceUsage(), lookupsPerSec)
+	}
+	if err := fromDB.Close(); err != nil {
+		return err
+	}
+
+	if cfg.RemoveOld {
+		log.Printf("Removing %v\n", fromName)
+		if err := os.RemoveAll(filepath.Join(cfg.WorkDir, fromName)); err != nil {
+			return err
+		}
+		return dropTable(cfg.WorkDir, fromName)
+	}
+	return nil
+}
+
+// buildProofIndex writes the index entry of every segment in idToSegment to
+// db and returns the number of segments and the largest id.
+func buildProofIndex(idToSegment, db *pebble.DB, index string, wo *pebble.WriteOptions) (uint64, uint64, time.Duration, error) {
+	iter, err := idToSegment.NewIter(nil)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer iter.Close()
+
+	w := NewBatchWriter(db, wo)
+	lastId := uint64(0)
+	n := uint64(0)
+	start := time.Now()
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Value()
+		if index == ProofIndexHash {
+			key = crypto.Keccak256(key)
+		}
+		if err := w.Set(key, iter.Key()); err != nil {
+			return 0, 0, 0, err
+		}
+		lastId = max(lastId, binary.LittleEndian.Uint64(iter.Key()))
+
+		n += 1
+		if n%1_000_000 == 0 {
+			log.Printf("n=%v %v\n", n, time.Since(start))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return 0, 0, 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, 0, 0, err
+	}
+	if err := db.Flush(); err != nil {
+		return 0, 0, 0, err
+	}
+	return n, lastId, time.Since(start), nil
+}
+
+// measureProofIndexLookups looks up n random segments in the index db and
+// returns the lookup rate. Reading the segments themselves isn't timed.
+func measureProofIndexLookups(idToSegment, db *pebble.DB, index string, lastId uint64, n int, seed int64) (float64, error) {
+	rng := rand.New(rand.NewSource(seed))
+	keys := make([][]byte, 0, n)
+	for len(keys) < n {
+		id := uint64(rng.Int63n(int64(lastId))) + 1
+		ps, err := pebbleGet(idToSegment, uint64ToKey(id))
+		if err != nil {
+			return 0, err
+		}
+		if ps == nil {
+			// A gap left by a resumed export.
+			continue
+		}
+		keys = append(keys, ps)
+	}
+
+	start := time.Now()
+	for _, ps := range keys {
+		key := ps
+		if index == ProofIndexHash {
+			key = crypto.Keccak256(ps)
+		}
+		v, err := pebbleGet(db, key)
+		if err != nil {
+			return 0, err
+		}
+		if v == nil {
+			return 0, notFound(index, key)
+		}
+	}
+	return float64(n) / time.Since(start).Seconds(), nil
+}
@@ -0,0 +1,554 @@
+package ethdataset
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+type RenumberProofsConfig struct {
+	WorkDir string `toml:"work_dir"`
+	// Scope selects the ProofDB to renumber: empty for the account proofs
+	// referenced by accountToProof, "storage" for the storage proofs
+	// referenced by slotAndIndexToProofIds.
+	Scope string `toml:"scope"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *RenumberProofsConfig) Defaults() {
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
+
+func (c *RenumberProofsConfig) Validate() error {
+	var errs []error
+	errs = append(errs, requireField("work_dir", c.WorkDir))
+	if _, err := proofRefTable(c.Scope); err != nil {
+		errs = append(errs, &ConfigError{Field: "scope", Reason: err.Error()})
+	}
+	errs = append(errs, c.PebbleConfig.validate("pebble_config"))
+	return errors.Join(errs...)
+}
+
+// proofRefTable returns the table holding the proof ids of every key proven
+// by the ProofDB of scope.
+func proofRefTable(scope string) (string, error) {
+	switch scope {
+	case "":
+		return "accountToProof", nil
+	case "storage":
+		return "slotAndIndexToProofIds", nil
+	}
+	return "", fmt.Errorf("unknown proof scope %q, want \"\" or \"storage\"", scope)
+}
+
+// proofRefTables returns every table in a dir with manifest m holding ids of
+// the ProofDB of scope. For the account ProofDB that includes absentToProof,
+// and slotAndIndexToProofIds if the storage proofs share it.
+func proofRefTables(m *Manifest, scope string) ([]string, error) {
+	refName, err := proofRefTable(scope)
+	if err != nil {
+		return nil, err
+	}
+	shared := m.Tables["slotAndIndexToProofIds"] != nil && storageProofScope(m) == ""
+	if scope == "storage" {
+		if shared {
+			return nil, fmt.Errorf("the storage proofs share the account ProofDB, use scope \"\"")
+		}
+		return []string{refName}, nil
+	}
+
+	var more []string
+	if m.Tables["absentToProof"] != nil {
+		more = append(more, "absentToProof")
+	}
+	if shared {
+		more = append(more, "slotAndIndexToProofIds")
+	}
+	if m.Tables[refName] == nil && len(more) > 0 {
+		return more, nil
+	}
+	return append([]string{refName}, more...), nil
+}
+
+// proofIdMapName is the table mapping the ids a ProofDB had before
+// RenumberProofs to the ones it has after.
+func proofIdMapName(scope string) string {
+	if scope == "" {
+		return "proofIdMap"
+	}
+	return scope + "-proofIdMap"
+}
+
+// renumberedSuffix names the tables RenumberProofs writes before they replace
+// the originals.
+const renumberedSuffix = ".renumbered"
+
+// renumberMarker records a RenumberProofs run that has not finished, so a
+// rerun knows whether to throw away its copies or finish swapping them in.
+// The manifest is not touched until the swap is done.
+type renumberMarker struct {
+	// Tables are swapped in for the originals, the proofIdMap last.
+	Tables   []string `json:"tables"`
+	RefNames []string `json:"ref_names"`
+	// Swapping is set once every copy is written. From then on the copies
+	// are the only consistent set and the swap has to be finished.
+	Swapping bool     `json:"swapping"`
+	NIds     uint64   `json:"n_ids"`
+	NRefs    []uint64 `json:"n_refs"`
+}
+
+const renumberMarkerSuffix = ".renumbering.json"
+
+func renumberMarkerPath(dir, scope string) string {
+	return filepath.Join(dir, proofIdMapName(scope)+renumberMarkerSuffix)
+}
+
+func readRenumberMarker(path string) (*renumberMarker, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var mk renumberMarker
+	if err := json.Unmarshal(b, &mk); err != nil {
+		return nil, corruptRecord(path, nil, err)
+	}
+	return &mk, nil
+}
+
+func writeRenumberMarker(path string, mk *renumberMarker) error {
+	b, err := json.MarshalIndent(mk, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// requireNoRenumberSwap fails if a RenumberProofs run in dir stopped while
+// swapping in any of tables, as they then mix old and new proof ids.
+func requireNoRenumberSwap(dir string, tables []string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+renumberMarkerSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		mk, err := readRenumberMarker(path)
+		if err != nil {
+			return err
+		}
+		if mk == nil || !mk.Swapping {
+			continue
+		}
+		for _, table := range tables {
+			if slices.Contains(mk.Tables, table) {
+				return fmt.Errorf("%v: table %v is being swapped in by renumber-proofs, rerun it to completion", dir, table)
+			}
+		}
+	}
+	return nil
+}
+
+// RenumberProofs gives the segments of a finished ProofDB dense ids ordered
+// by trie depth and then path: every root gets a lower id than every node
+// below the root and so on down, and within a depth nodes are numbered in the
+// key order of the proofs that reach them. Segments no proof refers to, e.g.
+// left behind by a crashed export, are dropped.
+//
+// idToProofSegment, its index, the proof id tables and proofIdMap, which maps
+// every old id to its new one, are all written next to the originals first.
+// Only then are they swapped in and marked complete in the manifest at once.
+// A marker file tracks the run: a rerun after a crash while writing starts
+// over, and one after a crash while swapping finishes the swap. The old to new
+// mapping is also held in memory while running, 8 bytes per old id.
+func RenumberProofs(cfg RenumberProofsConfig) error {
+	markerPath := renumberMarkerPath(cfg.WorkDir, cfg.Scope)
+	mk, err := readRenumberMarker(markerPath)
+	if err != nil {
+		return err
+	}
+	if mk != nil && mk.Swapping {
+		log.Printf("Finishing the swap of a crashed run\n")
+		return finishRenumber(cfg, markerPath, mk)
+	}
+
+	m, err := ReadManifest(cfg.WorkDir)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("%v has no manifest", cfg.WorkDir)
+	}
+	refNames, err := proofRefTables(m, cfg.Scope)
+	if err != nil {
+		return err
+	}
+	index, err := detectProofIndex(cfg.WorkDir, cfg.Scope)
+	if err != nil {
+		return err
+	}
+	indexName, idToSegmentName := proofTableNames(cfg.Scope, index)
+	mapName := proofIdMapName(cfg.Scope)
+	rewritten := append([]string{indexName, idToSegmentName}, refNames...)
+
+	if m, err = requireTables(cfg.WorkDir, rewritten...); err != nil {
+		return err
+	}
+	if m.Tables[mapName] != nil {
+		return fmt.Errorf("%v: proof ids were already renumbered, see %v", cfg.WorkDir, mapName)
+	}
+	lastOld := m.Tables[idToSegmentName].lastId()
+
+	mk = &renumberMarker{Tables: append(rewritten, mapName), RefNames: refNames}
+	if err := writeRenumberMarker(markerPath, mk); err != nil {
+		return err
+	}
+	// Start over from anything a crashed run left behind.
+	for _, name := range mk.Tables {
+		if err := os.RemoveAll(filepath.Join(cfg.WorkDir, name+renumberedSuffix)); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Ordering %v proof ids by depth from %v\n", lastOld, refNames)
+	start := time.Now()
+	newIds, nIds, nRefs, err := orderProofIds(cfg.WorkDir, refNames, lastOld, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	log.Printf("Ordered nIds=%v referenced by nRecords=%v in %v\n", nIds, nRefs, time.Since(start))
+
+	log.Printf("Rewriting %v\n", idToSegmentName)
+	nDropped, err := renumberSegments(cfg.WorkDir, idToSegmentName, newIds, nIds, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	log.Printf("Dropped nSegments=%v no proof refers to\n", nDropped)
+
+	log.Printf("Rebuilding %v\n", indexName)
+	if err := rebuildProofIndex(cfg.WorkDir, idToSegmentName, indexName, index, cfg.PebbleConfig); err != nil {
+		return err
+	}
+
+	for _, refName := range refNames {
+		log.Printf("Rewriting %v\n", refName)
+		if err := renumberRefs(cfg.WorkDir, refName, newIds, cfg.PebbleConfig); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Writing %v\n", mapName)
+	if err := writeProofIdMap(cfg.WorkDir, mapName+renumberedSuffix, newIds, cfg.PebbleConfig); err != nil {
+		return err
+	}
+	newIds = nil
+
+	mk.Swapping = true
+	mk.NIds = nIds
+	mk.NRefs = nRefs
+	if err := writeRenumberMarker(markerPath, mk); err != nil {
+		return err
+	}
+	if err := finishRenumber(cfg, markerPath, mk); err != nil {
+		return err
+	}
+	log.Printf("Renumbered nIds=%v in %v\n", nIds, time.Since(start))
+	return nil
+}
+
+// finishRenumber swaps in every copy of mk that is still there, marks the
+// tables complete in a single manifest write and drops the marker. It can be
+// repeated after a crash at any point.
+func finishRenumber(cfg RenumberProofsConfig, markerPath string, mk *renumberMarker) error {
+	for _, name := range mk.Tables {
+		path := filepath.Join(cfg.WorkDir, name)
+		if _, err := os.Stat(path + renumberedSuffix); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		if err := os.Rename(path+renumberedSuffix, path); err != nil {
+			return err
+		}
+	}
+
+	m, err := ReadManifest(cfg.WorkDir)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("%v has no manifest", cfg.WorkDir)
+	}
+	hash, err := configHash(cfg)
+	if err != nil {
+		return err
+	}
+	nRecords := make(map[string]uint64)
+	for i, refName := range mk.RefNames {
+		nRecords[refName] = mk.NRefs[i]
+	}
+	mapName := proofIdMapName(cfg.Scope)
+	for _, name := range mk.Tables {
+		t := &TableManifest{
+			Command:     "renumber-proofs",
+			ToolVersion: toolVersion(),
+			ConfigHash:  hash,
+			Status:      TableComplete,
+			UpdatedAt:   time.Now().UTC(),
+		}
+		if n, ok := nRecords[name]; ok {
+			t.NRecords = n
+		} else {
+			t.NRecords = mk.NIds
+			// The new ids have no gaps.
+			if name != mapName {
+				t.LastId = mk.NIds
+			}
+		}
+		m.Tables[name] = t
+	}
+	if err := WriteManifest(cfg.WorkDir, m); err != nil {
+		return err
+	}
+	return os.Remove(markerPath)
+}
+
+// orderProofIds assigns the new ids. The proofs are read once per depth, so
+// each node gets its id at the shallowest depth it appears at and in the key
+// order of the first proof through it, reading refNames one after the other.
+// newIds[old] is the new id of old, or 0 if no proof refers to it. nRefs
+// counts the records of each table.
+func orderProofIds(dir string, refNames []string, lastOld uint64, pc PebbleConfig) (newIds []uint64, nIds uint64, nRefs []uint64, err error) {
+	dbs := make([]*pebble.DB, len(refNames))
+	defer func() {
+		for _, db := range dbs {
+			if db != nil {
+				db.Close()
+			}
+		}
+	}()
+	for i, name := range refNames {
+		if dbs[i], err = openPebbleDBReadOnly(dir, name, pc); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+
+	newIds = make([]uint64, lastOld+1)
+	nRefs = make([]uint64, len(refNames))
+	for depth := 0; ; depth++ {
+		deeper := false
+		for i, db := range dbs {
+			nRefs[i] = 0
+			if err := orderProofIdsAt(db, refNames[i], depth, newIds, &nIds, &nRefs[i], &deeper); err != nil {
+				return nil, 0, nil, err
+			}
+		}
+		if !deeper {
+			return newIds, nIds, nRefs, nil
+		}
+		log.Printf("depth=%v nIds=%v\n", depth, nIds)
+	}
+}
+
+// orderProofIdsAt numbers the nodes at depth of every proof in db that are
+// not numbered yet.
+func orderProofIdsAt(db *pebble.DB, refName string, depth int, newIds []uint64, nIds, nRefs *uint64, deeper *bool) error {
+	iter, err := db.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	lastOld := uint64(len(newIds) - 1)
+	for iter.First(); iter.Valid(); iter.Next() {
+		*nRefs += 1
+		value := iter.Value()
+		if len(value)%8 != 0 {
+			return corruptRecord(refName, iter.Key(), fmt.Errorf("length %v is not a multiple of 8", len(value)))
+		}
+		if len(value)/8 <= depth {
+			continue
+		}
+		*deeper = true
+		old := binary.LittleEndian.Uint64(value[depth*8:])
+		if old == 0 || old > lastOld {
+			return corruptRecord(refName, iter.Key(), fmt.Errorf("proof id %v out of range [1, %v]", old, lastOld))
+		}
+		if newIds[old] == 0 {
+			*nIds += 1
+			newIds[old] = *nIds
+		}
+	}
+	return iter.Error()
+}
+
+// renumberSegments writes every referenced segment of idToSegmentName under
+// its new id and returns how many unreferenced segments were dropped.
+func renumberSegments(dir, idToSegmentName string, newIds []uint64, nIds uint64, pc PebbleConfig) (uint64, error) {
+	oldDB, err := openPebbleDBReadOnly(dir, idToSegmentName, pc)
+	if err != nil {
+		return 0, err
+	}
+	defer oldDB.Close()
+	newDB, err := openPebbleDB(dir, idToSegmentName+renumberedSuffix, pc)
+	if err != nil {
+		return 0, err
+	}
+	defer newDB.Close()
+
+	iter, err := oldDB.NewIter(nil)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	w := NewBatchWriter(newDB, pc.writeOptions(idToSegmentName))
+	var nWritten, nDropped uint64
+	for iter.First(); iter.Valid(); iter.Next() {
+		old := binary.LittleEndian.Uint64(iter.Key())
+		if old >= uint64(len(newIds)) || newIds[old] == 0 {
+			nDropped += 1
+			continue
+		}
+		if err := w.Set(uint64ToKey(newIds[old]), iter.Value()); err != nil {
+			return 0, err
+		}
+		nWritten += 1
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	if nWritten != nIds {
+		return 0, fmt.Errorf("%w: %v holds %v of the %v referenced segments", ErrNotFound, idToSegmentName, nWritten, nIds)
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return nDropped, newDB.Flush()
+}
+
+// rebuildProofIndex builds the renumbered index from the renumbered
+// idToProofSegment.
+func rebuildProofIndex(dir, idToSegmentName, indexName, index string, pc PebbleConfig) error {
+	idToSegment, err := openPebbleDBReadOnly(dir, idToSegmentName+renumberedSuffix, pc)
+	if err != nil {
+		return err
+	}
+	defer idToSegment.Close()
+	db, err := openPebbleDB(dir, indexName+renumberedSuffix, pc)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, _, _, err = buildProofIndex(idToSegment, db, index, pc.writeOptions(indexName))
+	return err
+}
+
+// renumberRefs rewrites the proof ids of every record of refName. The
+// records are read in key order, so they are bulk loaded as a single sorted
+// run.
+func renumberRefs(dir, refName string, newIds []uint64, pc PebbleConfig) error {
+	refDB, err := openPebbleDBReadOnly(dir, refName, pc)
+	if err != nil {
+		return err
+	}
+	defer refDB.Close()
+	newDB, err := openPebbleDB(dir, refName+renumberedSuffix, pc)
+	if err != nil {
+		return err
+	}
+	defer newDB.Close()
+	loader, err := NewBulkLoader(newDB, dir, refName+renumberedSuffix)
+	if err != nil {
+		return err
+	}
+
+	iter, err := refDB.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	w := loader.Writer(0)
+	var ids []uint64
+	for iter.First(); iter.Valid(); iter.Next() {
+		ids = ids[:0]
+		for _, old := range bytesToUint64(iter.Value()) {
+			ids = append(ids, newIds[old])
+		}
+		if err := w.Set(iter.Key(), uint64SliceToBytesUnsafe(ids)); err != nil {
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := loader.Close(); err != nil {
+		return err
+	}
+	return newDB.Flush()
+}
+
+// writeProofIdMap writes old id to new id for every referenced old id.
+func writeProofIdMap(dir, mapName string, newIds []uint64, pc PebbleConfig) error {
+	db, err := openPebbleDB(dir, mapName, pc)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w := NewBatchWriter(db, pc.writeOptions(mapName))
+	for old, id := range newIds {
+		if id == 0 {
+			continue
+		}
+		if err := w.Set(uint64ToKey(uint64(old)), uint64ToKey(id)); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return db.Flush()
+}
+
+// TranslateProofIds maps proof ids from before RenumberProofs to the ones
+// they have now, using the proofIdMap in dir. Ids are translated in place.
+func TranslateProofIds(dir, scope string, ids []uint64, pc PebbleConfig) error {
+	mapName := proofIdMapName(scope)
+	if _, err := requireTables(dir, mapName); err != nil {
+		return err
+	}
+	db, err := openPebbleDBReadOnly(dir, mapName, pc)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for i, old := range ids {
+		key := uint64ToKey(old)
+		b, err := pebbleGet(db, key)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			return notFound(mapName, key)
+		}
+		ids[i] = binary.LittleEndian.Uint64(b)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package ethdataset
+
+import (
+	"slices"
+	"testing"
+)
+
+// readTestProofIds returns the proof ids of every key in accountToProof in
+// dir.
+func readTestProofIds(t *testing.T, dir string, kvs map[string]string) map[string][]uint64 {
+	t.Helper()
+	db, err := openPebbleDBReadOnly(dir, "accountToProof", testPebbleConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	accountToProof := &AccountToProof{db: db}
+	ids := make(map[string][]uint64)
+	for k := range kvs {
+		if ids[k], err = accountToProof.Get([]byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+func TestRenumberProofs(t *testing.T) {
+	dir := t.TempDir()
+	old, changed := testAccounts(200)
+	oldTrie, newTrie := testTrie(t, old), testTrie(t, changed)
+
+	// Re-exporting after a repin leaves the old state's segments behind, so
+	// there are ids no proof refers to.
+	exportTestProofs(t, dir, oldTrie, old)
+	if err := repinWorkDir(dir, PinnedState{StateRoot: newTrie.Hash()}, nil); err != nil {
+		t.Fatal(err)
+	}
+	exportTestProofs(t, dir, newTrie, changed)
+	oldIds := readTestProofIds(t, dir, changed)
+
+	cfg := RenumberProofsConfig{WorkDir: dir, PebbleConfig: testPebbleConfig()}
+	if err := RenumberProofs(cfg); err != nil {
+		t.Fatal(err)
+	}
+	segments := checkTestProofs(t, dir, newTrie, changed)
+
+	// The ids are dense, start at the root and grow with depth along every
+	// proof.
+	n := uint64(len(segments))
+	m, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Tables["idToProofSegment"]; got.NRecords != n || got.LastId != n {
+		t.Errorf("idToProofSegment manifest: NRecords=%v LastId=%v, want %v", got.NRecords, got.LastId, n)
+	}
+	newIds := readTestProofIds(t, dir, changed)
+	for k, ids := range newIds {
+		if ids[0] != 1 {
+			t.Errorf("proof of %x starts at id %v, want the root at 1", k, ids[0])
+		}
+		for i := 1; i < len(ids); i++ {
+			if ids[i] <= ids[i-1] || ids[i] > n {
+				t.Errorf("proof of %x has ids %v, want increasing ids up to %v", k, ids, n)
+				break
+			}
+		}
+	}
+
+	// The id map translates the ids from before.
+	for k, ids := range oldIds {
+		if err := TranslateProofIds(dir, "", ids, testPebbleConfig()); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ids, newIds[k]) {
+			t.Errorf("translated ids of %x = %v, want %v", k, ids, newIds[k])
+		}
+	}
+
+	if err := RenumberProofs(cfg); err == nil {
+		t.Error("renumbering twice succeeded")
+	}
+}
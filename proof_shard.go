@@ -0,0 +1,190 @@
+package ethdataset
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"unsafe"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ethereum/go-ethereum/common/lru"
+)
+
+type ProofDedupConfig struct {
+	// Shards splits id assignment into independent shards, each with its own
+	// lock, cache, write batches and id range. 0 keeps the single striped
+	// lock path.
+	Shards int `toml:"shards"`
+	// CacheSize bounds the number of segment ids cached in memory, at every
+	// proof depth, across all shards.
+	CacheSize int `toml:"cache_size"`
+	// IdBlock is how many ids a shard reserves from the shared counter at
+	// once. Ids a shard reserves but doesn't use are left as gaps.
+	IdBlock uint64 `toml:"id_block"`
+}
+
+func (c *ProofDedupConfig) defaults() {
+	c.CacheSize = 4_000_000
+	c.IdBlock = 4096
+}
+
+func (c ProofDedupConfig) validate(prefix string) error {
+	var errs []error
+	if c.Shards < 0 {
+		errs = append(errs, &ConfigError{Field: prefix + ".shards", Reason: "must not be negative"})
+	}
+	if c.Shards > 0 && c.CacheSize < c.Shards {
+		errs = append(errs, &ConfigError{Field: prefix + ".cache_size", Reason: "must be at least shards"})
+	}
+	if c.Shards > 0 && c.IdBlock < 1 {
+		errs = append(errs, &ConfigError{Field: prefix + ".id_block", Reason: "must be at least 1"})
+	}
+	return errors.Join(errs...)
+}
+
+// minShardBatchSize keeps shard batches from getting too small to be worth
+// committing when there are many shards.
+const minShardBatchSize = 1 << 20
+
+// proofShard owns the segments whose index key hashes to it. Everything in it
+// is guarded by mu.
+type proofShard struct {
+	mu    sync.Mutex
+	cache lru.BasicLRU[string, uint64]
+	// pending holds the ids in the batches so that they are found before the
+	// batches are committed, even once they fall out of the cache.
+	pending     map[string]uint64
+	segmentToId *pebble.Batch
+	idToSegment *pebble.Batch
+	// next and end are the reserved but unused ids [next, end).
+	next, end uint64
+}
+
+// UseShards switches pd to sharded id assignment as configured by cfg. It
+// must be called before ResumeIds and before any ids are handed out.
+func (pd *ProofDB) UseShards(cfg ProofDedupConfig) {
+	if cfg.Shards == 0 {
+		return
+	}
+	pd.idBlock = cfg.IdBlock
+	pd.shardBatchSize = max(batchWriteSize/cfg.Shards, minShardBatchSize)
+	pd.shards = make([]*proofShard, cfg.Shards)
+	for i := range pd.shards {
+		pd.shards[i] = &proofShard{
+			cache:       lru.NewBasicLRU[string, uint64](max(cfg.CacheSize/cfg.Shards, 1)),
+			pending:     make(map[string]uint64),
+			segmentToId: pd.proofSegmentToId.NewBatch(),
+			idToSegment: pd.idToProofSegment.NewBatch(),
+		}
+	}
+}
+
+func (pd *ProofDB) shard(key []byte) *proofShard {
+	h := fnv.New32a()
+	h.Write(key)
+	return pd.shards[h.Sum32()%uint32(len(pd.shards))]
+}
+
+// shardedGetOrCreateId is getOrCreateId for a sharded ProofDB. Only the
+// shard owning the segment is locked, and the shared id counter is only
+// touched once per IdBlock new segments.
+func (pd *ProofDB) shardedGetOrCreateId(ps []byte) (uint64, bool, error) {
+	key := pd.indexKey(ps)
+	s := pd.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok, err := pd.shardLookup(s, key)
+	if err != nil {
+		return 0, false, err
+	}
+	if ok {
+		pd.deduped.Add(1)
+		return id, false, nil
+	}
+
+	pd.unique.Add(1)
+	if s.next == s.end {
+		s.end = pd.nextId.Add(pd.idBlock) + 1
+		s.next = s.end - pd.idBlock
+	}
+	id = s.next
+	s.next += 1
+
+	idBytes := uint64ToKey(id)
+	if err := s.segmentToId.Set(key, idBytes, nil); err != nil {
+		return 0, false, err
+	}
+	if err := s.idToSegment.Set(idBytes, ps, nil); err != nil {
+		return 0, false, err
+	}
+	s.pending[string(key)] = id
+	s.cache.Add(string(key), id)
+	if s.segmentToId.Len()+s.idToSegment.Len() >= pd.shardBatchSize {
+		return id, true, pd.commitShard(s)
+	}
+	return id, true, nil
+}
+
+// shardLookup finds key in the cache, the pending batches or Pebble. s.mu
+// must be held.
+func (pd *ProofDB) shardLookup(s *proofShard, key []byte) (uint64, bool, error) {
+	if len(key) == 0 {
+		return 0, false, ErrEmptyProofSegment
+	}
+	k := unsafe.String(&key[0], len(key))
+	if id, ok := s.cache.Get(k); ok {
+		return id, true, nil
+	}
+	if id, ok := s.pending[k]; ok {
+		return id, true, nil
+	}
+	value, err := pebbleGet(pd.proofSegmentToId, key)
+	if err != nil || value == nil {
+		return 0, false, err
+	}
+	if len(value) != 8 {
+		return 0, false, corruptRecord("proofSegmentToId", key, fmt.Errorf("id length %v, want 8", len(value)))
+	}
+	id := binary.LittleEndian.Uint64(value)
+	s.cache.Add(string(key), id)
+	return id, true, nil
+}
+
+// commitShard writes out the batches of s. s.mu must be held.
+func (pd *ProofDB) commitShard(s *proofShard) error {
+	if s.segmentToId.Empty() {
+		return nil
+	}
+	// As in commit, ids go in before the segments pointing at them.
+	if err := s.idToSegment.Commit(pd.idToSegmentWo); err != nil {
+		return err
+	}
+	if err := s.segmentToId.Commit(pd.segmentToIdWo); err != nil {
+		return err
+	}
+	if err := errors.Join(s.idToSegment.Close(), s.segmentToId.Close()); err != nil {
+		return err
+	}
+	s.segmentToId = pd.proofSegmentToId.NewBatch()
+	s.idToSegment = pd.idToProofSegment.NewBatch()
+	clear(s.pending)
+	return nil
+}
+
+// commitShards commits every shard. With closing set the shards' batches are
+// released rather than replaced.
+func (pd *ProofDB) commitShards(closing bool) error {
+	var errs []error
+	for _, s := range pd.shards {
+		s.mu.Lock()
+		errs = append(errs, pd.commitShard(s))
+		if closing {
+			errs = append(errs, s.segmentToId.Close(), s.idToSegment.Close())
+		}
+		s.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
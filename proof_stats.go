@@ -0,0 +1,86 @@
+package ethdataset
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	// ProofScopeAccount counts the segments of account proofs.
+	ProofScopeAccount = "account"
+	// ProofScopeStorage counts the segments of storage slot proofs.
+	ProofScopeStorage = "storage"
+)
+
+// maxStatsDepth is the number of proof depths ProofDB keeps stats for.
+// Deeper segments are counted at the last depth.
+const maxStatsDepth = 16
+
+// ProofScopeStats counts the segments deduplicated for one scope by their
+// depth in the proof.
+type ProofScopeStats struct {
+	total   [maxStatsDepth]atomic.Uint64
+	unique  [maxStatsDepth]atomic.Uint64
+	deduped [maxStatsDepth]atomic.Uint64
+}
+
+func (s *ProofScopeStats) add(depth int, created bool) {
+	depth = min(depth, maxStatsDepth-1)
+	s.total[depth].Add(1)
+	if created {
+		s.unique[depth].Add(1)
+	} else {
+		s.deduped[depth].Add(1)
+	}
+}
+
+// Depth returns the counts of segments at depth.
+func (s *ProofScopeStats) Depth(depth int) (total, unique, deduped uint64) {
+	return s.total[depth].Load(), s.unique[depth].Load(), s.deduped[depth].Load()
+}
+
+// Sum returns the counts over every depth.
+func (s *ProofScopeStats) Sum() (total, unique, deduped uint64) {
+	for d := 0; d < maxStatsDepth; d++ {
+		t, u, dd := s.Depth(d)
+		total, unique, deduped = total+t, unique+u, deduped+dd
+	}
+	return total, unique, deduped
+}
+
+// ScopeStats returns the stats of scope, e.g. ProofScopeStorage.
+func (pd *ProofDB) ScopeStats(scope string) *ProofScopeStats {
+	s, _ := pd.scopeStats.LoadOrStore(scope, &ProofScopeStats{})
+	return s.(*ProofScopeStats)
+}
+
+// Scopes returns the scopes that have deduplicated segments, sorted.
+func (pd *ProofDB) Scopes() []string {
+	var scopes []string
+	pd.scopeStats.Range(func(k, _ any) bool {
+		scopes = append(scopes, k.(string))
+		return true
+	})
+	sort.Strings(scopes)
+	return scopes
+}
+
+// LogStats logs Total/Unique/Deduped for every scope and depth. A segment
+// counted as deduped in one scope may have been created by another when they
+// share the ProofDB.
+func (pd *ProofDB) LogStats() {
+	log.Printf("Total=%v Unique=%v Deduped=%v\n", pd.Total(), pd.Unique(), pd.Deduped())
+	for _, scope := range pd.Scopes() {
+		s := pd.ScopeStats(scope)
+		total, unique, deduped := s.Sum()
+		log.Printf("scope=%v Total=%v Unique=%v Deduped=%v\n", scope, total, unique, deduped)
+		for d := 0; d < maxStatsDepth; d++ {
+			total, unique, deduped := s.Depth(d)
+			if total == 0 {
+				continue
+			}
+			log.Printf("scope=%v depth=%v Total=%v Unique=%v Deduped=%v (%.1f%%)\n", scope, d, total, unique, deduped, 100*float64(deduped)/float64(total))
+		}
+	}
+}
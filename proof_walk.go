@@ -0,0 +1,307 @@
+package ethdataset
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// Reasons a proof walk shows a key is absent.
+const (
+	AbsentEmptyTrie     = "empty trie"
+	AbsentEmptyChild    = "empty branch child"
+	AbsentLeafMismatch  = "leaf for another key"
+	AbsentExtensionPath = "extension diverges from key"
+	AbsentNoBranchValue = "branch without value"
+)
+
+// WalkStep is one node visited by WalkProof.
+type WalkStep struct {
+	// Segment is the index of the proof segment the node is in. Embedded
+	// nodes share their parent's segment.
+	Segment  int
+	Embedded bool
+	// Kind is "branch", "extension" or "leaf".
+	Kind string
+	// Pos is the number of key nibbles consumed before this node.
+	Pos int
+	// Consumed are the key nibbles this node consumed.
+	Consumed []byte
+	// Child is the branch child followed, -1 for other nodes.
+	Child int
+}
+
+func (s WalkStep) String() string {
+	ref := "hashed"
+	if s.Embedded {
+		ref = "embedded"
+	}
+	child := ""
+	if s.Child >= 0 {
+		child = fmt.Sprintf(" child=%x", s.Child)
+	}
+	return fmt.Sprintf("segment=%v %v %v pos=%v consumed=%v%v", s.Segment, ref, s.Kind, s.Pos, nibblesString(s.Consumed), child)
+}
+
+// nibblesString writes one hex digit per nibble.
+func nibblesString(nibbles []byte) string {
+	const digits = "0123456789abcdef"
+	b := make([]byte, len(nibbles))
+	for i, n := range nibbles {
+		b[i] = digits[n&0x0f]
+	}
+	return string(b)
+}
+
+// ProofWalk is the result of walking a key through a proof.
+type ProofWalk struct {
+	Steps []WalkStep
+	// Value is the proven value, nil if the proof shows the key is absent.
+	Value []byte
+	// Absent is why the key is absent, one of the Absent constants, and
+	// empty if it is included.
+	Absent string
+}
+
+func (w *ProofWalk) Included() bool {
+	return w.Value != nil
+}
+
+func (w *ProofWalk) String() string {
+	var b strings.Builder
+	for i, s := range w.Steps {
+		fmt.Fprintf(&b, "%v: %v\n", i, s)
+	}
+	if w.Included() {
+		fmt.Fprintf(&b, "included: %x", w.Value)
+	} else {
+		fmt.Fprintf(&b, "absent: %v", w.Absent)
+	}
+	return b.String()
+}
+
+// ParseProof parses every segment of proof.
+func ParseProof(proof [][]byte) ([]*MPTNode, error) {
+	nodes := make([]*MPTNode, len(proof))
+	for i, segment := range proof {
+		node, err := ParseNode(segment)
+		if err != nil {
+			return nil, fmt.Errorf("proof segment %v: %w", i, err)
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+// keyToNibbles splits key into its hex nibbles, without a terminator.
+func keyToNibbles(key []byte) []byte {
+	nibbles := make([]byte, len(key)*2)
+	for i, b := range key {
+		nibbles[2*i] = b >> 4
+		nibbles[2*i+1] = b & 0x0f
+	}
+	return nibbles
+}
+
+// WalkProof follows key from root through nodes nibble by nibble, like
+// trie.VerifyProof, and records every node it passes. Nodes are matched to
+// hashes by MPTNode.Hash, so their order doesn't matter and unused ones are
+// ignored. The result is an inclusion or an exclusion of key; a proof that
+// is missing a node on the path is an error.
+func WalkProof(root common.Hash, key []byte, nodes []*MPTNode) (*ProofWalk, error) {
+	w := &ProofWalk{}
+	if root == types.EmptyRootHash {
+		w.Absent = AbsentEmptyTrie
+		return w, nil
+	}
+
+	byHash := make(map[common.Hash]int, len(nodes))
+	for i, node := range nodes {
+		byHash[node.Hash()] = i
+	}
+
+	nibbles := keyToNibbles(key)
+	pos := 0
+	want := root
+	for {
+		segment, ok := byHash[want]
+		if !ok {
+			return nil, fmt.Errorf("proof node %v (hash %v) missing", len(w.Steps), want)
+		}
+		node, embedded := nodes[segment], false
+
+		// Follow embedded children within the segment.
+		for {
+			step := WalkStep{Segment: segment, Embedded: embedded, Pos: pos, Child: -1}
+			rest := nibbles[pos:]
+			var next *MPTNode
+			switch {
+			case node.IsLeafNode():
+				step.Kind = "leaf"
+				if !bytes.Equal(rest, node.Leaf.Key) {
+					w.Steps = append(w.Steps, step)
+					w.Absent = AbsentLeafMismatch
+					return w, nil
+				}
+				step.Consumed = rest
+				w.Steps = append(w.Steps, step)
+				w.Value = node.Leaf.Value
+				return w, nil
+
+			case node.IsExtensionNode():
+				step.Kind = "extension"
+				ext := node.Extension
+				if !bytes.HasPrefix(rest, ext.Key) {
+					w.Steps = append(w.Steps, step)
+					w.Absent = AbsentExtensionPath
+					return w, nil
+				}
+				step.Consumed = ext.Key
+				pos += len(ext.Key)
+				w.Steps = append(w.Steps, step)
+				if !ext.IsEmbedded() {
+					want = common.BytesToHash(ext.NodeHash)
+					break
+				}
+				next = ext.Embedded
+
+			case node.IsBranchNode():
+				step.Kind = "branch"
+				if len(rest) == 0 {
+					w.Steps = append(w.Steps, step)
+					if len(node.Branch.Value) == 0 {
+						w.Absent = AbsentNoBranchValue
+						return w, nil
+					}
+					w.Value = node.Branch.Value
+					return w, nil
+				}
+				step.Child = int(rest[0])
+				step.Consumed = rest[:1]
+				pos += 1
+				w.Steps = append(w.Steps, step)
+				child := node.Branch.Children[rest[0]]
+				switch {
+				case child == nil:
+					w.Absent = AbsentEmptyChild
+					return w, nil
+				case child.IsEmbedded():
+					next = child.Embedded
+				default:
+					want = common.BytesToHash(child.Hash)
+				}
+
+			default:
+				return nil, fmt.Errorf("proof segment %v: empty node", segment)
+			}
+
+			if next == nil {
+				break
+			}
+			node, embedded = next, true
+		}
+	}
+}
+
+// CrossCheckProof walks key through proof and checks the result agrees with
+// trie.VerifyProof.
+func CrossCheckProof(root common.Hash, key []byte, proof [][]byte) (*ProofWalk, error) {
+	nodes, err := ParseProof(proof)
+	if err != nil {
+		return nil, err
+	}
+	walk, walkErr := WalkProof(root, key, nodes)
+	value, verifyErr := trie.VerifyProof(root, key, NewProofKV(proof))
+
+	switch {
+	case walkErr != nil && verifyErr != nil:
+		return nil, walkErr
+	case walkErr != nil:
+		return nil, fmt.Errorf("walk failed where trie.VerifyProof did not: %w", walkErr)
+	case verifyErr != nil && walk.Absent != AbsentEmptyTrie:
+		// VerifyProof can't show a key is absent from the empty trie, as there
+		// is no root node to look up.
+		return walk, fmt.Errorf("trie.VerifyProof failed where the walk did not: %w", verifyErr)
+	case !bytes.Equal(walk.Value, value):
+		return walk, fmt.Errorf("walk proved %x, trie.VerifyProof proved %x", walk.Value, value)
+	}
+	return walk, nil
+}
+
+type TraceProofConfig struct {
+	// StateRoot defaults to the root pinned in the work dir's manifest.
+	StateRoot   string `toml:"state_root"`
+	WorkDir     string `toml:"work_dir"`
+	AddressHash string `toml:"address_hash"`
+	// Address is a hex address to trace instead of AddressHash.
+	Address string `toml:"address"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *TraceProofConfig) Defaults() {
+	c.PebbleConfig.defaults(ProfileReadMostly)
+}
+
+func (c *TraceProofConfig) Validate() error {
+	var errs []error
+	errs = append(errs, validateHash("state_root", c.StateRoot), requireField("work_dir", c.WorkDir))
+	switch {
+	case c.AddressHash == "" && c.Address == "":
+		errs = append(errs, &ConfigError{Field: "address_hash", Reason: "or address is required"})
+	case c.AddressHash != "" && c.Address != "":
+		errs = append(errs, &ConfigError{Field: "address", Reason: "can't be set together with address_hash"})
+	case c.Address != "" && !common.IsHexAddress(c.Address):
+		errs = append(errs, &ConfigError{Field: "address", Reason: fmt.Sprintf("want a 20 byte hex address, got %q", c.Address)})
+	}
+	errs = append(errs, validateHash("address_hash", c.AddressHash), c.PebbleConfig.validate("pebble_config"))
+	return errors.Join(errs...)
+}
+
+// TraceProof prints the walk of one exported account proof, node by node,
+// and cross-checks it against trie.VerifyProof.
+func TraceProof(cfg TraceProofConfig) error {
+	m, err := requireTables(cfg.WorkDir, "accountToProof")
+	if err != nil {
+		return err
+	}
+	if err := requireStateRoot(cfg.WorkDir, m, cfg.StateRoot); err != nil {
+		return err
+	}
+
+	accountToProof, err := openPebbleDBReadOnly(cfg.WorkDir, "accountToProof", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer accountToProof.Close()
+	proofDB, err := OpenProofDBReadOnly(cfg.WorkDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer proofDB.Close()
+
+	addressHash := common.HexToHash(cfg.AddressHash)
+	if cfg.Address != "" {
+		addressHash = crypto.Keccak256Hash(common.HexToAddress(cfg.Address).Bytes())
+	}
+	proofIds, err := (&AccountToProof{db: accountToProof}).Get(addressHash.Bytes())
+	if err != nil {
+		return err
+	}
+	proof, err := proofDB.RecoverProof(proofIds)
+	if err != nil {
+		return err
+	}
+
+	walk, err := CrossCheckProof(m.StateRoot, addressHash.Bytes(), proof)
+	if walk != nil {
+		fmt.Printf("StateRoot=%v AddressHash=%v ProofIds=%v\n%v\n", m.StateRoot, addressHash, proofIds, walk)
+	}
+	return err
+}
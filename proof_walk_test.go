@@ -0,0 +1,180 @@
+package ethdataset
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// stepsString writes each step as segment/kind/consumed nibbles, with a *
+// after the kind of embedded nodes.
+func stepsString(steps []WalkStep) string {
+	parts := make([]string, len(steps))
+	for i, s := range steps {
+		kind := s.Kind
+		if s.Embedded {
+			kind += "*"
+		}
+		parts[i] = fmt.Sprintf("%v/%v/%v", s.Segment, kind, nibblesString(s.Consumed))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestCrossCheckProof(t *testing.T) {
+	long := func(s string) string { return strings.Repeat(s, 40) }
+
+	// The root branches on the first nibble into an extension over "23" for
+	// the keys starting 0x12 and a leaf for 0x5678. Values are long, so every
+	// node is hashed.
+	hashed := map[string]string{
+		"\x12\x34": long("a"),
+		"\x12\x35": long("b"),
+		"\x56\x78": long("c"),
+	}
+	// Tiny leaves are embedded in the root branch.
+	embedded := map[string]string{
+		"\x10": "x",
+		"\x20": "y",
+		"\x30": long("z"),
+	}
+	// "do" is a prefix of "dog", so the branch after the extension over
+	// "do" holds a value.
+	branchValue := map[string]string{
+		"do":  long("verb"),
+		"dog": long("puppy"),
+	}
+	// "dog" and "dot" split after "do", which has no value.
+	noBranchValue := map[string]string{
+		"dog": long("puppy"),
+		"dot": long("point"),
+	}
+
+	tests := []struct {
+		name   string
+		kvs    map[string]string
+		key    string
+		value  string
+		absent string
+		steps  string
+	}{
+		{
+			name:  "inclusion",
+			kvs:   hashed,
+			key:   "\x12\x34",
+			value: long("a"),
+			steps: "0/branch/1 1/extension/23 2/branch/4 3/leaf/",
+		},
+		{
+			name:   "empty child at the root",
+			kvs:    hashed,
+			key:    "\x99\x00",
+			absent: AbsentEmptyChild,
+			steps:  "0/branch/9",
+		},
+		{
+			name:   "empty child below an extension",
+			kvs:    hashed,
+			key:    "\x12\x36",
+			absent: AbsentEmptyChild,
+			steps:  "0/branch/1 1/extension/23 2/branch/6",
+		},
+		{
+			name:   "leaf mismatch",
+			kvs:    hashed,
+			key:    "\x56\x79",
+			absent: AbsentLeafMismatch,
+			steps:  "0/branch/5 1/leaf/",
+		},
+		{
+			name:   "extension divergence",
+			kvs:    hashed,
+			key:    "\x1f\x00",
+			absent: AbsentExtensionPath,
+			steps:  "0/branch/1 1/extension/",
+		},
+		{
+			name:  "embedded leaf",
+			kvs:   embedded,
+			key:   "\x10",
+			value: "x",
+			steps: "0/branch/1 0/leaf*/0",
+		},
+		{
+			name:   "embedded leaf mismatch",
+			kvs:    embedded,
+			key:    "\x11",
+			absent: AbsentLeafMismatch,
+			steps:  "0/branch/1 0/leaf*/",
+		},
+		{
+			name:  "branch value",
+			kvs:   branchValue,
+			key:   "do",
+			value: long("verb"),
+			steps: "0/extension/646f 1/branch/",
+		},
+		{
+			name:  "leaf below a branch value",
+			kvs:   branchValue,
+			key:   "dog",
+			value: long("puppy"),
+			steps: "0/extension/646f 1/branch/6 2/leaf/7",
+		},
+		{
+			name:   "branch without value",
+			kvs:    noBranchValue,
+			key:    "do",
+			absent: AbsentNoBranchValue,
+			steps:  "0/extension/646f 1/branch/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := testTrie(t, tt.kvs)
+			walk, err := CrossCheckProof(tr.Hash(), []byte(tt.key), prove(t, tr, tt.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.value != "" && !bytes.Equal(walk.Value, []byte(tt.value)) {
+				t.Errorf("Value = %q, want %q", walk.Value, tt.value)
+			}
+			if walk.Included() != (tt.value != "") {
+				t.Errorf("Included() = %v, want %v", walk.Included(), tt.value != "")
+			}
+			if walk.Absent != tt.absent {
+				t.Errorf("Absent = %q, want %q", walk.Absent, tt.absent)
+			}
+			if got := stepsString(walk.Steps); got != tt.steps {
+				t.Errorf("steps = %q, want %q", got, tt.steps)
+			}
+		})
+	}
+}
+
+func TestCrossCheckProofEmptyRoot(t *testing.T) {
+	walk, err := CrossCheckProof(types.EmptyRootHash, []byte("any"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walk.Included() || walk.Absent != AbsentEmptyTrie || len(walk.Steps) != 0 {
+		t.Errorf("walk = %v, want an empty trie exclusion", walk)
+	}
+}
+
+func TestCrossCheckProofMissingNode(t *testing.T) {
+	tr := testTrie(t, map[string]string{
+		"\x12\x34": strings.Repeat("a", 40),
+		"\x56\x78": strings.Repeat("b", 40),
+	})
+	proof := prove(t, tr, "\x12\x34")
+	if _, err := CrossCheckProof(tr.Hash(), []byte("\x12\x34"), proof[:len(proof)-1]); err == nil {
+		t.Error("want an error for a proof missing its leaf")
+	}
+	if _, err := CrossCheckProof(common.Hash{1}, []byte("\x12\x34"), proof); err == nil {
+		t.Error("want an error for a proof of another root")
+	}
+}
@@ -0,0 +1,119 @@
+package ethdataset
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+)
+
+type RepinConfig struct {
+	WorkDir     string      `toml:"work_dir"`
+	ChainConfig ChainConfig `toml:"chain_config"`
+}
+
+func (c *RepinConfig) Defaults() {}
+
+func (c *RepinConfig) Validate() error {
+	return errors.Join(
+		requireField("work_dir", c.WorkDir),
+		c.ChainConfig.validate("chain_config"),
+	)
+}
+
+// repinKeptTables returns the tables of a work dir that don't depend on the
+// state root and survive a repin: the ProofDBs, whose segments are addressed
+// by content, and the preimages.
+func repinKeptTables() []string {
+	kept := []string{"preimages"}
+	for _, scope := range []string{"", ProofScopeStorage} {
+		for _, index := range []string{ProofIndexSegment, ProofIndexHash} {
+			indexName, idToSegmentName := proofTableNames(scope, index)
+			kept = append(kept, indexName, idToSegmentName)
+		}
+	}
+	return kept
+}
+
+// Repin moves a work dir to the state selected by cfg.ChainConfig so that it
+// can be exported again. The ProofDBs are kept, so the new proofs share every
+// segment the two states have in common and only add the changed nodes.
+// Every other table, and every checkpoint, belongs to the old state and is
+// removed. Once the new state's proofs are exported, GCProofs removes the
+// segments only the old state used.
+func Repin(cfg RepinConfig) error {
+	_, chainDB, trieDB, err := openChain(cfg.ChainConfig)
+	if err != nil {
+		return err
+	}
+	pinned, err := ResolvePinnedState(cfg.ChainConfig, chainDB, trieDB)
+	if err != nil {
+		return err
+	}
+	return repinWorkDir(cfg.WorkDir, pinned, cfg)
+}
+
+// repinWorkDir records pinned in the manifest in dir and drops the tables of
+// the state it held before. The dropped tables are first marked in progress,
+// so that a repin interrupted while removing them leaves no table looking
+// complete, and a rerun finishes it.
+func repinWorkDir(dir string, pinned PinnedState, cfg interface{}) error {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("%v has no manifest, there is nothing to repin", dir)
+	}
+	if m.StateRoot == pinned.StateRoot {
+		log.Printf("%v already holds StateRoot=%v (block %v)\n", dir, pinned.StateRoot, pinned.BlockNumber)
+		return nil
+	}
+
+	kept, dropped := []string{}, []string{}
+	for name := range m.Tables {
+		if slices.Contains(repinKeptTables(), name) {
+			kept = append(kept, name)
+		} else {
+			dropped = append(dropped, name)
+		}
+	}
+	sort.Strings(kept)
+	sort.Strings(dropped)
+	if _, err := requireTables(dir, kept...); err != nil {
+		return err
+	}
+
+	log.Printf("Repinning %v from StateRoot=%v (block %v) to StateRoot=%v (block %v), keeping %v, dropping %v\n",
+		dir, m.StateRoot, m.BlockNumber, pinned.StateRoot, pinned.BlockNumber, kept, dropped)
+	if err := startTables(dir, "repin", cfg, dropped...); err != nil {
+		return err
+	}
+
+	checkpoints, err := filepath.Glob(checkpointPath(dir, "*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range checkpoints {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	for _, name := range dropped {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	if m, err = ReadManifest(dir); err != nil {
+		return err
+	}
+	m.PinnedState = pinned
+	for _, name := range dropped {
+		delete(m.Tables, name)
+	}
+	return WriteManifest(dir, m)
+}
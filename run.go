@@ -2,9 +2,11 @@ package ethdataset
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -15,8 +17,8 @@ import (
 )
 
 type Metrics struct {
-	Accounts uint64
-	Slots    uint64
+	Accounts atomic.Uint64
+	Slots    atomic.Uint64
 }
 
 type ExportConfig struct {
@@ -27,40 +29,114 @@ type ExportConfig struct {
 type RunConfig struct {
 	WorkDir      string       `toml:"work_dir"`
 	NAccounts    uint64       `toml:"n_accounts"`
+	ProofIndex   string       `toml:"proof_index"`
 	ChainConfig  ChainConfig  `toml:"chain_config"`
 	ExportConfig ExportConfig `toml:"export_config"`
+	WalkConfig   WalkConfig   `toml:"walk_config"`
+
+	ProofDedupConfig ProofDedupConfig `toml:"proof_dedup"`
+	PebbleConfig     PebbleConfig     `toml:"pebble_config"`
 }
 
-func Run(cfg RunConfig, analysisPass AnalysisPass) {
-	os.MkdirAll(cfg.WorkDir, os.ModePerm)
+func (c *RunConfig) Defaults() {
+	c.ProofIndex = ProofIndexSegment
+	c.WalkConfig.defaults()
+	c.ProofDedupConfig.defaults()
+	c.PebbleConfig.defaults(ProfileBulkLoad)
+}
 
-	stack := newNode(cfg.ChainConfig.DataDir)
-	chainDB := newChainDB(cfg.ChainConfig.AncientsDir, stack)
-	trieDB := newTrieDB(stack, chainDB)
+func (c *RunConfig) Validate() error {
+	return errors.Join(
+		requireField("work_dir", c.WorkDir),
+		validateProofIndex("proof_index", c.ProofIndex),
+		c.ChainConfig.validate("chain_config"),
+		c.WalkConfig.validate("walk_config"),
+		c.ProofDedupConfig.validate("proof_dedup"),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+}
 
-	header := rawdb.ReadHeadHeader(chainDB)
-	stateRoot := header.Root
+func Run(cfg RunConfig, analysisPass AnalysisPass) error {
+	if err := os.MkdirAll(cfg.WorkDir, os.ModePerm); err != nil {
+		return err
+	}
 
-	accountIt := newTrieIter(trie.StateTrieID(stateRoot), nil, trieDB)
+	_, chainDB, trieDB, err := openChain(cfg.ChainConfig)
+	if err != nil {
+		return err
+	}
+
+	pinned, err := ResolvePinnedState(cfg.ChainConfig, chainDB, trieDB)
+	if err != nil {
+		return err
+	}
+	if err := recordPinnedState(cfg.WorkDir, pinned); err != nil {
+		return err
+	}
+	if err := checkProofIndex(cfg.WorkDir, "", cfg.ProofIndex); err != nil {
+		return err
+	}
+	// A ProofDB kept by Repin is appended to.
+	tables, err := appendProofTables(cfg.WorkDir, "accountToProof", "", cfg.ProofIndex)
+	if err != nil {
+		return err
+	}
+	if cfg.ExportConfig.Code {
+		tables = append(tables, "codeHashToId", "idToCode")
+	}
+	if err := startTables(cfg.WorkDir, "run", cfg, tables...); err != nil {
+		return err
+	}
+	stateRoot := pinned.StateRoot
 
 	start := time.Now()
 	//proofTopDeduper := NewProofTopDeduper()
 
-	proofDeduper := NewProofDeduper(cfg.WorkDir)
+	proofDeduper, err := NewProofDeduper(cfg.WorkDir, cfg.ProofIndex, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer proofDeduper.Close()
+	proofDeduper.UseShards(cfg.ProofDedupConfig)
+	if err := resumeProofDB(cfg.WorkDir, "", proofDeduper, 0); err != nil {
+		return err
+	}
 
-	accountToProof := NewAccountToProof(cfg.WorkDir)
+	accountToProof, err := NewAccountToProof(cfg.WorkDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
 	defer accountToProof.Close()
 
-	codeDeduper := NewCodeDeduper(cfg.WorkDir)
+	var codeDeduper *CodeDeduper
+	if cfg.ExportConfig.Code {
+		codeDeduper, err = NewCodeDeduper(cfg.WorkDir, cfg.PebbleConfig)
+		if err != nil {
+			return err
+		}
+		defer codeDeduper.Close()
+	}
 	metrics := Metrics{}
 
-	analysisPass.OnStart(StateInfo{RootHash: stateRoot})
+	analysisPass.OnStart(StateInfo{
+		BlockID:     pinned.BlockHash,
+		BlockNumber: pinned.BlockNumber,
+		RootHash:    stateRoot,
+	})
 
-	for accountIt.Next() {
+	// Analysis passes are not thread safe, so serialize them across workers.
+	var analysisMu sync.Mutex
+
+	walk, err := NewStateWalk(cfg.WalkConfig, trieDB, stateRoot, cfg.WorkDir, "")
+	if err != nil {
+		return err
+	}
+	walk.Limit = cfg.NAccounts
+
+	err = walk.Run(func(accountIt *trie.Iterator) error {
 		var stateAccount types.StateAccount
 		if err := rlp.DecodeBytes(accountIt.Value, &stateAccount); err != nil {
-			log.Fatal(err)
+			return corruptRecord("state trie", accountIt.Key, err)
 		}
 		addressHashBytes := accountIt.Key
 
@@ -72,15 +148,22 @@ func Run(cfg RunConfig, analysisPass AnalysisPass) {
 			if !bytes.Equal(stateAccount.CodeHash, types.EmptyCodeHash.Bytes()) {
 				code = rawdb.ReadCode(chainDB, common.BytesToHash(stateAccount.CodeHash))
 			}
-			codeId = codeDeduper.Dedup(stateAccount.CodeHash, code)
+			var err error
+			if codeId, err = codeDeduper.Dedup(stateAccount.CodeHash, code); err != nil {
+				return err
+			}
 		}
 
 		accountProof := accountIt.Prove()
 
 		p := proofDeduper.NewProofContainer()
-		p.DedupAll(accountProof)
+		if err := p.DedupAll(accountProof); err != nil {
+			return err
+		}
 		proofIds := p.AsIds()
-		accountToProof.Save(addressHashBytes, proofIds)
+		if err := accountToProof.Save(addressHashBytes, proofIds); err != nil {
+			return err
+		}
 
 		// p.DedupAll(accountProof)
 		// proofIds := p.AsIds()
@@ -102,50 +185,77 @@ func Run(cfg RunConfig, analysisPass AnalysisPass) {
 		// 	log.Fatal(err)
 		// }
 
+		analysisMu.Lock()
 		accountAnalysisPass := analysisPass.OnAccount(AccountInfo{
 			StateAccount:    stateAccount,
 			Code:            code,
 			CodeId:          codeId,
 			CompressedProof: p.AsIds(),
 		})
+		analysisMu.Unlock()
 
 		if cfg.ExportConfig.Storage {
 			addressHash := common.Hash(addressHashBytes)
-			storageIt := newTrieIter(trie.StorageTrieID(stateRoot, addressHash, stateAccount.Root), nil, trieDB)
+			storageIt, err := newTrieIter(trie.StorageTrieID(stateRoot, addressHash, stateAccount.Root), nil, trieDB)
+			if err != nil {
+				return err
+			}
 
 			for storageIt.Next() {
 				_, content, _, err := rlp.Split(storageIt.Value)
 				if err != nil {
-					log.Fatal(err)
+					return corruptRecord("storage trie", storageIt.Key, err)
 				}
 				keyBytes := storageIt.Key
 
-				p := proofDeduper.NewProofContainer()
+				p := proofDeduper.NewScopedProofContainer(ProofScopeStorage)
 				storageProof := storageIt.Prove()
-				p.DedupAll(storageProof)
+				if err := p.DedupAll(storageProof); err != nil {
+					return err
+				}
 
+				analysisMu.Lock()
 				accountAnalysisPass.OnSlot(SlotInfo{
 					Key:             keyBytes,
 					Value:           content,
 					CompressedProof: p.AsIds(),
 				})
+				analysisMu.Unlock()
 
-				metrics.Slots += 1
+				metrics.Slots.Add(1)
+			}
+			if storageIt.Err != nil {
+				return storageIt.Err
 			}
 		}
+		analysisMu.Lock()
 		accountAnalysisPass.OnComplete()
+		analysisMu.Unlock()
 
-		if metrics.Accounts > 0 && metrics.Accounts%10_000 == 0 {
+		nAccounts := metrics.Accounts.Load()
+		if nAccounts > 0 && nAccounts%10_000 == 0 {
 			elapsed := time.Since(start)
-			accountsPerSec := float64(metrics.Accounts) / elapsed.Seconds()
-			fmt.Printf("Accounts=%v Slots=%v Elapsed=%v AccountsPerSec=%v\n", metrics.Accounts, metrics.Slots, elapsed, accountsPerSec)
+			accountsPerSec := float64(nAccounts) / elapsed.Seconds()
+			fmt.Printf("Accounts=%v Slots=%v Elapsed=%v AccountsPerSec=%v\n", nAccounts, metrics.Slots.Load(), elapsed, accountsPerSec)
 			fmt.Printf("Total=%v Unique=%v Deduped=%v\n", proofDeduper.Total(), proofDeduper.Unique(), proofDeduper.Deduped())
 		}
-		metrics.Accounts += 1
-		if cfg.NAccounts != 0 && metrics.Accounts == cfg.NAccounts {
-			break
+		metrics.Accounts.Add(1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := completeAppendedProofs(cfg.WorkDir, "accountToProof", metrics.Accounts.Load(), "", proofDeduper); err != nil {
+		return err
+	}
+	if codeDeduper != nil {
+		if err := completeCodeTables(cfg.WorkDir, codeDeduper); err != nil {
+			return err
 		}
 	}
 
-	analysisPass.OnComplete(*codeDeduper, proofDeduper)
+	proofDeduper.LogStats()
+	analysisPass.OnComplete(codeDeduper, proofDeduper)
+	return nil
 }
@@ -45,8 +45,12 @@ func (sa *SizeAnalysis) OnAccount(ai AccountInfo) AccountAnalysisPass {
 		SizeAnalysis: sa,
 	}
 }
-func (sa *SizeAnalysis) OnComplete(CodeDeduper, ProofDB) {
+func (sa *SizeAnalysis) OnComplete(codeDeduper *CodeDeduper, _ *ProofDB) {
 	fmt.Printf("%+v\n", sa)
+	if codeDeduper != nil {
+		fmt.Printf("Code Total=%v Unique=%v Deduped=%v Missing=%v UniqueBytes=%v\n",
+			codeDeduper.Total(), codeDeduper.Unique(), codeDeduper.Deduped(), codeDeduper.Missing(), codeDeduper.UniqueBytes())
+	}
 }
 
 type SizeAccountAnalysis struct {
@@ -1,6 +1,7 @@
 package ethdataset
 
 import (
+	"fmt"
 	"log"
 	"time"
 
@@ -24,16 +25,20 @@ type Dump struct {
 }
 
 // TODO: Note that we can't use snapshot bc it doesn't match current state trie
-func IterSnapshot(cfg RunConfig) {
+func IterSnapshot(cfg RunConfig) error {
 	// dumpConfig := DumpConfig {
 	// 	Code: true,
 	// }
 
-	stack := newNode(cfg.ChainConfig.DataDir)
-	chainDB := newChainDB(cfg.ChainConfig.AncientsDir, stack)
-	trieDB := newTrieDB(stack, chainDB)
+	_, chainDB, trieDB, err := openChain(cfg.ChainConfig)
+	if err != nil {
+		return err
+	}
 
 	header := rawdb.ReadHeadHeader(chainDB)
+	if header == nil {
+		return fmt.Errorf("chain database has no head header")
+	}
 	stateRoot := header.Root
 
 	log.Printf("Opening snapshot at stateRoot=%v", stateRoot)
@@ -46,18 +51,21 @@ func IterSnapshot(cfg RunConfig) {
 	}
 	snaptree, err := snapshot.New(snapshotConfig, chainDB, trieDB, stateRoot)
 	if err != nil {
-		log.Fatalf("Unable to build snapshot: %v\n", err)
+		return fmt.Errorf("unable to build snapshot: %w", err)
 	}
 
 	log.Println("Opening iteration")
 	accountIt, err := snaptree.AccountIterator(stateRoot, common.Hash{})
 	if err != nil {
-		log.Fatalf("Unable to build AccountIterator: %v\n", err)
+		return fmt.Errorf("unable to build AccountIterator: %w", err)
 	}
 
 	log.Printf("Starting iteration\n")
 
-	accountKV := NewKeyValue("./accounts")
+	accountKV, err := NewKeyValue("./accounts")
+	if err != nil {
+		return err
+	}
 	defer accountKV.Close()
 
 	i := 0
@@ -71,7 +79,7 @@ func IterSnapshot(cfg RunConfig) {
 		accountBytes := accountIt.Account()
 		var slim SlimAccount
 		if err := rlp.DecodeBytes(accountBytes, &slim); err != nil {
-			log.Fatal(err)
+			return corruptRecord("snapshot", addressHashBytes, err)
 		}
 
 		if slim.Root == nil || len(slim.Root) == 0 {
@@ -83,10 +91,12 @@ func IterSnapshot(cfg RunConfig) {
 
 		b, err := rlp.EncodeToBytes(slim)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
-		accountKV.Write(addressHashBytes, b)
+		if _, err := accountKV.Write(addressHashBytes, b); err != nil {
+			return err
+		}
 
 		nHashBytes += len(addressHashBytes)
 		nAccountBytes += len(b)
@@ -96,5 +106,9 @@ func IterSnapshot(cfg RunConfig) {
 			log.Printf("%v nHashBytes=%v nAccountBytes=%v @ %v\n", i, nHashBytes, nAccountBytes, time.Since(start))
 		}
 	}
+	if err := accountIt.Error(); err != nil {
+		return err
+	}
 	log.Printf("Total=%v\n", i)
+	return nil
 }
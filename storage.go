@@ -1,29 +1,29 @@
 package ethdataset
 
 import (
-	"log"
-
 	"github.com/cockroachdb/pebble"
 )
 
 type StorageTable struct {
 	DB *pebble.DB
+	wo *pebble.WriteOptions
 }
 
-func NewStorageTable(path string) *StorageTable {
-	return &StorageTable{
-		DB: openPebbleDB(path, "storage"),
+func NewStorageTable(path string, pc PebbleConfig) (*StorageTable, error) {
+	db, err := openPebbleDB(path, "storage", pc)
+	if err != nil {
+		return nil, err
 	}
+	return &StorageTable{
+		DB: db,
+		wo: pc.writeOptions("storage"),
+	}, nil
 }
 
-func (t *StorageTable) Save(key, code []byte) {
-	if err := t.DB.Set(key, code, pebble.NoSync); err != nil {
-		log.Fatal(err)
-	}
+func (t *StorageTable) Save(key, code []byte) error {
+	return t.DB.Set(key, code, t.wo)
 }
 
-func (t *StorageTable) Close() {
-	if err := t.DB.Close(); err != nil {
-		log.Fatal(err)
-	}
+func (t *StorageTable) Close() error {
+	return t.DB.Close()
 }
@@ -2,91 +2,138 @@ package ethdataset
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"io/fs"
 	"path/filepath"
 
 	"github.com/cockroachdb/pebble"
 )
 
-func openPebbleDB(path, name string) *pebble.DB {
-	db, err := pebble.Open(filepath.Join(path, name), FastUnsafeOptions())
-	if err != nil {
-		log.Fatal(err)
-	}
-	return db
+// openPebbleDB opens table name in path with the profile pc picks for it.
+func openPebbleDB(path, name string, pc PebbleConfig) (*pebble.DB, error) {
+	return openPebbleDBWithOptions(path, name, pc.profileFor(name).options())
 }
 
-type Table struct {
-	DB *pebble.DB
+// openPebbleDBReadOnly opens an existing table without allowing writes.
+func openPebbleDBReadOnly(path, name string, pc PebbleConfig) (*pebble.DB, error) {
+	opts := pc.profileFor(name).options()
+	opts.ReadOnly = true
+	opts.ErrorIfNotExists = true
+	return openPebbleDBWithOptions(path, name, opts)
 }
 
-func NewTable(path, name string) *Table {
-	return &Table{
-		DB: openPebbleDB(path, name),
+func openPebbleDBWithOptions(path, name string, opts *pebble.Options) (*pebble.DB, error) {
+	db, err := pebble.Open(filepath.Join(path, name), opts)
+	// The DB holds its own reference to the cache.
+	opts.Cache.Unref()
+	if err != nil {
+		return nil, fmt.Errorf("opening %v: %w", name, err)
 	}
+	return db, nil
 }
 
-func (t *Table) Set(key, value []byte) {
-	if err := t.DB.Set(key, value, pebble.NoSync); err != nil {
-		log.Fatal(err)
-	}
+// dirSize returns the total size of the files under path.
+func dirSize(path string) (uint64, error) {
+	var size uint64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += uint64(info.Size())
+		return nil
+	})
+	return size, err
+}
+
+type Table struct {
+	DB   *pebble.DB
+	name string
+	wo   *pebble.WriteOptions
 }
 
-func (t *Table) Get(key []byte) []byte {
-	b, c, err := t.DB.Get(key)
+func NewTable(path, name string, pc PebbleConfig) (*Table, error) {
+	db, err := openPebbleDB(path, name, pc)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return &Table{
+		DB:   db,
+		name: name,
+		wo:   pc.writeOptions(name),
+	}, nil
+}
 
-	out := make([]byte, len(b))
-	copy(out, b)
-
-	if err := c.Close(); err != nil {
-		log.Fatal(err)
+// OpenTableReadOnly opens an existing table for reading.
+func OpenTableReadOnly(path, name string, pc PebbleConfig) (*Table, error) {
+	db, err := openPebbleDBReadOnly(path, name, pc)
+	if err != nil {
+		return nil, err
 	}
-
-	return out
+	return &Table{
+		DB:   db,
+		name: name,
+	}, nil
 }
 
-func (t *Table) MaybeGet(key []byte) []byte {
-	b, c, err := t.DB.Get(key)
-	if errors.Is(err, pebble.ErrNotFound) {
-		if c != nil {
-			c.Close()
-		}
-		return nil
-	}
+func (t *Table) Set(key, value []byte) error {
+	return t.DB.Set(key, value, t.wo)
+}
 
+// Get returns the value for key, or an error wrapping ErrNotFound.
+func (t *Table) Get(key []byte) ([]byte, error) {
+	b, err := t.MaybeGet(key)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	out := make([]byte, len(b))
-	copy(out, b)
-
-	if err := c.Close(); err != nil {
-		log.Fatal(err)
+	if b == nil {
+		return nil, notFound(t.name, key)
 	}
+	return b, nil
+}
 
-	return out
+// MaybeGet returns the value for key, or nil if key is missing.
+func (t *Table) MaybeGet(key []byte) ([]byte, error) {
+	return pebbleGet(t.DB, key)
 }
 
-func (t *Table) Contains(key []byte) bool {
+func (t *Table) Contains(key []byte) (bool, error) {
 	_, closer, err := t.DB.Get(key)
 	if closer != nil {
 		closer.Close()
 	}
 	if errors.Is(err, pebble.ErrNotFound) {
-		return false
+		return false, nil
 	}
 	if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
-	return true
+	return true, nil
+}
+
+func (t *Table) Close() error {
+	return t.DB.Close()
 }
 
-func (t *Table) Close() {
-	if err := t.DB.Close(); err != nil {
-		log.Fatal(err)
+// pebbleGet returns a copy of the value for key, or nil if key is missing.
+func pebbleGet(db *pebble.DB, key []byte) ([]byte, error) {
+	b, c, err := db.Get(key)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+
+	out := make([]byte, len(b))
+	copy(out, b)
+
+	if err := c.Close(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
 }
@@ -1,7 +1,9 @@
 package ethdataset
 
 import (
+	"errors"
 	"log"
+	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/trie"
@@ -10,48 +12,105 @@ import (
 type VerifyConfig struct {
 	StateRoot string `toml:"state_root"`
 	WorkDir   string `toml:"work_dir"`
+
+	VerifyRunConfig VerifyRunConfig `toml:"verify_config"`
+	PebbleConfig    PebbleConfig    `toml:"pebble_config"`
+}
+
+func (c *VerifyConfig) Defaults() {
+	c.VerifyRunConfig.defaults()
+	c.PebbleConfig.defaults(ProfileReadMostly)
 }
 
-func Verify(cfg VerifyConfig) {
+func (c *VerifyConfig) Validate() error {
+	return errors.Join(
+		requireField("state_root", c.StateRoot),
+		validateHash("state_root", c.StateRoot),
+		requireField("work_dir", c.WorkDir),
+		c.VerifyRunConfig.validate("verify_config"),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+}
+
+func Verify(cfg VerifyConfig) error {
 	stateRoot := common.HexToHash(cfg.StateRoot)
 	log.Printf("StateRoot=%v\n", stateRoot)
+	m, err := requireTables(cfg.WorkDir, "accountToProof", "idToProofSegment")
+	if err != nil {
+		return err
+	}
+	if err := requireStateRoot(cfg.WorkDir, m, cfg.StateRoot); err != nil {
+		return err
+	}
 
 	log.Println("Opening DBs")
 
-	accountToProof := openPebbleDB(cfg.WorkDir, "accountToProof")
-	iter, err := accountToProof.NewIter(nil)
+	accountToProof, err := openPebbleDBReadOnly(cfg.WorkDir, "accountToProof", cfg.PebbleConfig)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer accountToProof.Close()
 
-	proofDeduper := NewProofDeduper(cfg.WorkDir)
-
-	log.Println("Starting iteration")
-
-	nVerified := 0
-	for iter.First(); iter.Valid(); iter.Next() {
-		addressHashBytes := iter.Key()
-
-		proofIdBytes := iter.Value()
-		proofIds := bytesToUint64(proofIdBytes)
+	proofDeduper, err := OpenProofDBReadOnly(cfg.WorkDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer proofDeduper.Close()
+
+	err = runVerification(cfg.VerifyRunConfig, cfg.WorkDir, "verify", pebbleCursor(accountToProof), m.Tables["accountToProof"].NRecords, func(addressHashBytes, proofIdBytes []byte, r *AccountReport) error {
+		_, err := verifyAccountProof(r, proofDeduper, stateRoot, addressHashBytes, proofIdBytes)
+		return err
+	})
+	if m.Tables["absentToProof"] == nil {
+		return err
+	}
+	return errors.Join(err, verifyExclusionProofs(cfg, proofDeduper, stateRoot))
+}
 
-		proofBytes := proofDeduper.RecoverProof(proofIds)
-		pdb := NewProofKV(proofBytes)
+// verifyExclusionProofs checks that every proof in absentToProof shows its
+// address hash has no account, with its own report.
+func verifyExclusionProofs(cfg VerifyConfig, proofDB *ProofDB, stateRoot common.Hash) error {
+	m, err := requireTables(cfg.WorkDir, "absentToProof")
+	if err != nil {
+		return err
+	}
+	absentToProof, err := openPebbleDBReadOnly(cfg.WorkDir, "absentToProof", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer absentToProof.Close()
 
-		if _, err := trie.VerifyProof(stateRoot, addressHashBytes, pdb); err != nil {
-			log.Fatal(err)
-		}
+	// Don't overwrite the account proofs' report.
+	runCfg := cfg.VerifyRunConfig
+	if runCfg.ReportPath != "" {
+		runCfg.ReportPath = strings.TrimSuffix(runCfg.ReportPath, ".jsonl") + "-absent.jsonl"
+	}
 
-		nVerified += 1
+	log.Println("Verifying exclusion proofs")
+	return runVerification(runCfg, cfg.WorkDir, "verify-absent", pebbleCursor(absentToProof), m.Tables["absentToProof"].NRecords, func(addressHashBytes, proofIdBytes []byte, r *AccountReport) error {
+		return verifyExclusionProof(r, proofDB, stateRoot, addressHashBytes, proofIdBytes)
+	})
+}
 
-		if nVerified != 0 && nVerified%10_000 == 0 {
-			log.Printf("Verified nVerified=%v\n", nVerified)
-		}
+// verifyAccountProof recovers an account's proof from its proof ids and
+// verifies it against stateRoot, returning the proven account.
+func verifyAccountProof(r *AccountReport, proofDB *ProofDB, stateRoot common.Hash, addressHashBytes, proofIdBytes []byte) ([]byte, error) {
+	proofBytes, err := proofDB.RecoverProof(bytesToUint64(proofIdBytes))
+	if errors.Is(err, ErrNotFound) {
+		r.fail(FailureMissingProofId, nil, "%v", err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	log.Printf("Verification complete nVerified=%v\n", nVerified)
-
-	if err := iter.Close(); err != nil {
-		log.Fatal(err)
+	value, err := trie.VerifyProof(stateRoot, addressHashBytes, NewProofKV(proofBytes))
+	if err != nil {
+		r.fail(FailureBadProof, nil, "%v", err)
+		return nil, nil
+	}
+	if value == nil {
+		r.fail(FailureBadProof, nil, "proof shows the account is absent")
 	}
+	return value, nil
 }
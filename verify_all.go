@@ -2,110 +2,167 @@ package ethdataset
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"log"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rlp"
-	"github.com/ethereum/go-ethereum/trie"
 )
 
 type VerifyAllConfig struct {
 	StateRoot   string      `toml:"state_root"`
 	WorkDir     string      `toml:"work_dir"`
 	ChainConfig ChainConfig `toml:"chain_config"`
+	// StorageProofDir, if set, is the output_dir of export storage-proofs and
+	// every storage slot proof in it is verified too.
+	StorageProofDir string `toml:"storage_proof_dir"`
+
+	VerifyRunConfig VerifyRunConfig `toml:"verify_config"`
+	PebbleConfig    PebbleConfig    `toml:"pebble_config"`
+}
+
+func (c *VerifyAllConfig) Defaults() {
+	c.VerifyRunConfig.defaults()
+	c.PebbleConfig.defaults(ProfileReadMostly)
+}
+
+func (c *VerifyAllConfig) Validate() error {
+	return errors.Join(
+		requireField("state_root", c.StateRoot),
+		validateHash("state_root", c.StateRoot),
+		requireField("work_dir", c.WorkDir),
+		c.ChainConfig.validate("chain_config"),
+		c.VerifyRunConfig.validate("verify_config"),
+		c.PebbleConfig.validate("pebble_config"),
+	)
 }
 
-func VerifyAll(cfg VerifyAllConfig) {
+func VerifyAll(cfg VerifyAllConfig) error {
 	log.Println("Opening Node")
-	stack := newNode(cfg.ChainConfig.DataDir)
-	chainDB := newChainDB(cfg.ChainConfig.AncientsDir, stack)
-	newTrieDB(stack, chainDB)
+	_, chainDB, _, err := openChain(cfg.ChainConfig)
+	if err != nil {
+		return err
+	}
 	log.Println("Opened Node")
 
-	header := rawdb.ReadHeadHeader(chainDB)
+	// Without an explicit pin, look for the configured root on the chain rather
+	// than requiring it to be the head.
+	chainConfig := cfg.ChainConfig
+	if !chainConfig.IsPinned() {
+		chainConfig.StateRoot = cfg.StateRoot
+	}
+	header, err := resolveHeader(chainConfig, chainDB)
+	if err != nil {
+		return err
+	}
 	gotStateRoot := header.Root
 
 	stateRoot := common.HexToHash(cfg.StateRoot)
 	if gotStateRoot != stateRoot {
-		log.Fatalf("Got unexpected StateRoot, got=%v, want=%v\n", gotStateRoot, stateRoot)
+		return fmt.Errorf("got unexpected StateRoot, got=%v, want=%v", gotStateRoot, stateRoot)
+	}
+	m, err := requireTables(cfg.WorkDir, "accounts", "code", "storage", "accountToProof", "idToProofSegment")
+	if err != nil {
+		return err
+	}
+	if err := requireStateRoot(cfg.WorkDir, m, cfg.StateRoot); err != nil {
+		return err
 	}
 	log.Printf("Verified StateRoot=%v.\n", stateRoot)
 
 	log.Println("Opening DBs")
 
-	accountDB := openPebbleDB(cfg.WorkDir, "accounts")
-	codeDB := openPebbleDB(cfg.WorkDir, "code")
-	storageDB := openPebbleDB(cfg.WorkDir, "storage")
-	accountToProof := openPebbleDB(cfg.WorkDir, "accountToProof")
-	proofDB := NewProofDeduper(cfg.WorkDir)
-
-	iter, err := accountDB.NewIter(nil)
+	accountDB, err := openPebbleDBReadOnly(cfg.WorkDir, "accounts", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer accountDB.Close()
+	codeDB, err := openPebbleDBReadOnly(cfg.WorkDir, "code", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer codeDB.Close()
+	storageDB, err := openPebbleDBReadOnly(cfg.WorkDir, "storage", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer storageDB.Close()
+	accountToProof, err := openPebbleDBReadOnly(cfg.WorkDir, "accountToProof", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer accountToProof.Close()
+	proofDB, err := OpenProofDBReadOnly(cfg.WorkDir, cfg.PebbleConfig)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer proofDB.Close()
 
-	log.Println("Starting iteration")
+	var storageVerifier *storageProofVerifier
+	if cfg.StorageProofDir != "" {
+		storageVerifier, err = openStorageProofVerifier(storageDB, cfg.StorageProofDir, cfg.PebbleConfig)
+		if err != nil {
+			return err
+		}
+		defer storageVerifier.Close()
+	}
 
-	nVerified := 0
-	for iter.First(); iter.Valid(); iter.Next() {
-		addressHashBytes := iter.Key()
-		accountBytes := iter.Value()
+	stats, err := codeTableStats(codeDB)
+	if err != nil {
+		return err
+	}
+	stats.log()
 
+	return runVerification(cfg.VerifyRunConfig, cfg.WorkDir, "verify-all", pebbleCursor(accountDB), m.Tables["accounts"].NRecords, func(addressHashBytes, accountBytes []byte, r *AccountReport) error {
 		var account SlimAccount
 		if err := rlp.DecodeBytes(accountBytes, &account); err != nil {
-			log.Fatal(err)
+			return corruptRecord("accounts", addressHashBytes, err)
 		}
 
 		if !bytes.Equal(account.CodeHash, types.EmptyCodeHash.Bytes()) {
-			b, c, err := codeDB.Get(account.CodeHash)
+			code, err := pebbleGet(codeDB, account.CodeHash)
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
-			if len(b) == 0 {
-				log.Fatalf("Missing code @ %v\n", account.CodeHash)
-			}
-			c.Close()
+			checkCode(r, account.CodeHash, code)
 		}
 
-		if !bytes.Equal(account.Root, types.EmptyRootHash.Bytes()) {
+		if storageVerifier != nil && !bytes.Equal(account.Root, types.EmptyRootHash.Bytes()) {
+			if err := storageVerifier.verifyAccount(r, common.BytesToHash(account.Root)); err != nil {
+				return err
+			}
+		} else if !bytes.Equal(account.Root, types.EmptyRootHash.Bytes()) {
 			storageIter, err := storageDB.NewIter(PrefixIterOptions(addressHashBytes))
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
-			ok := false
-			for storageIter.First(); storageIter.Valid(); storageIter.Next() {
-				ok = true
+			ok := storageIter.First()
+			if err := storageIter.Close(); err != nil {
+				return err
 			}
 			if !ok {
-				log.Fatal("Missing storage slots!")
+				r.fail(FailureMissingStorage, nil, "non-empty storage root but no slots exported")
 			}
 		}
 
-		proofIdBytes, c, err := accountToProof.Get(addressHashBytes)
+		proofIdBytes, err := pebbleGet(accountToProof, addressHashBytes)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		proofIds := bytesToUint64(proofIdBytes)
-		c.Close()
-
-		proofBytes := proofDB.RecoverProof(proofIds)
-
-		if _, err := trie.VerifyProof(stateRoot, addressHashBytes, NewProofKV(proofBytes)); err != nil {
-			log.Fatal(err)
+		if proofIdBytes == nil {
+			r.fail(FailureMissingProofId, nil, "%v", notFound("accountToProof", addressHashBytes))
+			return nil
 		}
 
-		nVerified += 1
-
-		if nVerified != 0 && nVerified%10_000 == 0 {
-			log.Printf("Verified nVerified=%v\n", nVerified)
+		value, err := verifyAccountProof(r, proofDB, stateRoot, addressHashBytes, proofIdBytes)
+		if err != nil {
+			return err
 		}
-	}
-
-	log.Printf("Verification complete nVerified=%v\n", nVerified)
-
-	if err := iter.Close(); err != nil {
-		log.Fatal(err)
-	}
+		if value != nil && !bytes.Equal(value, accountBytes) {
+			r.fail(FailureValueMismatch, nil, "proven account %x does not match stored account %x", value, accountBytes)
+		}
+		return nil
+	})
 }
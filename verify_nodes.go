@@ -0,0 +1,125 @@
+package ethdataset
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+type VerifyNodeEncodingConfig struct {
+	WorkDir string `toml:"work_dir"`
+	// Scope selects the ProofDB, e.g. "storage", empty for accounts.
+	Scope string `toml:"scope"`
+	// SampleCount is how many random segments to check, 0 for all of them.
+	SampleCount int   `toml:"sample_count"`
+	Seed        int64 `toml:"seed"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *VerifyNodeEncodingConfig) Defaults() {
+	c.SampleCount = 100_000
+	c.PebbleConfig.defaults(ProfileReadMostly)
+}
+
+func (c *VerifyNodeEncodingConfig) Validate() error {
+	var errs []error
+	errs = append(errs, requireField("work_dir", c.WorkDir))
+	if c.SampleCount < 0 {
+		errs = append(errs, &ConfigError{Field: "sample_count", Reason: "must not be negative"})
+	}
+	errs = append(errs, c.PebbleConfig.validate("pebble_config"))
+	return errors.Join(errs...)
+}
+
+// checkNodeEncoding parses segment and re-encodes it, returning an error if
+// the result isn't byte for byte the same or hashes differently.
+func checkNodeEncoding(segment []byte) error {
+	node, err := ParseNode(segment)
+	if err != nil {
+		return err
+	}
+	if encoded := node.Encode(); !bytes.Equal(encoded, segment) {
+		return fmt.Errorf("re-encoded as %x", encoded)
+	}
+	if want := crypto.Keccak256Hash(segment); node.Hash() != want {
+		return fmt.Errorf("hash %v, want %v", node.Hash(), want)
+	}
+	return nil
+}
+
+// VerifyNodeEncoding checks that parsing and re-encoding proof segments is
+// lossless: every sampled segment of idToProofSegment must come back out of
+// ParseNode and MPTNode.Encode byte for byte, embedded children included.
+func VerifyNodeEncoding(cfg VerifyNodeEncodingConfig) error {
+	index, err := detectProofIndex(cfg.WorkDir, cfg.Scope)
+	if err != nil {
+		return err
+	}
+	_, idToSegmentName := proofTableNames(cfg.Scope, index)
+	m, err := requireTables(cfg.WorkDir, idToSegmentName)
+	if err != nil {
+		return err
+	}
+	lastId := m.Tables[idToSegmentName].lastId()
+
+	db, err := openPebbleDBReadOnly(cfg.WorkDir, idToSegmentName, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var nChecked, nFailed uint64
+	check := func(id, segment []byte) {
+		nChecked += 1
+		if err := checkNodeEncoding(segment); err != nil {
+			nFailed += 1
+			if nFailed <= 10 {
+				log.Printf("segment %v (%x): %v\n", bytesToUint64(id), segment, err)
+			}
+		}
+		if nChecked%1_000_000 == 0 {
+			log.Printf("nChecked=%v nFailed=%v\n", nChecked, nFailed)
+		}
+	}
+
+	start := time.Now()
+	if cfg.SampleCount == 0 {
+		iter, err := db.NewIter(nil)
+		if err != nil {
+			return err
+		}
+		for iter.First(); iter.Valid(); iter.Next() {
+			check(iter.Key(), iter.Value())
+		}
+		if err := errors.Join(iter.Error(), iter.Close()); err != nil {
+			return err
+		}
+	} else if lastId > 0 {
+		rng := rand.New(rand.NewSource(cfg.Seed))
+		for misses := 0; nChecked < uint64(cfg.SampleCount) && misses < 1_000_000; {
+			key := uint64ToKey(uint64(rng.Int63n(int64(lastId))) + 1)
+			segment, err := pebbleGet(db, key)
+			if err != nil {
+				return err
+			}
+			if segment == nil {
+				// A gap left by resuming, sharding or gc.
+				misses += 1
+				continue
+			}
+			check(key, segment)
+		}
+	}
+
+	log.Printf("Checked nSegments=%v in %v, nFailed=%v\n", nChecked, time.Since(start), nFailed)
+	if nFailed > 0 {
+		return fmt.Errorf("%w: %v of %v segments don't round trip", ErrVerificationFailed, nFailed, nChecked)
+	}
+	return nil
+}
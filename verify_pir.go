@@ -0,0 +1,349 @@
+package ethdataset
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+type VerifyPIRConfig struct {
+	StateRoot string `toml:"state_root"`
+	// PIRDir is the out_dir of pir generate.
+	PIRDir string `toml:"pir_dir"`
+
+	VerifyRunConfig VerifyRunConfig `toml:"verify_config"`
+}
+
+func (c *VerifyPIRConfig) Defaults() {
+	c.VerifyRunConfig.defaults()
+}
+
+func (c *VerifyPIRConfig) Validate() error {
+	return errors.Join(
+		requireField("state_root", c.StateRoot),
+		validateHash("state_root", c.StateRoot),
+		requireField("pir_dir", c.PIRDir),
+		c.VerifyRunConfig.validate("verify_config"),
+	)
+}
+
+// FileTableReader reads back the records of a FileTable.
+type FileTableReader struct {
+	f        *os.File
+	metadata FileTableMetadata
+}
+
+func OpenFileTableReader(path, name string) (*FileTableReader, error) {
+	metadataFile, err := os.Open(filepath.Join(path, fmt.Sprintf("%v.metadata.json", name)))
+	if err != nil {
+		return nil, err
+	}
+	defer metadataFile.Close()
+
+	// The metadata file is appended to every time the table is closed, the
+	// last line describes the table as a whole.
+	var metadata FileTableMetadata
+	found := false
+	scanner := bufio.NewScanner(metadataFile)
+	for scanner.Scan() {
+		if err := json.Unmarshal(scanner.Bytes(), &metadata); err != nil {
+			return nil, corruptRecord(metadataFile.Name(), nil, err)
+		}
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, corruptRecord(metadataFile.Name(), nil, errors.New("no metadata"))
+	}
+
+	f, err := os.Open(filepath.Join(path, fmt.Sprintf("%v.bin", name)))
+	if err != nil {
+		return nil, err
+	}
+	return &FileTableReader{f: f, metadata: metadata}, nil
+}
+
+func (t *FileTableReader) Len() uint32 {
+	return t.metadata.NRecords
+}
+
+// Get returns row rowId, or an error wrapping ErrNotFound if there is no such
+// row. It is safe for concurrent use.
+func (t *FileTableReader) Get(rowId uint32) ([]byte, error) {
+	if rowId >= t.metadata.NRecords {
+		return nil, notFound(t.f.Name(), uint64ToKey(uint64(rowId)))
+	}
+	recordSize := t.metadata.RecordSize
+	buf := make([]byte, recordSize)
+	if _, err := t.f.ReadAt(buf, int64(rowId)*int64(recordSize)); err != nil {
+		return nil, err
+	}
+	padding := binary.LittleEndian.Uint16(buf)
+	if int(padding) > recordSize-sizeOfPaddingCounter {
+		return nil, corruptRecord(t.f.Name(), uint64ToKey(uint64(rowId)), fmt.Errorf("padding %v exceeds record size %v", padding, recordSize))
+	}
+	return buf[sizeOfPaddingCounter : recordSize-int(padding)], nil
+}
+
+func (t *FileTableReader) Close() error {
+	return t.f.Close()
+}
+
+// pirDataset is the output of GeneratePIRDataset opened for reading.
+type pirDataset struct {
+	accounts []*FileTableReader
+	// offsets[i] is the global row of the first record of accounts[i].
+	offsets  []uint64
+	nRecords uint64
+
+	treeTop *FileTableReader
+	buckets []*FileTableReader
+}
+
+func openPIRDataset(dir string) (*pirDataset, error) {
+	d := &pirDataset{}
+	ok := false
+	defer func() {
+		if !ok {
+			d.Close()
+		}
+	}()
+
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("accounts-pir-%v", i)
+		if _, err := os.Stat(filepath.Join(dir, name+".bin")); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		t, err := OpenFileTableReader(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		d.accounts = append(d.accounts, t)
+		d.offsets = append(d.offsets, d.nRecords)
+		d.nRecords += uint64(t.Len())
+	}
+	if len(d.accounts) == 0 {
+		return nil, fmt.Errorf("%v: no accounts-pir shards", dir)
+	}
+
+	var err error
+	if d.treeTop, err = OpenFileTableReader(dir, "treeTop"); err != nil {
+		return nil, err
+	}
+	for i := 0; i < nBuckets; i++ {
+		t, err := OpenFileTableReader(dir, fmt.Sprintf("account-proofs-%v", i))
+		if err != nil {
+			return nil, err
+		}
+		d.buckets = append(d.buckets, t)
+	}
+	ok = true
+	return d, nil
+}
+
+// account returns global row i of the account shards.
+func (d *pirDataset) account(i uint64) ([]byte, error) {
+	shard := sort.Search(len(d.offsets), func(j int) bool { return d.offsets[j] > i }) - 1
+	return d.accounts[shard].Get(uint32(i - d.offsets[shard]))
+}
+
+// search returns the first row whose address hash is at or after key. Rows
+// are written in address hash order.
+func (d *pirDataset) search(key []byte) (uint64, error) {
+	var err error
+	i := sort.Search(int(d.nRecords), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var record []byte
+		record, err = d.account(uint64(i))
+		return bytes.Compare(record[:sizeOfAddressHash], key) >= 0
+	})
+	return uint64(i), err
+}
+
+// proof reads the segments at bucketIndexes. Records pad their bucket indexes
+// with zeros, which is also the index of the first row of bucket 0, so a zero
+// index is read once and skipped if there is no such row.
+func (d *pirDataset) proof(bucketIndexes []BucketIndex) ([][]byte, error) {
+	var proof [][]byte
+	seenZero := false
+	for _, bucketIndex := range bucketIndexes {
+		var (
+			buf []byte
+			err error
+		)
+		isZero := bucketIndex == BucketIndex{}
+		if isZero && seenZero {
+			continue
+		}
+		seenZero = seenZero || isZero
+		switch {
+		case bucketIndex.BucketId == 255:
+			buf, err = d.treeTop.Get(bucketIndex.RowId)
+		case int(bucketIndex.BucketId) < len(d.buckets):
+			buf, err = d.buckets[bucketIndex.BucketId].Get(bucketIndex.RowId)
+		default:
+			err = fmt.Errorf("bucket %v: %w", bucketIndex.BucketId, ErrNotFound)
+		}
+		if isZero && errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		proof = append(proof, buf)
+	}
+	return proof, nil
+}
+
+func (d *pirDataset) Close() error {
+	var errs []error
+	for _, t := range d.accounts {
+		errs = append(errs, t.Close())
+	}
+	if d.treeTop != nil {
+		errs = append(errs, d.treeTop.Close())
+	}
+	for _, t := range d.buckets {
+		errs = append(errs, t.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// cursor walks the rows of d in [lower, upper).
+func (d *pirDataset) cursor(lower, upper []byte) (recordCursor, error) {
+	c := &pirCursor{d: d, hi: d.nRecords}
+	if lower != nil {
+		if c.lo, c.err = d.search(lower); c.err != nil {
+			return nil, c.err
+		}
+	}
+	if upper != nil {
+		if c.hi, c.err = d.search(upper); c.err != nil {
+			return nil, c.err
+		}
+	}
+	c.i = c.hi
+	return c, nil
+}
+
+type pirCursor struct {
+	d      *pirDataset
+	lo, hi uint64
+	i      uint64
+	record []byte
+	err    error
+}
+
+func (c *pirCursor) load() bool {
+	if c.err != nil || c.i >= c.hi {
+		c.record = nil
+		return false
+	}
+	c.record, c.err = c.d.account(c.i)
+	return c.err == nil
+}
+
+func (c *pirCursor) First() bool {
+	c.i = c.lo
+	return c.load()
+}
+
+func (c *pirCursor) SeekGE(key []byte) bool {
+	i, err := c.d.search(key)
+	if err != nil {
+		c.err = err
+		return false
+	}
+	c.i = max(i, c.lo)
+	return c.load()
+}
+
+func (c *pirCursor) Next() bool {
+	c.i += 1
+	return c.load()
+}
+
+func (c *pirCursor) Valid() bool   { return c.record != nil }
+func (c *pirCursor) Key() []byte   { return c.record[:sizeOfAddressHash] }
+func (c *pirCursor) Value() []byte { return c.record }
+func (c *pirCursor) Error() error  { return c.err }
+func (c *pirCursor) Close() error  { return nil }
+
+// VerifyPIR reads account records back out of a generated PIR dataset,
+// reassembles each proof from the tree top and buckets and verifies it against
+// the state root. Records of absent accounts must carry an exclusion proof.
+func VerifyPIR(cfg VerifyPIRConfig) error {
+	m, err := requireTables(cfg.PIRDir, "accounts-pir", "treeTop", "account-proofs")
+	if err != nil {
+		return err
+	}
+	if err := requireStateRoot(cfg.PIRDir, m, cfg.StateRoot); err != nil {
+		return err
+	}
+	stateRoot := common.HexToHash(cfg.StateRoot)
+
+	log.Println("Opening PIR dataset")
+	d, err := openPIRDataset(cfg.PIRDir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return runVerification(cfg.VerifyRunConfig, cfg.PIRDir, "verify-pir", d.cursor, d.nRecords, func(addressHashBytes, record []byte, r *AccountReport) error {
+		if len(record) < sizeOfAccountPirRecord {
+			r.fail(FailureValueMismatch, nil, "record is %v bytes, want %v", len(record), sizeOfAccountPirRecord)
+			return nil
+		}
+		account := record[sizeOfAddressHash : sizeOfAddressHash+sizeOfAccount]
+		bucketIndexes := bucketIndexesFromBytes(record[sizeOfAddressHash+sizeOfAccount:], nBuckets)
+
+		proof, err := d.proof(bucketIndexes)
+		if errors.Is(err, ErrNotFound) {
+			r.fail(FailureMissingProofId, nil, "%v", err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		value, err := trie.VerifyProof(stateRoot, addressHashBytes, NewProofKV(proof))
+		absent := pirRecordAbsent(account)
+		switch {
+		case err != nil:
+			r.fail(FailureBadProof, nil, "%v", err)
+		case absent && value != nil:
+			r.fail(FailureValueMismatch, nil, "record says the account is absent, proof shows %x", value)
+		case absent && !allZero(account):
+			r.fail(FailureValueMismatch, nil, "absent account record %x is not all zeros", account)
+		case absent:
+		case value == nil:
+			r.fail(FailureBadProof, nil, "proof shows the account is absent")
+		case len(value) > len(account) || !bytes.Equal(value, account[:len(value)]) || !allZero(account[len(value):]):
+			r.fail(FailureValueMismatch, nil, "proven account %x does not match record %x", value, account)
+		}
+		return nil
+	})
+}
+
+func allZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
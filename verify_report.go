@@ -0,0 +1,416 @@
+package ethdataset
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type VerifyRunConfig struct {
+	// NWorkers is the number of goroutines verifying address hash ranges.
+	NWorkers int `toml:"n_workers"`
+	// MaxFailures stops verification once this many failures were found, 0
+	// to always verify everything.
+	MaxFailures uint64 `toml:"max_failures"`
+	// ReportPath is where the JSONL failure report is written, by default
+	// <name>-report.jsonl in the work dir.
+	ReportPath string `toml:"report_path"`
+
+	// SampleCount or SampleRate, a fraction of the records, verify only a
+	// sample of address hashes drawn uniformly from the keyspace with Seed.
+	// Each verifies the record at or after it, once.
+	SampleCount uint64  `toml:"sample_count"`
+	SampleRate  float64 `toml:"sample_rate"`
+	Seed        int64   `toml:"seed"`
+}
+
+// verifyRangeNibbles splits the keyspace into 16^2 ranges for the workers.
+const verifyRangeNibbles = 2
+
+func (c *VerifyRunConfig) defaults() {
+	c.NWorkers = runtime.NumCPU()
+}
+
+func (c VerifyRunConfig) validate(prefix string) error {
+	var errs []error
+	if c.NWorkers < 1 {
+		errs = append(errs, &ConfigError{Field: prefix + ".n_workers", Reason: "must be at least 1"})
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		errs = append(errs, &ConfigError{Field: prefix + ".sample_rate", Reason: "must be between 0 and 1"})
+	}
+	if c.SampleRate > 0 && c.SampleCount > 0 {
+		errs = append(errs, &ConfigError{Field: prefix + ".sample_rate", Reason: "can't be set together with sample_count"})
+	}
+	return errors.Join(errs...)
+}
+
+func (c VerifyRunConfig) reportPath(workDir, name string) string {
+	if c.ReportPath != "" {
+		return c.ReportPath
+	}
+	return filepath.Join(workDir, name+"-report.jsonl")
+}
+
+// FailureClass says why a record failed verification.
+type FailureClass string
+
+const (
+	// FailureMissingProofId is a record without proof ids or whose ids aren't
+	// in idToProofSegment.
+	FailureMissingProofId FailureClass = "missing_proof_id"
+	// FailureBadProof is a proof that doesn't verify against its root.
+	FailureBadProof FailureClass = "bad_proof"
+	// FailureMissingCode is an account whose code isn't in the code table.
+	FailureMissingCode FailureClass = "missing_code"
+	// FailureMissingStorage is an account or proven slot without exported
+	// storage.
+	FailureMissingStorage FailureClass = "missing_storage"
+	// FailureValueMismatch is a proof whose value differs from the exported one.
+	FailureValueMismatch FailureClass = "value_mismatch"
+	// FailureStorageRootMismatch is an account whose exported slots don't
+	// hash to its storage root.
+	FailureStorageRootMismatch FailureClass = "storage_root_mismatch"
+)
+
+// VerifyFailure is one line of the failure report.
+type VerifyFailure struct {
+	Type    string       `json:"type"`
+	Account common.Hash  `json:"account"`
+	Slot    *common.Hash `json:"slot,omitempty"`
+	Class   FailureClass `json:"class"`
+	Detail  string       `json:"detail"`
+}
+
+// VerifySummary is the last line of the failure report.
+type VerifySummary struct {
+	Type            string                  `json:"type"`
+	NAccounts       uint64                  `json:"n_accounts"`
+	NSlots          uint64                  `json:"n_slots"`
+	NFailedAccounts uint64                  `json:"n_failed_accounts"`
+	NFailures       uint64                  `json:"n_failures"`
+	ByClass         map[FailureClass]uint64 `json:"by_class"`
+	// Stopped is set when verification stopped at max_failures.
+	Stopped bool `json:"stopped"`
+
+	// NSamples and Seed are set when only a sample was verified, and
+	// Confidence says what the sample says about the whole table. Samples
+	// landing on a record that was already verified are skipped, so
+	// NAccounts counts distinct records and can be below NSamples.
+	NSamples   uint64 `json:"n_samples,omitempty"`
+	Seed       int64  `json:"seed,omitempty"`
+	Confidence string `json:"confidence,omitempty"`
+}
+
+// AccountReport collects the failures found for one account.
+type AccountReport struct {
+	Account  common.Hash
+	NSlots   int
+	Failures []VerifyFailure
+}
+
+func (r *AccountReport) fail(class FailureClass, slot []byte, format string, args ...interface{}) {
+	f := VerifyFailure{
+		Type:    "failure",
+		Account: r.Account,
+		Class:   class,
+		Detail:  fmt.Sprintf(format, args...),
+	}
+	if slot != nil {
+		h := common.BytesToHash(slot)
+		f.Slot = &h
+	}
+	r.Failures = append(r.Failures, f)
+}
+
+// VerifyReport writes failures to a JSONL file as they are found and keeps
+// the totals for the summary.
+type VerifyReport struct {
+	path        string
+	maxFailures uint64
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	enc     *json.Encoder
+	summary VerifySummary
+}
+
+func NewVerifyReport(path string, maxFailures uint64) (*VerifyReport, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &VerifyReport{
+		path:        path,
+		maxFailures: maxFailures,
+		f:           f,
+		w:           w,
+		enc:         json.NewEncoder(w),
+		summary: VerifySummary{
+			Type:    "summary",
+			ByClass: make(map[FailureClass]uint64),
+		},
+	}, nil
+}
+
+// Add records an account's outcome. It returns false once max_failures has
+// been reached.
+func (r *VerifyReport) Add(a *AccountReport) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.summary.NAccounts += 1
+	r.summary.NSlots += uint64(a.NSlots)
+	if len(a.Failures) > 0 {
+		r.summary.NFailedAccounts += 1
+	}
+	for _, f := range a.Failures {
+		if err := r.enc.Encode(f); err != nil {
+			return false, err
+		}
+		r.summary.NFailures += 1
+		r.summary.ByClass[f.Class] += 1
+	}
+	if r.maxFailures > 0 && r.summary.NFailures >= r.maxFailures {
+		r.summary.Stopped = true
+		return false, nil
+	}
+	return true, nil
+}
+
+// Close writes the summary line and closes the report.
+func (r *VerifyReport) Close() (VerifySummary, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.enc.Encode(r.summary)
+	if flushErr := r.w.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := r.f.Close(); err == nil {
+		err = closeErr
+	}
+	return r.summary, err
+}
+
+// Err summarises the report as an error wrapping ErrVerificationFailed, or
+// nil if nothing failed.
+func (s VerifySummary) Err(path string) error {
+	if s.NFailures == 0 {
+		return nil
+	}
+	stopped := ""
+	if s.Stopped {
+		stopped = ", stopped at max_failures"
+	}
+	return fmt.Errorf("%w: %v failures in %v of %v accounts%v, see %v", ErrVerificationFailed, s.NFailures, s.NFailedAccounts, s.NAccounts, stopped, path)
+}
+
+func (s VerifySummary) log() {
+	log.Printf("nAccounts=%v nSlots=%v nFailedAccounts=%v nFailures=%v\n", s.NAccounts, s.NSlots, s.NFailedAccounts, s.NFailures)
+	for class, n := range s.ByClass {
+		log.Printf("  %v=%v\n", class, n)
+	}
+	if s.Confidence != "" {
+		log.Println(s.Confidence)
+	}
+}
+
+// recordCursor walks records in key order. *pebble.Iterator is one.
+type recordCursor interface {
+	First() bool
+	SeekGE(key []byte) bool
+	Next() bool
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+	Close() error
+}
+
+// newCursorFunc opens a cursor over the records in [lower, upper), with nil
+// bounds being unbounded.
+type newCursorFunc func(lower, upper []byte) (recordCursor, error)
+
+func pebbleCursor(db *pebble.DB) newCursorFunc {
+	return func(lower, upper []byte) (recordCursor, error) {
+		return db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	}
+}
+
+type checkFunc func(key, value []byte, r *AccountReport) error
+
+// verifyTable runs check over the records of a table keyed by address hash on
+// cfg.NWorkers goroutines and records the outcomes in report. Every record is
+// checked unless samples is set, in which case the record at or after each
+// sample key is, and every record at most once. Failures found by check don't
+// stop verification, errors reading the tables do.
+func verifyTable(cfg VerifyRunConfig, newCursor newCursorFunc, samples [][]byte, report *VerifyReport, check checkFunc) error {
+	type job struct {
+		kr     KeyRange
+		sample []byte
+	}
+	jobs := make(chan job)
+	go func() {
+		defer close(jobs)
+		if samples != nil {
+			for _, s := range samples {
+				jobs <- job{sample: s}
+			}
+			return
+		}
+		for _, kr := range NibblePrefixRanges(verifyRangeNibbles) {
+			jobs <- job{kr: kr}
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		total    atomic.Uint64
+		stop     atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+
+		// seen holds the keys of the sampled records, so that samples
+		// landing in the same gap between records count once.
+		seenMu sync.Mutex
+		seen   = make(map[string]bool)
+	)
+
+	visit := func(c recordCursor) error {
+		a := &AccountReport{Account: common.BytesToHash(c.Key())}
+		if err := check(c.Key(), c.Value(), a); err != nil {
+			return err
+		}
+		ok, err := report.Add(a)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			stop.Store(true)
+		}
+
+		if n := total.Add(1); n%100_000 == 0 {
+			log.Printf("Verified n=%v\n", n)
+		}
+		return nil
+	}
+
+	verifyRange := func(kr KeyRange) error {
+		c, err := newCursor(kr.Start, kr.End)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		for c.First(); c.Valid() && !stop.Load(); c.Next() {
+			if err := visit(c); err != nil {
+				return err
+			}
+		}
+		return c.Error()
+	}
+
+	// verifySample checks the record at or after key, wrapping around to the
+	// first record, unless another sample already did.
+	verifySample := func(c recordCursor, key []byte) error {
+		if !c.SeekGE(key) && !c.First() {
+			return c.Error()
+		}
+		seenMu.Lock()
+		dup := seen[string(c.Key())]
+		seen[string(c.Key())] = true
+		seenMu.Unlock()
+		if dup {
+			return nil
+		}
+		return visit(c)
+	}
+
+	worker := func() error {
+		var c recordCursor
+		if samples != nil {
+			var err error
+			if c, err = newCursor(nil, nil); err != nil {
+				return err
+			}
+			defer c.Close()
+		}
+		for j := range jobs {
+			if stop.Load() {
+				continue
+			}
+			var err error
+			if c != nil {
+				err = verifySample(c, j.sample)
+			} else {
+				err = verifyRange(j.kr)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for w := 0; w < max(cfg.NWorkers, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := worker(); err != nil {
+				errOnce.Do(func() { firstErr = err })
+				stop.Store(true)
+				// Drain so the producer isn't left blocked.
+				for range jobs {
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// runVerification opens the report for name, runs verifyTable over the
+// nRecords records of a table and turns the summary into the returned error.
+func runVerification(cfg VerifyRunConfig, workDir, name string, newCursor newCursorFunc, nRecords uint64, check checkFunc) error {
+	path := cfg.reportPath(workDir, name)
+	report, err := NewVerifyReport(path, cfg.MaxFailures)
+	if err != nil {
+		return err
+	}
+
+	samples := cfg.samples(nRecords)
+	if samples != nil {
+		report.summary.NSamples = uint64(len(samples))
+		report.summary.Seed = cfg.Seed
+		log.Printf("Sampling nSamples=%v of nRecords=%v seed=%v\n", len(samples), nRecords, cfg.Seed)
+	}
+
+	log.Printf("Starting verification nWorkers=%v report=%v\n", cfg.NWorkers, path)
+	err = verifyTable(cfg, newCursor, samples, report, check)
+	if samples != nil {
+		// The bound is on the rate of failing records, so it counts failed
+		// accounts out of the distinct accounts verified.
+		report.summary.Confidence = confidenceStatement(report.summary.NFailedAccounts, report.summary.NAccounts)
+	}
+	summary, closeErr := report.Close()
+	if err := errors.Join(err, closeErr); err != nil {
+		return err
+	}
+
+	log.Println("Verification complete")
+	summary.log()
+	return summary.Err(path)
+}
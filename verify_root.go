@@ -0,0 +1,149 @@
+package ethdataset
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+type VerifyStateRootConfig struct {
+	// StateRoot defaults to the root pinned in the work dir's manifest.
+	StateRoot string `toml:"state_root"`
+	WorkDir   string `toml:"work_dir"`
+	// StorageRoots also recomputes every account's storage root from the
+	// storage table.
+	StorageRoots bool `toml:"storage_roots"`
+
+	VerifyRunConfig VerifyRunConfig `toml:"verify_config"`
+	PebbleConfig    PebbleConfig    `toml:"pebble_config"`
+}
+
+func (c *VerifyStateRootConfig) Defaults() {
+	c.VerifyRunConfig.defaults()
+	c.PebbleConfig.defaults(ProfileReadMostly)
+}
+
+func (c *VerifyStateRootConfig) Validate() error {
+	return errors.Join(
+		validateHash("state_root", c.StateRoot),
+		requireField("work_dir", c.WorkDir),
+		c.VerifyRunConfig.validate("verify_config"),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+}
+
+// stackTrieRoot streams every record of iter, which must be in key order,
+// through a StackTrie and returns the root of the trie they form along with
+// the number of records.
+func stackTrieRoot(iter *pebble.Iterator, keyOffset int, progress func(n int)) (common.Hash, int, error) {
+	st := trie.NewStackTrie(nil)
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := st.Update(iter.Key()[keyOffset:], iter.Value()); err != nil {
+			return common.Hash{}, n, err
+		}
+		n += 1
+		if progress != nil {
+			progress(n)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return common.Hash{}, n, err
+	}
+	return st.Hash(), n, nil
+}
+
+// VerifyStateRoot recomputes the state root from the accounts table and
+// compares it to the pinned root. Unlike verifying proofs this also proves the
+// table is complete: a missing, extra or altered account changes the root.
+// With storage_roots set, every account's storage root is recomputed from the
+// storage table as well.
+func VerifyStateRoot(cfg VerifyStateRootConfig) error {
+	tables := []string{"accounts"}
+	if cfg.StorageRoots {
+		tables = append(tables, "storage")
+	}
+	m, err := requireTables(cfg.WorkDir, tables...)
+	if err != nil {
+		return err
+	}
+	if err := requireStateRoot(cfg.WorkDir, m, cfg.StateRoot); err != nil {
+		return err
+	}
+	stateRoot := m.StateRoot
+	log.Printf("StateRoot=%v\n", stateRoot)
+
+	accountDB, err := openPebbleDBReadOnly(cfg.WorkDir, "accounts", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer accountDB.Close()
+
+	iter, err := accountDB.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	log.Println("Recomputing StateRoot")
+	start := time.Now()
+	gotStateRoot, nAccounts, err := stackTrieRoot(iter, 0, func(n int) {
+		if n%1_000_000 == 0 {
+			log.Printf("nAccounts=%v %v\n", n, time.Since(start))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Recomputed StateRoot=%v from nAccounts=%v in %v\n", gotStateRoot, nAccounts, time.Since(start))
+	if want := m.Tables["accounts"].NRecords; uint64(nAccounts) != want {
+		log.Printf("accounts holds %v accounts, the manifest says %v\n", nAccounts, want)
+	}
+	if gotStateRoot != stateRoot {
+		return fmt.Errorf("%w: recomputed StateRoot=%v, want StateRoot=%v", ErrVerificationFailed, gotStateRoot, stateRoot)
+	}
+	if !cfg.StorageRoots {
+		return nil
+	}
+
+	storageDB, err := openPebbleDBReadOnly(cfg.WorkDir, "storage", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer storageDB.Close()
+
+	log.Println("Recomputing storage roots")
+	return runVerification(cfg.VerifyRunConfig, cfg.WorkDir, "verify-state-root", pebbleCursor(accountDB), uint64(nAccounts), func(addressHashBytes, accountBytes []byte, r *AccountReport) error {
+		var account SlimAccount
+		if err := rlp.DecodeBytes(accountBytes, &account); err != nil {
+			return corruptRecord("accounts", addressHashBytes, err)
+		}
+		if bytes.Equal(account.Root, types.EmptyRootHash.Bytes()) {
+			return nil
+		}
+
+		storageIter, err := storageDB.NewIter(PrefixIterOptions(addressHashBytes))
+		if err != nil {
+			return err
+		}
+		defer storageIter.Close()
+
+		storageRoot, nSlots, err := stackTrieRoot(storageIter, 32, nil)
+		if err != nil {
+			return err
+		}
+		r.NSlots = nSlots
+		if want := common.BytesToHash(account.Root); storageRoot != want {
+			r.fail(FailureStorageRootMismatch, nil, "recomputed storage root %v from %v slots, want %v", storageRoot, nSlots, want)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,58 @@
+package ethdataset
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// sampleConfidence is the confidence level of the failure rate bound reported
+// for sampled verification.
+const sampleConfidence = 0.95
+
+// samples returns the address hashes to sample out of nRecords, or nil if
+// everything should be verified. Keys are drawn uniformly from the whole
+// keyspace rather than taken from the front of the table, and the same seed
+// always gives the same keys. Each key selects the record at or after it, so
+// nRecords only sizes sample_rate and doesn't have to be exact.
+func (c VerifyRunConfig) samples(nRecords uint64) [][]byte {
+	n := c.SampleCount
+	if n == 0 && c.SampleRate > 0 {
+		n = max(uint64(math.Ceil(c.SampleRate*float64(nRecords))), 1)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	rng := rand.New(rand.NewSource(c.Seed))
+	samples := make([][]byte, n)
+	for i := range samples {
+		samples[i] = make([]byte, sizeOfAddressHash)
+		rng.Read(samples[i])
+	}
+	return samples
+}
+
+// confidenceStatement bounds the failure rate of the whole table given
+// nFailed failing records out of n distinct sampled records, e.g. "0 of 1000000
+// sampled records failed: failure rate below 3.0e-06 with 95% confidence".
+// nFailed can't be more than n.
+func confidenceStatement(nFailed, n uint64) string {
+	if n == 0 {
+		return "no records sampled"
+	}
+	prefix := fmt.Sprintf("%v of %v sampled records failed", nFailed, n)
+	if nFailed == 0 {
+		// Exact binomial bound: the largest rate for which seeing no failures
+		// still has probability 1 - sampleConfidence.
+		upper := 1 - math.Pow(1-sampleConfidence, 1/float64(n))
+		return fmt.Sprintf("%v: failure rate below %.1e with %.0f%% confidence", prefix, upper, sampleConfidence*100)
+	}
+
+	// Wilson score interval, which holds up for rates close to 0.
+	z := 1.959963984540054
+	nf := float64(n)
+	p := float64(nFailed) / nf
+	upper := (p + z*z/(2*nf) + z*math.Sqrt(p*(1-p)/nf+z*z/(4*nf*nf))) / (1 + z*z/nf)
+	return fmt.Sprintf("%v: estimated failure rate %.1e, below %.1e with %.0f%% confidence", prefix, p, upper, sampleConfidence*100)
+}
@@ -0,0 +1,207 @@
+package ethdataset
+
+import (
+	"bytes"
+	"errors"
+	"log"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+type VerifyStorageConfig struct {
+	StateRoot string `toml:"state_root"`
+	// WorkDir holds the accounts and storage tables.
+	WorkDir string `toml:"work_dir"`
+	// ProofDir holds slotAndIndexToProofIds and the storage ProofDB, i.e. the
+	// output_dir of export storage-proofs. Defaults to work_dir.
+	ProofDir string `toml:"proof_dir"`
+
+	VerifyRunConfig VerifyRunConfig `toml:"verify_config"`
+	PebbleConfig    PebbleConfig    `toml:"pebble_config"`
+}
+
+func (c *VerifyStorageConfig) Defaults() {
+	c.VerifyRunConfig.defaults()
+	c.PebbleConfig.defaults(ProfileReadMostly)
+}
+
+func (c *VerifyStorageConfig) Validate() error {
+	return errors.Join(
+		requireField("state_root", c.StateRoot),
+		validateHash("state_root", c.StateRoot),
+		requireField("work_dir", c.WorkDir),
+		c.VerifyRunConfig.validate("verify_config"),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+}
+
+// storageProofVerifier checks the storage proofs written by
+// ExportStorageProofs against the values in the storage table.
+type storageProofVerifier struct {
+	storage    *pebble.DB
+	slotProofs *pebble.DB
+	proofDB    *ProofDB
+}
+
+// openStorageProofVerifier opens the storage proof tables in proofDir. The
+// storage table is borrowed and not closed by Close.
+func openStorageProofVerifier(storage *pebble.DB, proofDir string, pc PebbleConfig) (*storageProofVerifier, error) {
+	m, err := requireTables(proofDir, "slotAndIndexToProofIds")
+	if err != nil {
+		return nil, err
+	}
+	// The storage proofs may share the account ProofDB.
+	scope := storageProofScope(m)
+	_, idToSegmentName := proofTableNames(scope, ProofIndexSegment)
+	if _, err := requireTables(proofDir, idToSegmentName); err != nil {
+		return nil, err
+	}
+	slotProofs, err := openPebbleDBReadOnly(proofDir, "slotAndIndexToProofIds", pc)
+	if err != nil {
+		return nil, err
+	}
+	proofDB, err := OpenScopedProofDBReadOnly(proofDir, scope, pc)
+	if err != nil {
+		slotProofs.Close()
+		return nil, err
+	}
+	return &storageProofVerifier{
+		storage:    storage,
+		slotProofs: slotProofs,
+		proofDB:    proofDB,
+	}, nil
+}
+
+func (v *storageProofVerifier) Close() error {
+	return errors.Join(v.slotProofs.Close(), v.proofDB.Close())
+}
+
+// verifyAccount verifies every slot of r.Account against storageRoot. Slots
+// that fail are recorded in r; the error is only set if the tables can't be
+// read.
+func (v *storageProofVerifier) verifyAccount(r *AccountReport, storageRoot common.Hash) error {
+	addressHash := r.Account
+
+	storageIt, err := v.storage.NewIter(PrefixIterOptions(addressHash.Bytes()))
+	if err != nil {
+		return err
+	}
+	defer storageIt.Close()
+	proofIt, err := v.slotProofs.NewIter(PrefixIterOptions(addressHash.Bytes()))
+	if err != nil {
+		return err
+	}
+	defer proofIt.Close()
+
+	// Both tables are keyed by addressHash ++ slotHash, so walk them together
+	// to catch slots that are only in one of them.
+	storageOk, proofOk := storageIt.First(), proofIt.First()
+	for storageOk || proofOk {
+		c := 0
+		switch {
+		case !proofOk:
+			c = -1
+		case !storageOk:
+			c = 1
+		default:
+			c = bytes.Compare(storageIt.Key(), proofIt.Key())
+		}
+
+		switch {
+		case c < 0:
+			r.NSlots += 1
+			r.fail(FailureMissingProofId, storageIt.Key()[32:], "no proof ids in slotAndIndexToProofIds")
+			storageOk = storageIt.Next()
+		case c > 0:
+			r.NSlots += 1
+			r.fail(FailureMissingStorage, proofIt.Key()[32:], "no value in storage")
+			proofOk = proofIt.Next()
+		default:
+			r.NSlots += 1
+			if err := v.verifySlot(r, storageRoot, proofIt.Key()[32:], proofIt.Value(), storageIt.Value()); err != nil {
+				return err
+			}
+			storageOk, proofOk = storageIt.Next(), proofIt.Next()
+		}
+	}
+	if err := errors.Join(storageIt.Error(), proofIt.Error()); err != nil {
+		return err
+	}
+	if r.NSlots == 0 {
+		r.fail(FailureMissingStorage, nil, "non-empty storage root but no slots exported")
+	}
+	return nil
+}
+
+func (v *storageProofVerifier) verifySlot(r *AccountReport, storageRoot common.Hash, slot, proofIdBytes, want []byte) error {
+	proof, err := v.proofDB.RecoverProof(bytesToUint64(proofIdBytes))
+	if errors.Is(err, ErrNotFound) {
+		r.fail(FailureMissingProofId, slot, "%v", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	got, err := trie.VerifyProof(storageRoot, slot, NewProofKV(proof))
+	switch {
+	case err != nil:
+		r.fail(FailureBadProof, slot, "%v", err)
+	case got == nil:
+		r.fail(FailureBadProof, slot, "proof shows the slot is absent")
+	case !bytes.Equal(got, want):
+		r.fail(FailureValueMismatch, slot, "proven value %x does not match stored value %x", got, want)
+	}
+	return nil
+}
+
+// VerifyStorage verifies every exported storage slot proof against its
+// account's storage root and checks the proven values match the storage
+// table.
+func VerifyStorage(cfg VerifyStorageConfig) error {
+	proofDir := cfg.ProofDir
+	if proofDir == "" {
+		proofDir = cfg.WorkDir
+	}
+
+	m, err := requireTables(cfg.WorkDir, "accounts", "storage")
+	if err != nil {
+		return err
+	}
+	if err := requireStateRoot(cfg.WorkDir, m, cfg.StateRoot); err != nil {
+		return err
+	}
+
+	log.Println("Opening DBs")
+
+	accountDB, err := openPebbleDBReadOnly(cfg.WorkDir, "accounts", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer accountDB.Close()
+	storageDB, err := openPebbleDBReadOnly(cfg.WorkDir, "storage", cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer storageDB.Close()
+	verifier, err := openStorageProofVerifier(storageDB, proofDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer verifier.Close()
+
+	return runVerification(cfg.VerifyRunConfig, cfg.WorkDir, "verify-storage", pebbleCursor(accountDB), m.Tables["accounts"].NRecords, func(addressHashBytes, accountBytes []byte, r *AccountReport) error {
+		var account SlimAccount
+		if err := rlp.DecodeBytes(accountBytes, &account); err != nil {
+			return corruptRecord("accounts", addressHashBytes, err)
+		}
+		if bytes.Equal(account.Root, types.EmptyRootHash.Bytes()) {
+			return nil
+		}
+		return verifier.verifyAccount(r, common.BytesToHash(account.Root))
+	})
+}
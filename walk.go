@@ -0,0 +1,350 @@
+package ethdataset
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/triedb"
+)
+
+type WalkConfig struct {
+	// NWorkers is the number of goroutines walking the account trie.
+	NWorkers int `toml:"n_workers"`
+	// PrefixNibbles splits the account trie into 16^PrefixNibbles ranges.
+	PrefixNibbles int `toml:"prefix_nibbles"`
+}
+
+func (c WalkConfig) workers() int {
+	return max(c.NWorkers, 1)
+}
+
+// maxPrefixNibbles caps the walk at 16^4 ranges, beyond which the checkpoint
+// is mostly bookkeeping.
+const maxPrefixNibbles = 4
+
+func (c *WalkConfig) defaults() {
+	c.NWorkers = 1
+}
+
+func (c WalkConfig) validate(prefix string) error {
+	var errs []error
+	if c.NWorkers < 1 {
+		errs = append(errs, &ConfigError{Field: prefix + ".n_workers", Reason: "must be at least 1"})
+	}
+	if c.PrefixNibbles < 0 || c.PrefixNibbles > maxPrefixNibbles {
+		errs = append(errs, &ConfigError{Field: prefix + ".prefix_nibbles", Reason: fmt.Sprintf("must be between 0 and %v", maxPrefixNibbles)})
+	}
+	return errors.Join(errs...)
+}
+
+func (c WalkConfig) ranges() []KeyRange {
+	nibbles := c.PrefixNibbles
+	if nibbles == 0 && c.workers() > 1 {
+		nibbles = 2
+	}
+	return NibblePrefixRanges(nibbles)
+}
+
+// KeyRange is the half open interval [Start, End) of trie keys. A nil End is
+// unbounded.
+type KeyRange struct {
+	Start []byte
+	End   []byte
+}
+
+// NibblePrefixRanges splits the keyspace into one range per nibble prefix of
+// the given length.
+func NibblePrefixRanges(nibbles int) []KeyRange {
+	if nibbles <= 0 {
+		return []KeyRange{{}}
+	}
+	nBytes := (nibbles + 1) / 2
+	shift := uint(nBytes*8 - nibbles*4)
+	n := 1 << (4 * nibbles)
+
+	key := func(i int) []byte {
+		b := make([]byte, nBytes)
+		v := uint64(i) << shift
+		for j := nBytes - 1; j >= 0; j-- {
+			b[j] = byte(v)
+			v >>= 8
+		}
+		return b
+	}
+
+	ranges := make([]KeyRange, n)
+	for i := 0; i < n; i++ {
+		ranges[i].Start = key(i)
+		if i+1 < n {
+			ranges[i].End = key(i + 1)
+		}
+	}
+	return ranges
+}
+
+// Flusher is anything that can make its writes durable, e.g. a *pebble.DB, a
+// *ProofDB or a *BulkLoader.
+type Flusher interface {
+	Flush() error
+}
+
+// StateWalk runs a partitioned, checkpointed walk over the account trie.
+type StateWalk struct {
+	cfg       WalkConfig
+	trieDB    *triedb.Database
+	stateRoot common.Hash
+
+	workDir string
+	name    string
+
+	// Limit caps the number of accounts visited across all ranges, 0 for no cap.
+	Limit uint64
+	// Flush is flushed before every checkpoint so that everything written for
+	// the checkpointed keys is durable.
+	Flush []Flusher
+	// OnCheckpoint lets the caller record extra state before a checkpoint is
+	// written.
+	OnCheckpoint func(cp *Checkpoint)
+
+	mu     sync.Mutex
+	saveMu sync.Mutex
+	cp     *Checkpoint
+	total  atomic.Uint64
+}
+
+// NewStateWalk loads the checkpoint for name in workDir, if any. An empty name
+// disables checkpointing.
+func NewStateWalk(cfg WalkConfig, trieDB *triedb.Database, stateRoot common.Hash, workDir, name string) (*StateWalk, error) {
+	var cp *Checkpoint
+	if name != "" {
+		var err error
+		cp, err = resumeCheckpoint(workDir, name, stateRoot, cfg.ranges())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cp = &Checkpoint{StateRoot: stateRoot}
+		for _, r := range cfg.ranges() {
+			cp.Ranges = append(cp.Ranges, RangeCheckpoint{Start: r.Start, End: r.End})
+		}
+	}
+	sw := &StateWalk{
+		cfg:       cfg,
+		trieDB:    trieDB,
+		stateRoot: stateRoot,
+		workDir:   workDir,
+		name:      name,
+		cp:        cp,
+	}
+	sw.total.Store(cp.NAccounts)
+	return sw, nil
+}
+
+func (sw *StateWalk) Checkpoint() *Checkpoint {
+	return sw.cp
+}
+
+func (sw *StateWalk) limitReached(n uint64) bool {
+	return sw.Limit != 0 && n >= sw.Limit
+}
+
+// reserve claims the next account, returning its 1-based count, or false
+// once Limit accounts have been claimed. Workers reserve before visiting, so
+// together they never visit more than Limit.
+func (sw *StateWalk) reserve() (uint64, bool) {
+	for {
+		n := sw.total.Load()
+		if sw.limitReached(n) {
+			return 0, false
+		}
+		if sw.total.CompareAndSwap(n, n+1) {
+			return n + 1, true
+		}
+	}
+}
+
+// LimitReached reports whether the walk stopped at Limit. The checkpoint is
+// then left incomplete, so a rerun with a larger Limit carries on from it.
+func (sw *StateWalk) LimitReached() bool {
+	return sw.limitReached(sw.total.Load())
+}
+
+// Run calls visit for every account not covered by the checkpoint. visit is
+// called concurrently from cfg.NWorkers goroutines, but never concurrently for
+// the same range. The first error stops the walk and is returned.
+func (sw *StateWalk) Run(visit func(it *trie.Iterator) error) error {
+	return sw.RunRanges(func(_ int, it *trie.Iterator) error {
+		return visit(it)
+	})
+}
+
+// RunRanges is Run but also passes visit the index of the range being walked.
+// Keys within a range are visited in increasing order, so each range can be
+// bulk loaded as one sorted run.
+func (sw *StateWalk) RunRanges(visit func(r int, it *trie.Iterator) error) error {
+	if sw.cp.Complete {
+		return nil
+	}
+
+	work := make(chan int, len(sw.cp.Ranges))
+	for i, r := range sw.cp.Ranges {
+		if !r.Complete {
+			work <- i
+		}
+	}
+	close(work)
+
+	log.Printf("Starting iteration ranges=%v workers=%v\n", len(work), sw.cfg.workers())
+
+	start := time.Now()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		failed   atomic.Bool
+	)
+	for w := 0; w < sw.cfg.workers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if failed.Load() || sw.limitReached(sw.total.Load()) {
+					return
+				}
+				if err := sw.walkRange(i, start, &failed, visit); err != nil {
+					errOnce.Do(func() { firstErr = err })
+					failed.Store(true)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		// Keep whatever progress was made so a rerun resumes from it.
+		if err := sw.save(); err != nil {
+			log.Printf("Failed to save checkpoint: %v\n", err)
+		}
+		return firstErr
+	}
+
+	sw.mu.Lock()
+	sw.cp.NAccounts = sw.total.Load()
+	sw.cp.Complete = true
+	for _, r := range sw.cp.Ranges {
+		if !r.Complete {
+			sw.cp.Complete = false
+		}
+	}
+	sw.mu.Unlock()
+	if err := sw.save(); err != nil {
+		return err
+	}
+
+	log.Printf("Finished iteration Accounts=%v Elapsed=%v\n", sw.cp.NAccounts, time.Since(start))
+	return nil
+}
+
+func (sw *StateWalk) walkRange(i int, start time.Time, failed *atomic.Bool, visit func(r int, it *trie.Iterator) error) error {
+	sw.mu.Lock()
+	r := sw.cp.Ranges[i]
+	sw.mu.Unlock()
+
+	tr, err := trie.New(trie.StateTrieID(sw.stateRoot), sw.trieDB)
+	if err != nil {
+		return err
+	}
+
+	from := []byte(r.Start)
+	if len(r.LastKey) != 0 {
+		from = r.LastKey
+	}
+	var end []byte
+	if len(r.End) != 0 {
+		end = r.End
+	}
+	nodeIt, err := tr.NodeIteratorWithRange(from, end)
+	if err != nil {
+		return err
+	}
+	it := trie.NewIterator(nodeIt)
+
+	for it.Next() {
+		if len(r.LastKey) != 0 && bytes.Equal(it.Key, r.LastKey) {
+			continue
+		}
+		if failed.Load() {
+			return nil
+		}
+		n, ok := sw.reserve()
+		if !ok {
+			return nil
+		}
+
+		if err := visit(i, it); err != nil {
+			return fmt.Errorf("account %x: %w", it.Key, err)
+		}
+
+		sw.mu.Lock()
+		sw.cp.Ranges[i].LastKey = it.Key
+		sw.cp.Ranges[i].NAccounts += 1
+		sw.mu.Unlock()
+
+		if n%checkpointInterval == 0 {
+			elapsed := time.Since(start)
+			accountsPerSec := float64(n) / elapsed.Seconds()
+			log.Printf("Accounts=%v Elapsed=%v AccountsPerSec=%v\n", n, elapsed, accountsPerSec)
+			if err := sw.save(); err != nil {
+				return err
+			}
+		}
+	}
+	if it.Err != nil {
+		return it.Err
+	}
+
+	sw.mu.Lock()
+	sw.cp.Ranges[i].Complete = true
+	sw.mu.Unlock()
+	return nil
+}
+
+// save snapshots the checkpoint, flushes every table written for the
+// snapshotted keys and then persists the snapshot.
+func (sw *StateWalk) save() error {
+	if sw.name == "" {
+		return nil
+	}
+
+	sw.saveMu.Lock()
+	defer sw.saveMu.Unlock()
+
+	sw.mu.Lock()
+	snapshot := *sw.cp
+	snapshot.Ranges = append([]RangeCheckpoint(nil), sw.cp.Ranges...)
+	snapshot.NAccounts = 0
+	for _, r := range snapshot.Ranges {
+		snapshot.NAccounts += r.NAccounts
+	}
+	sw.mu.Unlock()
+
+	if sw.OnCheckpoint != nil {
+		sw.OnCheckpoint(&snapshot)
+	}
+
+	for _, f := range sw.Flush {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return WriteCheckpoint(sw.workDir, sw.name, &snapshot)
+}
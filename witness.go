@@ -0,0 +1,450 @@
+package ethdataset
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// WitnessKey is an account, and optionally some of its slots, to prove in a
+// Witness.
+type WitnessKey struct {
+	AddressHash common.Hash
+	// SlotHashes are the keccak hashes of the slots to prove.
+	SlotHashes []common.Hash
+}
+
+// Witness proves a set of accounts and slots against one state root at once.
+// Nodes is the union of their proofs with every node once, so the nodes that
+// proofs share, the top of the account trie above all, aren't repeated.
+type Witness struct {
+	StateRoot common.Hash
+	Keys      []WitnessKey
+	Nodes     [][]byte
+}
+
+// ProvenAccount is what a Witness proves about one WitnessKey.
+type ProvenAccount struct {
+	AddressHash common.Hash
+	// Account is the account RLP, nil if there is no account.
+	Account []byte
+	// Slots are the values of the key's slots in order, nil for empty slots.
+	Slots [][]byte
+}
+
+// witnessKV serves the nodes of a witness to trie.VerifyProof and records
+// which of them were read.
+type witnessKV struct {
+	nodes map[common.Hash][]byte
+	used  map[common.Hash]struct{}
+}
+
+func (kv *witnessKV) Has(key []byte) (bool, error) {
+	_, ok := kv.nodes[common.BytesToHash(key)]
+	return ok, nil
+}
+
+func (kv *witnessKV) Get(key []byte) ([]byte, error) {
+	hash := common.BytesToHash(key)
+	node, ok := kv.nodes[hash]
+	if !ok {
+		return nil, nil
+	}
+	kv.used[hash] = struct{}{}
+	return node, nil
+}
+
+// Verify checks every key of w against w.StateRoot in one pass: each node is
+// hashed once and every proof is walked through the same node set. It fails
+// if a key isn't proven, or if w holds duplicate nodes or nodes no key needs,
+// so a witness that verifies is also minimal.
+func (w *Witness) Verify() ([]ProvenAccount, error) {
+	kv := &witnessKV{
+		nodes: make(map[common.Hash][]byte, len(w.Nodes)),
+		used:  make(map[common.Hash]struct{}, len(w.Nodes)),
+	}
+	for _, node := range w.Nodes {
+		kv.nodes[crypto.Keccak256Hash(node)] = node
+	}
+	if len(kv.nodes) != len(w.Nodes) {
+		return nil, fmt.Errorf("witness has %v duplicate nodes", len(w.Nodes)-len(kv.nodes))
+	}
+
+	proven := make([]ProvenAccount, len(w.Keys))
+	for i, key := range w.Keys {
+		p := ProvenAccount{AddressHash: key.AddressHash}
+		var err error
+		if w.StateRoot != types.EmptyRootHash {
+			p.Account, err = trie.VerifyProof(w.StateRoot, key.AddressHash.Bytes(), kv)
+			if err != nil {
+				return nil, fmt.Errorf("account %v: %w", key.AddressHash, err)
+			}
+		}
+
+		storageRoot := types.EmptyRootHash
+		if p.Account != nil && len(key.SlotHashes) > 0 {
+			var account SlimAccount
+			if err := rlp.DecodeBytes(p.Account, &account); err != nil {
+				return nil, fmt.Errorf("account %v: %w", key.AddressHash, err)
+			}
+			if len(account.Root) != 0 {
+				storageRoot = common.BytesToHash(account.Root)
+			}
+		}
+		for _, slotHash := range key.SlotHashes {
+			var value []byte
+			if storageRoot != types.EmptyRootHash {
+				value, err = trie.VerifyProof(storageRoot, slotHash.Bytes(), kv)
+				if err != nil {
+					return nil, fmt.Errorf("account %v slot %v: %w", key.AddressHash, slotHash, err)
+				}
+			}
+			p.Slots = append(p.Slots, value)
+		}
+		proven[i] = p
+	}
+
+	if unused := len(kv.nodes) - len(kv.used); unused > 0 {
+		return nil, fmt.Errorf("%v of %v witness nodes aren't needed by any key", unused, len(kv.nodes))
+	}
+	return proven, nil
+}
+
+// WitnessBuilder assembles witnesses from exported proof tables.
+type WitnessBuilder struct {
+	stateRoot      common.Hash
+	accountToProof *pebble.DB
+	// absentToProof and slotProofs are nil if they weren't exported.
+	absentToProof *pebble.DB
+	slotProofs    *pebble.DB
+	proofDB       *ProofDB
+	// storageProofDB is proofDB if the storage proofs share it.
+	storageProofDB *ProofDB
+}
+
+// OpenWitnessBuilder opens the account proofs in workDir and, if exported,
+// the exclusion proofs there and the storage proofs in proofDir, the
+// output_dir of export storage-proofs.
+func OpenWitnessBuilder(workDir, proofDir string, pc PebbleConfig) (_ *WitnessBuilder, err error) {
+	m, err := requireTables(workDir, "accountToProof", "idToProofSegment")
+	if err != nil {
+		return nil, err
+	}
+	b := &WitnessBuilder{stateRoot: m.StateRoot}
+	defer func() {
+		if err != nil {
+			b.Close()
+		}
+	}()
+
+	if b.accountToProof, err = openPebbleDBReadOnly(workDir, "accountToProof", pc); err != nil {
+		return nil, err
+	}
+	if b.proofDB, err = OpenProofDBReadOnly(workDir, pc); err != nil {
+		return nil, err
+	}
+	if m.Tables["absentToProof"] != nil {
+		if _, err := requireTables(workDir, "absentToProof"); err != nil {
+			return nil, err
+		}
+		if b.absentToProof, err = openPebbleDBReadOnly(workDir, "absentToProof", pc); err != nil {
+			return nil, err
+		}
+	}
+
+	pm, err := ReadManifest(proofDir)
+	if err != nil || pm == nil || pm.Tables["slotAndIndexToProofIds"] == nil {
+		return b, err
+	}
+	if pm.StateRoot != m.StateRoot {
+		return nil, fmt.Errorf("%v was exported from StateRoot=%v, %v from StateRoot=%v", proofDir, pm.StateRoot, workDir, m.StateRoot)
+	}
+	scope := storageProofScope(pm)
+	_, idToSegmentName := proofTableNames(scope, ProofIndexSegment)
+	if _, err := requireTables(proofDir, "slotAndIndexToProofIds", idToSegmentName); err != nil {
+		return nil, err
+	}
+	if b.slotProofs, err = openPebbleDBReadOnly(proofDir, "slotAndIndexToProofIds", pc); err != nil {
+		return nil, err
+	}
+	if scope == "" && filepath.Clean(proofDir) == filepath.Clean(workDir) {
+		b.storageProofDB = b.proofDB
+		return b, nil
+	}
+	if b.storageProofDB, err = OpenScopedProofDBReadOnly(proofDir, scope, pc); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// accountProofIds returns the ids of the inclusion or exclusion proof of
+// addressHash.
+func (b *WitnessBuilder) accountProofIds(addressHash common.Hash) ([]uint64, error) {
+	value, err := pebbleGet(b.accountToProof, addressHash.Bytes())
+	if err != nil || value != nil {
+		return bytesToUint64(value), err
+	}
+	if b.absentToProof != nil {
+		value, err := pebbleGet(b.absentToProof, addressHash.Bytes())
+		if err != nil || value != nil {
+			return bytesToUint64(value), err
+		}
+	}
+	return nil, fmt.Errorf("no inclusion or exclusion proof for account %v: %w", addressHash, ErrNotFound)
+}
+
+func (b *WitnessBuilder) slotProofIds(addressHash, slotHash common.Hash) ([]uint64, error) {
+	if b.slotProofs == nil {
+		return nil, fmt.Errorf("slot %v of account %v: no storage proofs were exported", slotHash, addressHash)
+	}
+	key := append(addressHash.Bytes(), slotHash.Bytes()...)
+	value, err := pebbleGet(b.slotProofs, key)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, notFound("slotAndIndexToProofIds", key)
+	}
+	return bytesToUint64(value), nil
+}
+
+// Build returns the witness of keys. Every id is read from idToProofSegment
+// once, in id order, and nodes found in both the account and the storage
+// ProofDB are kept once. nProofNodes is how many nodes the keys' proofs have
+// together, i.e. the size of the witness without deduplication.
+//
+// Accounts without an account need an exported exclusion proof, and slots
+// can only be proven if they are in slotAndIndexToProofIds.
+func (b *WitnessBuilder) Build(keys []WitnessKey) (w *Witness, nProofNodes int, err error) {
+	accountIds := make(map[uint64]struct{})
+	storageIds := make(map[uint64]struct{})
+	if b.storageProofDB == b.proofDB {
+		storageIds = accountIds
+	}
+	for _, key := range keys {
+		ids, err := b.accountProofIds(key.AddressHash)
+		if err != nil {
+			return nil, 0, err
+		}
+		nProofNodes += len(ids)
+		for _, id := range ids {
+			accountIds[id] = struct{}{}
+		}
+		for _, slotHash := range key.SlotHashes {
+			ids, err := b.slotProofIds(key.AddressHash, slotHash)
+			if err != nil {
+				return nil, 0, err
+			}
+			nProofNodes += len(ids)
+			for _, id := range ids {
+				storageIds[id] = struct{}{}
+			}
+		}
+	}
+
+	w = &Witness{StateRoot: b.stateRoot, Keys: keys}
+	seen := make(map[common.Hash]struct{})
+	addNodes := func(pd *ProofDB, ids map[uint64]struct{}) error {
+		sorted := make([]uint64, 0, len(ids))
+		for id := range ids {
+			sorted = append(sorted, id)
+		}
+		slices.Sort(sorted)
+		nodes, err := pd.RecoverProof(sorted)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			hash := crypto.Keccak256Hash(node)
+			if _, ok := seen[hash]; !ok {
+				seen[hash] = struct{}{}
+				w.Nodes = append(w.Nodes, node)
+			}
+		}
+		return nil
+	}
+	if err := addNodes(b.proofDB, accountIds); err != nil {
+		return nil, 0, err
+	}
+	if b.storageProofDB != nil && b.storageProofDB != b.proofDB {
+		if err := addNodes(b.storageProofDB, storageIds); err != nil {
+			return nil, 0, err
+		}
+	}
+	return w, nProofNodes, nil
+}
+
+func (b *WitnessBuilder) Close() error {
+	var errs []error
+	for _, db := range []*pebble.DB{b.accountToProof, b.absentToProof, b.slotProofs} {
+		if db != nil {
+			errs = append(errs, db.Close())
+		}
+	}
+	if b.proofDB != nil {
+		errs = append(errs, b.proofDB.Close())
+	}
+	if b.storageProofDB != nil && b.storageProofDB != b.proofDB {
+		errs = append(errs, b.storageProofDB.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// readWitnessKeys reads one WitnessKey per line of path: an address or
+// address hash as for readKeyList, followed by the hashes of any of its
+// slots, separated by spaces.
+func readWitnessKeys(path string) ([]WitnessKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []WitnessKey
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		addressHash, err := parseAccountKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %w", path, line, err)
+		}
+		key := WitnessKey{AddressHash: addressHash}
+		for _, field := range fields[1:] {
+			if err := validateHash("slot", field); err != nil {
+				return nil, fmt.Errorf("%v:%v: %w", path, line, err)
+			}
+			key.SlotHashes = append(key.SlotHashes, common.HexToHash(field))
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+type BuildWitnessConfig struct {
+	WorkDir string `toml:"work_dir"`
+	// ProofDir holds the storage proofs, as for verify storage-proofs.
+	// Defaults to work_dir.
+	ProofDir string `toml:"proof_dir"`
+	// KeysPath lists the accounts and slots to prove, see readWitnessKeys.
+	KeysPath string `toml:"keys_path"`
+	// OutPath is where the RLP encoded witness is written, by default
+	// witness.rlp in the work dir.
+	OutPath string `toml:"out_path"`
+
+	PebbleConfig PebbleConfig `toml:"pebble_config"`
+}
+
+func (c *BuildWitnessConfig) Defaults() {
+	c.PebbleConfig.defaults(ProfileReadMostly)
+}
+
+func (c *BuildWitnessConfig) Validate() error {
+	return errors.Join(
+		requireField("work_dir", c.WorkDir),
+		requireField("keys_path", c.KeysPath),
+		c.PebbleConfig.validate("pebble_config"),
+	)
+}
+
+// BuildWitness writes the witness of the keys in KeysPath, after checking
+// that it verifies.
+func BuildWitness(cfg BuildWitnessConfig) error {
+	keys, err := readWitnessKeys(cfg.KeysPath)
+	if err != nil {
+		return err
+	}
+	proofDir := cfg.ProofDir
+	if proofDir == "" {
+		proofDir = cfg.WorkDir
+	}
+	outPath := cfg.OutPath
+	if outPath == "" {
+		outPath = filepath.Join(cfg.WorkDir, "witness.rlp")
+	}
+
+	b, err := OpenWitnessBuilder(cfg.WorkDir, proofDir, cfg.PebbleConfig)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	w, nProofNodes, err := b.Build(keys)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Verify(); err != nil {
+		return fmt.Errorf("built witness doesn't verify: %w", err)
+	}
+
+	enc, err := rlp.EncodeToBytes(w)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(outPath, enc, 0o644); err != nil {
+		return err
+	}
+	log.Printf("Wrote witness of nKeys=%v nNodes=%v (nProofNodes=%v) in %v bytes to %v\n", len(keys), len(w.Nodes), nProofNodes, len(enc), outPath)
+	return nil
+}
+
+type VerifyWitnessConfig struct {
+	// StateRoot defaults to the witness' own.
+	StateRoot   string `toml:"state_root"`
+	WitnessPath string `toml:"witness_path"`
+}
+
+func (c *VerifyWitnessConfig) Defaults() {}
+
+func (c *VerifyWitnessConfig) Validate() error {
+	return errors.Join(
+		validateHash("state_root", c.StateRoot),
+		requireField("witness_path", c.WitnessPath),
+	)
+}
+
+// VerifyWitness reads a witness written by BuildWitness, verifies it and
+// prints what it proves.
+func VerifyWitness(cfg VerifyWitnessConfig) error {
+	enc, err := os.ReadFile(cfg.WitnessPath)
+	if err != nil {
+		return err
+	}
+	var w Witness
+	if err := rlp.DecodeBytes(enc, &w); err != nil {
+		return corruptRecord(cfg.WitnessPath, nil, err)
+	}
+	if cfg.StateRoot != "" && w.StateRoot != common.HexToHash(cfg.StateRoot) {
+		return fmt.Errorf("%w: witness is for StateRoot=%v, want StateRoot=%v", ErrVerificationFailed, w.StateRoot, cfg.StateRoot)
+	}
+
+	proven, err := w.Verify()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+	}
+	fmt.Printf("StateRoot=%v nKeys=%v nNodes=%v\n", w.StateRoot, len(w.Keys), len(w.Nodes))
+	for i, p := range proven {
+		if p.Account == nil {
+			fmt.Printf("%v absent\n", p.AddressHash)
+		} else {
+			fmt.Printf("%v %x\n", p.AddressHash, p.Account)
+		}
+		for j, value := range p.Slots {
+			fmt.Printf("  %v %x\n", w.Keys[i].SlotHashes[j], value)
+		}
+	}
+	return nil
+}
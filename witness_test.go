@@ -0,0 +1,82 @@
+package ethdataset
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestWitnessRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	kvs, _ := testAccounts(200)
+	tr := testTrie(t, kvs)
+	exportTestProofs(t, dir, tr, kvs)
+
+	b, err := OpenWitnessBuilder(dir, dir, testPebbleConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var keys []WitnessKey
+	wantNodes := make(map[string]bool)
+	wantProofNodes := 0
+	for k := range kvs {
+		if len(keys) == 20 {
+			break
+		}
+		keys = append(keys, WitnessKey{AddressHash: common.BytesToHash([]byte(k))})
+		proof := prove(t, tr, k)
+		wantProofNodes += len(proof)
+		for _, node := range proof {
+			wantNodes[string(node)] = true
+		}
+	}
+
+	w, nProofNodes, err := b.Build(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nProofNodes != wantProofNodes || len(w.Nodes) != len(wantNodes) {
+		t.Errorf("Build: %v nodes of %v proof nodes, want %v of %v", len(w.Nodes), nProofNodes, len(wantNodes), wantProofNodes)
+	}
+	proven, err := w.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range proven {
+		if p.AddressHash != keys[i].AddressHash || !bytes.Equal(p.Account, []byte(kvs[string(p.AddressHash.Bytes())])) {
+			t.Errorf("proven[%v] = %x: %q, want %x: %q", i, p.AddressHash, p.Account, keys[i].AddressHash, kvs[string(keys[i].AddressHash.Bytes())])
+		}
+	}
+
+	// A witness missing a node, repeating one or carrying one no key needs
+	// doesn't verify.
+	var unneeded []byte
+	for k := range kvs {
+		leaf := prove(t, tr, k)
+		if node := leaf[len(leaf)-1]; !wantNodes[string(node)] {
+			unneeded = node
+			break
+		}
+	}
+	for name, nodes := range map[string][][]byte{
+		"missing":   w.Nodes[1:],
+		"duplicate": append(append([][]byte{}, w.Nodes...), w.Nodes[0]),
+		"unneeded":  append(append([][]byte{}, w.Nodes...), unneeded),
+	} {
+		bad := &Witness{StateRoot: w.StateRoot, Keys: w.Keys, Nodes: nodes}
+		if _, err := bad.Verify(); err == nil {
+			t.Errorf("witness with a %v node verified", name)
+		}
+	}
+
+	// Without exported exclusion proofs an absent account can't be proven.
+	absent := WitnessKey{AddressHash: crypto.Keccak256Hash([]byte("absent"))}
+	if _, _, err := b.Build([]WitnessKey{absent}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Build of an absent account: %v, want ErrNotFound", err)
+	}
+}